@@ -0,0 +1,313 @@
+package acl
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tiger5226/filetransfer/auth"
+	"github.com/tiger5226/filetransfer/storage"
+	"github.com/tiger5226/filetransfer/util"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+// Permission is an action a user may be allowed to perform on a bucket
+type Permission string
+
+// The permissions that can be granted on a bucket. Admin implies every other permission and allows managing the
+// access list of the bucket itself.
+const (
+	Read   Permission = "read"
+	Write  Permission = "write"
+	Delete Permission = "delete"
+	Admin  Permission = "admin"
+)
+
+// Everyone grants permissions to any authenticated caller
+const Everyone = "*"
+
+// ErrForbidden is returned when the caller lacks the permission required on a bucket
+var ErrForbidden = errors.Base("permission denied")
+
+// Default is the access list store consulted by the handlers
+var Default *Store
+
+// Store keeps the access lists of the buckets in a JSON file on disk. A bucket's access list also governs every
+// bucket nested below it unless that bucket has a list of its own. Buckets without any list are open to everyone.
+type Store struct {
+	l     sync.RWMutex
+	path  string
+	rules map[string]map[string][]Permission
+}
+
+// Open loads the access lists from the file at path. A missing file results in an empty store.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, rules: map[string]map[string][]Permission{}}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	err = json.Unmarshal(contents, &s.rules)
+	if err != nil {
+		return nil, errors.Prefix("unable to read access lists: ", err)
+	}
+
+	return s, nil
+}
+
+// ParsePermission validates a permission name
+func ParsePermission(name string) (Permission, error) {
+	switch p := Permission(strings.ToLower(strings.TrimSpace(name))); p {
+	case Read, Write, Delete, Admin:
+		return p, nil
+	default:
+		return "", errors.Err("unknown permission '%s'", name)
+	}
+}
+
+// Allowed reports whether the user holds the permission on the bucket
+func (s *Store) Allowed(user, bucket string, p Permission) bool {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	_, rules, ok := s.governing(bucket)
+	if !ok {
+		return true
+	}
+
+	for _, who := range []string{user, Everyone} {
+		for _, granted := range rules[who] {
+			if granted == p || granted == Admin {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Claim makes the user the administrator of the top level bucket containing bucket, unless that bucket is already
+// governed by an access list. This is how whoever creates a bucket becomes its owner.
+func (s *Store) Claim(user, bucket string) error {
+	top := strings.SplitN(bucket, "/", 2)[0]
+	if top == "" || user == "" {
+		return nil
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	if _, _, ok := s.governing(top); ok {
+		return nil
+	}
+
+	s.rules[top] = map[string][]Permission{user: {Admin}}
+	err := s.save()
+	if err != nil {
+		delete(s.rules, top)
+	}
+	return err
+}
+
+// Grant replaces the permissions of the user on the bucket. Granting no permissions removes the user.
+func (s *Store) Grant(bucket, user string, permissions []Permission) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	previous, existed := s.rules[bucket]
+	updated := map[string][]Permission{}
+	for who, granted := range previous {
+		updated[who] = granted
+	}
+	if len(permissions) == 0 {
+		delete(updated, user)
+	} else {
+		updated[user] = permissions
+	}
+
+	if len(updated) == 0 {
+		delete(s.rules, bucket)
+	} else {
+		s.rules[bucket] = updated
+	}
+
+	err := s.save()
+	if err != nil {
+		if existed {
+			s.rules[bucket] = previous
+		} else {
+			delete(s.rules, bucket)
+		}
+	}
+	return err
+}
+
+// Rules returns the bucket whose access list governs bucket along with a copy of that list
+func (s *Store) Rules(bucket string) (string, map[string][]Permission) {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	governing, rules, ok := s.governing(bucket)
+	if !ok {
+		return "", map[string][]Permission{}
+	}
+
+	copied := make(map[string][]Permission, len(rules))
+	for who, granted := range rules {
+		copied[who] = append([]Permission(nil), granted...)
+	}
+	return governing, copied
+}
+
+// Owners returns the users administering the top level bucket containing bucket, sorted by name
+func (s *Store) Owners(bucket string) []string {
+	top := strings.SplitN(bucket, "/", 2)[0]
+
+	s.l.RLock()
+	defer s.l.RUnlock()
+	owners := make([]string, 0)
+	for who, granted := range s.rules[top] {
+		if who != Everyone && hasPermission(granted, Admin) {
+			owners = append(owners, who)
+		}
+	}
+	sort.Strings(owners)
+	return owners
+}
+
+// Owned returns the top level buckets the user administers, sorted by name
+func (s *Store) Owned(user string) []string {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	owned := make([]string, 0)
+	for bucket, rules := range s.rules {
+		if !strings.Contains(bucket, "/") && hasPermission(rules[user], Admin) {
+			owned = append(owned, bucket)
+		}
+	}
+	sort.Strings(owned)
+	return owned
+}
+
+// Nested returns the buckets below bucket that have an access list of their own, sorted by name
+func (s *Store) Nested(bucket string) []string {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	nested := make([]string, 0)
+	for b := range s.rules {
+		if below(b, bucket) {
+			nested = append(nested, b)
+		}
+	}
+	sort.Strings(nested)
+	return nested
+}
+
+// RemoveBucket removes the access lists of a deleted bucket and every bucket nested below it
+func (s *Store) RemoveBucket(bucket string) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	removed := map[string]map[string][]Permission{}
+	for b, rules := range s.rules {
+		if b == bucket || below(b, bucket) {
+			removed[b] = rules
+			delete(s.rules, b)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	err := s.save()
+	if err != nil {
+		for b, rules := range removed {
+			s.rules[b] = rules
+		}
+	}
+	return err
+}
+
+// below reports whether bucket is nested somewhere below parent
+func below(bucket, parent string) bool {
+	return parent == "" && bucket != "" || strings.HasPrefix(bucket, parent+"/")
+}
+
+// hasPermission reports whether p is among the granted permissions
+func hasPermission(granted []Permission, p Permission) bool {
+	for _, g := range granted {
+		if g == p {
+			return true
+		}
+	}
+	return false
+}
+
+// governing finds the nearest bucket, starting with bucket itself, that has an access list. The caller must hold
+// the lock.
+func (s *Store) governing(bucket string) (string, map[string][]Permission, bool) {
+	for {
+		if rules, ok := s.rules[bucket]; ok {
+			return bucket, rules, true
+		}
+		i := strings.LastIndex(bucket, "/")
+		if i < 0 {
+			break
+		}
+		bucket = bucket[:i]
+	}
+	return "", nil, false
+}
+
+// save writes the access lists to disk. The caller must hold the lock.
+func (s *Store) save() error {
+	for _, rules := range s.rules {
+		for _, granted := range rules {
+			sort.Slice(granted, func(i, j int) bool { return granted[i] < granted[j] })
+		}
+	}
+
+	contents, err := json.MarshalIndent(s.rules, "", "  ")
+	if err != nil {
+		return errors.Err(err)
+	}
+
+	return util.WriteFileAtomic(s.path, contents, 0600)
+}
+
+// Check reports whether the caller of the request holds the permission on the bucket. Admin tokens and servers
+// without an access list store are always allowed, except that pre-signed links never reach beyond what they were
+// issued for.
+func Check(r *http.Request, bucket string, p Permission) bool {
+	token := auth.FromRequest(r)
+	if token != nil && token.Link != nil && !linkAllows(token.Link, bucket, p) {
+		return false
+	}
+	if Default == nil {
+		return true
+	}
+	if token != nil && token.Admin {
+		return true
+	}
+	return Default.Allowed(auth.User(r), bucket, p)
+}
+
+// linkAllows reports whether a pre-signed link covers the permission on the bucket. Download links only read the
+// bucket of their file, which the signature pins down, and upload links only write into their bucket and below.
+func linkAllows(link *auth.Link, bucket string, p Permission) bool {
+	switch link.Kind {
+	case auth.LinkDownload:
+		return p == Read && bucket == storage.BucketOf(link.Target)
+	case auth.LinkUpload:
+		return p == Write && (link.Target == "" || bucket == link.Target || strings.HasPrefix(bucket, link.Target+"/"))
+	}
+	return false
+}
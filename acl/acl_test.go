@@ -0,0 +1,195 @@
+package acl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tiger5226/filetransfer/auth"
+)
+
+func newTestStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "ft-acl-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := Open(filepath.Join(dir, "acl.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestUngovernedBucketsAreOpen(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+
+	for _, p := range []Permission{Read, Write, Delete, Admin} {
+		if !store.Allowed("qa", "scratch", p) {
+			t.Errorf("%s denied on a bucket without an access list", p)
+		}
+	}
+}
+
+func TestClaimProtectsBucket(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+
+	if err := store.Claim("build", "release/1.0"); err != nil {
+		t.Fatal(err)
+	}
+	// A second claim must not take the bucket over
+	if err := store.Claim("qa", "release/2.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !store.Allowed("build", "release/1.0", Write) || !store.Allowed("build", "release", Delete) {
+		t.Error("the creator lost access to its bucket")
+	}
+	if store.Allowed("qa", "release/1.0", Write) || store.Allowed("qa", "release/2.0", Read) {
+		t.Error("another user gained access to a claimed bucket")
+	}
+
+	if err := store.Grant("release", "qa", []Permission{Read}); err != nil {
+		t.Fatal(err)
+	}
+	if !store.Allowed("qa", "release/1.0", Read) || store.Allowed("qa", "release/1.0", Write) {
+		t.Error("read-only grant was not applied to nested buckets")
+	}
+
+	if err := store.Grant("release", Everyone, []Permission{Read}); err != nil {
+		t.Fatal(err)
+	}
+	if !store.Allowed("anyone", "release", Read) {
+		t.Error("grant to everyone was not applied")
+	}
+
+	reloaded, err := Open(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Allowed("qa", "release", Write) || !reloaded.Allowed("qa", "release", Read) {
+		t.Error("access lists did not survive a reload")
+	}
+}
+
+func TestNestedListOverridesParent(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+
+	if err := store.Grant("release", "build", []Permission{Admin}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Grant("release/qa", "qa", []Permission{Read, Write}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !store.Allowed("qa", "release/qa/reports", Write) {
+		t.Error("nested access list was not used")
+	}
+	if store.Allowed("qa", "release/1.0", Read) {
+		t.Error("nested access list leaked to a sibling")
+	}
+
+	governing, _ := store.Rules("release/qa/reports")
+	if governing != "release/qa" {
+		t.Errorf("Rules reported %q as governing", governing)
+	}
+
+	if err := store.Grant("release/qa", "qa", nil); err != nil {
+		t.Fatal(err)
+	}
+	if governing, _ := store.Rules("release/qa"); governing != "release" {
+		t.Errorf("removing the last user did not drop the access list, governed by %q", governing)
+	}
+}
+
+func TestRemoveBucket(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+
+	for _, bucket := range []string{"release", "release/qa", "release/qa/private", "releases"} {
+		if err := store.Grant(bucket, "build", []Permission{Admin}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if nested := store.Nested("release"); len(nested) != 2 || nested[0] != "release/qa" || nested[1] != "release/qa/private" {
+		t.Errorf("Nested returned %v", nested)
+	}
+
+	if err := store.RemoveBucket("release/qa"); err != nil {
+		t.Fatal(err)
+	}
+	if nested := store.Nested("release"); len(nested) != 0 {
+		t.Errorf("the access lists of the removed buckets are left: %v", nested)
+	}
+	if err := store.RemoveBucket("release"); err != nil {
+		t.Fatal(err)
+	}
+	if governing, _ := store.Rules("releases/1.0"); governing != "releases" {
+		t.Errorf("removing a bucket dropped the access list of a sibling, governed by %q", governing)
+	}
+	if governing, _ := store.Rules("release"); governing != "" {
+		t.Errorf("the removed bucket is still governed by %q", governing)
+	}
+}
+
+func TestParsePermission(t *testing.T) {
+	if p, err := ParsePermission(" Write "); err != nil || p != Write {
+		t.Errorf("ParsePermission returned %q, %v", p, err)
+	}
+	if _, err := ParsePermission("execute"); err == nil {
+		t.Error("ParsePermission accepted an unknown permission")
+	}
+}
+
+func TestOwners(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+
+	if err := store.Claim("build", "release/1.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Grant("release", "qa", []Permission{Read}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Grant("release/1.0", "ops", []Permission{Admin}); err != nil {
+		t.Fatal(err)
+	}
+
+	if owners := store.Owners("release/1.0"); len(owners) != 1 || owners[0] != "build" {
+		t.Errorf("unexpected owners %v", owners)
+	}
+	if owned := store.Owned("build"); len(owned) != 1 || owned[0] != "release" {
+		t.Errorf("unexpected owned buckets %v", owned)
+	}
+	if owned := store.Owned("ops"); len(owned) != 0 {
+		t.Errorf("administering a nested bucket counted as ownership: %v", owned)
+	}
+}
+
+func TestLinkAllows(t *testing.T) {
+	download := &auth.Link{Kind: auth.LinkDownload, Target: "builds/app.tar"}
+	upload := &auth.Link{Kind: auth.LinkUpload, Target: "vendor/drop"}
+	cases := []struct {
+		link     *auth.Link
+		bucket   string
+		p        Permission
+		expected bool
+	}{
+		{download, "builds", Read, true},
+		{download, "builds", Write, false},
+		{download, "builds/nightly", Read, false},
+		{upload, "vendor/drop", Write, true},
+		{upload, "vendor/drop/reports", Write, true},
+		{upload, "vendor/dropbox", Write, false},
+		{upload, "vendor/drop", Read, false},
+		{upload, "vendor/drop", Delete, false},
+	}
+	for _, c := range cases {
+		if linkAllows(c.link, c.bucket, c.p) != c.expected {
+			t.Errorf("a %s link for %s allowed %s on %s: %v", c.link.Kind, c.link.Target, c.p, c.bucket, !c.expected)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package actions
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/tiger5226/filetransfer/acl"
+	"github.com/tiger5226/filetransfer/storage"
+
+	"github.com/lbryio/lbry.go/extras/api"
+	"github.com/lbryio/lbry.go/extras/errors"
+	v "github.com/lbryio/ozzo-validation"
+	"github.com/lbryio/ozzo-validation/is"
+)
+
+// BucketACL shows the access list governing a bucket
+func BucketACL(r *http.Request) api.Response {
+	params := struct {
+		Bucket string
+	}{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.Bucket, v.Required, is.PrintableASCII),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	bucket, rsp, ok := adminBucket(r, params.Bucket)
+	if !ok {
+		return rsp
+	}
+
+	governing, rules := acl.Default.Rules(bucket)
+	return api.Response{Data: struct {
+		Bucket      string
+		GovernedBy  string
+		Permissions map[string][]acl.Permission
+	}{bucket, governing, rules}}
+}
+
+// GrantBucket sets the permissions of a user on a bucket. Users may be given as "*" to grant everyone access.
+func GrantBucket(r *http.Request) api.Response {
+	params := struct {
+		Bucket      string
+		User        string
+		Permissions string
+	}{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.Bucket, v.Required, is.PrintableASCII),
+		v.Field(&params.User, v.Required, is.PrintableASCII),
+		v.Field(&params.Permissions, v.Required, is.PrintableASCII),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	permissions := make([]acl.Permission, 0)
+	for _, name := range strings.Split(params.Permissions, ",") {
+		p, err := acl.ParsePermission(name)
+		if err != nil {
+			return api.Response{Error: err, Status: http.StatusBadRequest}
+		}
+		permissions = append(permissions, p)
+	}
+
+	return updateBucketACL(r, params.Bucket, params.User, permissions)
+}
+
+// RevokeBucket removes every permission of a user on a bucket
+func RevokeBucket(r *http.Request) api.Response {
+	params := struct {
+		Bucket string
+		User   string
+	}{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.Bucket, v.Required, is.PrintableASCII),
+		v.Field(&params.User, v.Required, is.PrintableASCII),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	return updateBucketACL(r, params.Bucket, params.User, nil)
+}
+
+// updateBucketACL stores the permissions of a user and responds with the updated access list
+func updateBucketACL(r *http.Request, bucket, user string, permissions []acl.Permission) api.Response {
+	bucket, rsp, ok := adminBucket(r, bucket)
+	if !ok {
+		return rsp
+	}
+
+	err := acl.Default.Grant(bucket, user, permissions)
+	if err != nil {
+		return api.Response{Error: errors.Err(err)}
+	}
+
+	_, rules := acl.Default.Rules(bucket)
+	return api.Response{Data: rules}
+}
+
+// adminBucket cleans the bucket name and makes sure the caller administers it
+func adminBucket(r *http.Request, bucket string) (string, api.Response, bool) {
+	bucket, err := storage.CleanBucket(bucket)
+	if err != nil {
+		return "", api.Response{Error: err, Status: http.StatusBadRequest}, false
+	}
+	if bucket == "" {
+		return "", api.Response{Error: errors.Err("the root bucket has no access list"), Status: http.StatusBadRequest}, false
+	}
+	if acl.Default == nil {
+		return "", api.Response{Error: errors.Err("access lists are not enabled")}, false
+	}
+	if !acl.Check(r, bucket, acl.Admin) {
+		return "", api.Response{Error: errors.Err(acl.ErrForbidden), Status: http.StatusForbidden}, false
+	}
+	return bucket, api.Response{}, true
+}
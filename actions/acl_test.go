@@ -0,0 +1,98 @@
+package actions
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/tiger5226/filetransfer/acl"
+)
+
+func TestBucketACLGrantAndRevoke(t *testing.T) {
+	defer useTestStores(t)()
+
+	if err := acl.Default.Claim("alice", "team"); err != nil {
+		t.Fatal(err)
+	}
+	governedBy := func(bucket string) (string, map[string][]acl.Permission) {
+		response := BucketACL(testRequest(t, "alice", url.Values{"bucket": {bucket}}))
+		if response.Error != nil {
+			t.Fatal(response.Error)
+		}
+		list := response.Data.(struct {
+			Bucket      string
+			GovernedBy  string
+			Permissions map[string][]acl.Permission
+		})
+		return list.GovernedBy, list.Permissions
+	}
+	grant := func(user string, params url.Values) int {
+		response := GrantBucket(testRequest(t, user, params))
+		if response.Error != nil && response.Status == 0 {
+			t.Fatal(response.Error)
+		}
+		return response.Status
+	}
+
+	if response := BucketACL(testRequest(t, "bob", url.Values{"bucket": {"team"}})); response.Status != http.StatusForbidden {
+		t.Errorf("showing the access list without admin rights returned %d", response.Status)
+	}
+	if status := grant("bob", url.Values{"bucket": {"team"}, "user": {"bob"}, "permissions": {"admin"}}); status != http.StatusForbidden {
+		t.Errorf("granting without admin rights returned %d", status)
+	}
+	if status := grant("alice", url.Values{"bucket": {"team"}, "user": {"bob"}, "permissions": {"read,fly"}}); status != http.StatusBadRequest {
+		t.Errorf("granting an unknown permission returned %d", status)
+	}
+	if status := grant("alice", url.Values{"bucket": {""}, "user": {"bob"}, "permissions": {"read"}}); status != http.StatusBadRequest {
+		t.Errorf("granting on the root returned %d", status)
+	}
+
+	// Nested buckets inherit the access list of the team until they have one of their own
+	if status := grant("alice", url.Values{"bucket": {"team"}, "user": {"bob"}, "permissions": {"read, write"}}); status != 0 {
+		t.Fatalf("granting returned %d", status)
+	}
+	if !acl.Default.Allowed("bob", "team/nested/deep", acl.Write) || acl.Default.Allowed("bob", "team/nested/deep", acl.Delete) {
+		t.Error("the nested bucket does not follow the access list of the team")
+	}
+	governing, rules := governedBy("team/nested/deep")
+	expected := map[string][]acl.Permission{"alice": {acl.Admin}, "bob": {acl.Read, acl.Write}}
+	if governing != "team" || !reflect.DeepEqual(rules, expected) {
+		t.Errorf("the nested bucket is governed by %q with %v", governing, rules)
+	}
+
+	// A list of its own replaces that of the team for the bucket and everything below it
+	if status := grant("alice", url.Values{"bucket": {"team/nested"}, "user": {"carol"}, "permissions": {"admin"}}); status != 0 {
+		t.Fatalf("granting on the nested bucket returned %d", status)
+	}
+	if acl.Default.Allowed("bob", "team/nested/deep", acl.Read) || !acl.Default.Allowed("bob", "team/other", acl.Read) {
+		t.Error("the access list of the nested bucket does not replace that of the team")
+	}
+	if response := BucketACL(testRequest(t, "alice", url.Values{"bucket": {"team/nested"}})); response.Status != http.StatusForbidden {
+		t.Errorf("showing an access list alice is not on returned %d", response.Status)
+	}
+	if response := BucketACL(testRequest(t, "carol", url.Values{"bucket": {"team/nested/deep"}})); response.Error != nil {
+		t.Errorf("the admin of the nested bucket could not see its access list: %v", response.Error)
+	}
+
+	// Revoking the last user removes the list, so the team governs again
+	if response := RevokeBucket(testRequest(t, "carol", url.Values{"bucket": {"team/nested"}, "user": {"carol"}})); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if governing, _ := governedBy("team/nested/deep"); governing != "team" {
+		t.Errorf("the nested bucket is governed by %q after its list was emptied", governing)
+	}
+	if response := RevokeBucket(testRequest(t, "bob", url.Values{"bucket": {"team"}, "user": {"alice"}})); response.Status != http.StatusForbidden {
+		t.Errorf("revoking without admin rights returned %d", response.Status)
+	}
+	response := RevokeBucket(testRequest(t, "alice", url.Values{"bucket": {"team"}, "user": {"bob"}}))
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if rules := response.Data.(map[string][]acl.Permission); len(rules) != 1 || acl.Default.Allowed("bob", "team", acl.Read) {
+		t.Errorf("bob kept access to the team: %v", rules)
+	}
+	if response := RevokeBucket(adminRequest(t, url.Values{"bucket": {"team"}, "user": {"alice"}})); response.Error != nil {
+		t.Errorf("an admin token could not revoke: %v", response.Error)
+	}
+}
@@ -2,83 +2,336 @@ package actions
 
 import (
 	"net/http"
-	"os"
-	"path/filepath"
+	"path"
 	"strings"
 	"time"
 
+	"github.com/tiger5226/filetransfer/acl"
+	"github.com/tiger5226/filetransfer/metadata"
+	"github.com/tiger5226/filetransfer/retention"
+	"github.com/tiger5226/filetransfer/storage"
+
 	"github.com/lbryio/lbry.go/extras/api"
 	"github.com/lbryio/lbry.go/extras/errors"
 	v "github.com/lbryio/ozzo-validation"
 	"github.com/lbryio/ozzo-validation/is"
-	"github.com/sirupsen/logrus"
 )
 
-// List generates a list of all the available buckets
+// List generates a tree of the buckets below the requested bucket (the root by default) that the caller is allowed
+// to read, along with their files. The listing can be filtered and sorted, and is paginated through the Next cursor.
 func List(r *http.Request) api.Response {
 	params := struct {
-		Bucket   *string
-		Contains *string
+		Bucket        string
+		Contains      *string
+		Recursive     *bool
+		Depth         int
+		Flat          bool
+		Glob          string
+		MinSize       *int64
+		MaxSize       *int64
+		ModifiedSince string
+		Files         *bool
+		Meta          string
+		Sort          string
+		Order         string
+		Limit         int
+		Cursor        string
 	}{}
 
 	err := api.FormValues(r, &params, []*v.FieldRules{
 		v.Field(&params.Bucket, is.PrintableASCII),
+		v.Field(&params.Depth, v.Min(0)),
+		v.Field(&params.Glob, is.PrintableASCII),
+		v.Field(&params.MinSize, v.Min(0)),
+		v.Field(&params.MaxSize, v.Min(0)),
+		v.Field(&params.Sort, v.In("name", "size", "modified")),
+		v.Field(&params.Order, v.In("asc", "desc")),
+		v.Field(&params.Limit, v.Min(0), v.Max(maxListLimit)),
 	})
 	if err != nil {
-		return api.Response{Error: errors.Err(err)}
+		return api.Response{Error: err, Status: http.StatusBadRequest}
 	}
 
-	currDir, err := os.Getwd()
+	root, err := storage.CleanBucket(params.Bucket)
 	if err != nil {
-		return api.Response{Error: errors.Err(err)}
+		return storageError(err)
+	}
+	if params.Recursive != nil && !*params.Recursive && params.Depth == 0 {
+		params.Depth = 1
+	}
+	if params.Sort == "" {
+		params.Sort = "name"
+	}
+	if params.Order == "" {
+		params.Order = "asc"
+	}
+	if params.Limit == 0 {
+		params.Limit = defaultListLimit
+	}
+	withFiles := params.Files == nil || *params.Files
+	if _, err := path.Match(params.Glob, ""); err != nil {
+		return api.Response{Error: errors.Err("glob: %s", err), Status: http.StatusBadRequest}
+	}
+	var modifiedSince time.Time
+	if params.ModifiedSince != "" {
+		modifiedSince, err = time.Parse(time.RFC3339, params.ModifiedSince)
+		if err != nil {
+			return api.Response{Error: errors.Err("modified_since must be an RFC 3339 time"), Status: http.StatusBadRequest}
+		}
 	}
-	root := currDir + "/data"
-	if filepath.FromSlash(currDir) == filepath.FromSlash("/") {
-		root = currDir + "data"
+	var after *listCursor
+	if params.Cursor != "" {
+		cursor, err := decodeCursor(params.Cursor, params.Sort, params.Order)
+		if err != nil {
+			return api.Response{Error: err, Status: http.StatusBadRequest}
+		}
+		after = &cursor
+	}
+	filters, err := metadata.ParseFilters(params.Meta)
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+	fileFiltered := params.Glob != "" || params.MinSize != nil || params.MaxSize != nil || !modifiedSince.IsZero() || len(filters) > 0
+
+	// level is the number of buckets between the requested bucket and the given one
+	level := func(bucket string) int {
+		if bucket == root {
+			return 0
+		}
+		if root != "" {
+			bucket = strings.TrimPrefix(bucket, root+"/")
+		}
+		return strings.Count(bucket, "/") + 1
+	}
+	// Sorted by name the listing follows the walk, so buckets the cursor has passed are skipped and the walk stops
+	// once the next page is known to exist. Otherwise any bucket may hold the entries of the page, so all are walked.
+	walkOrder := params.Sort == "name"
+	// Entries the cursor has passed are still collected for paginate, but do not count towards the page
+	afterCursor := func(e listEntry) bool {
+		return after == nil || compareCursors(cursorOf(e, params.Sort, params.Order), *after) > 0
+	}
+	// listed counts the entries of the page and those following it, to stop once the next page is known to exist
+	listed := 0
+	readable := make(map[string]bool)
+	hasFiles := make(map[string]bool)
+	pendingBucket := make(map[string]bool)
+	var entries []listEntry
+	includeBucket := func(bucket string) bool {
+		include, ok := readable[bucket]
+		if !ok {
+			// Buckets the caller cannot read are left out altogether
+			include = acl.Check(r, bucket, acl.Read) && (params.Contains == nil || strings.Contains(bucket, *params.Contains))
+			readable[bucket] = include
+			inDepth := params.Depth == 0 || level(bucket) <= params.Depth
+			if include && bucket != root && inDepth && (!params.Flat || !withFiles) {
+				e := listEntry{Bucket: bucket}
+				entries = append(entries, e)
+				if withFiles && fileFiltered {
+					// Only counted once a file of the bucket matches
+					pendingBucket[bucket] = afterCursor(e)
+				} else if afterCursor(e) {
+					listed++
+				}
+			}
+		}
+		return include
 	}
 
-	var buckets []*ftBucket
-	var bucket *ftBucket
-	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		logrus.Info("Path: ", filepath.FromSlash(path), " Root: ", filepath.FromSlash(root))
-		bucketName := strings.ReplaceAll(filepath.FromSlash(path), filepath.FromSlash(root), "")
-		bucketName = strings.TrimPrefix(bucketName, string(os.PathSeparator))
-		bucketName = strings.ReplaceAll(bucketName, string(os.PathSeparator), "-")
+	current := root
+	err = storage.Default.Walk(root, func(info *storage.ObjectInfo) error {
+		bucket := info.Bucket()
+		if info.IsDir {
+			bucket = info.Key
+		}
+		if bucket != current {
+			// Every bucket walked so far is complete, so the page is too
+			if walkOrder && listed > params.Limit {
+				return storage.StopWalk
+			}
+			current = bucket
+		}
 
-		if root == path {
+		if walkOrder && after != nil && storage.CompareBuckets(bucket, after.Bucket) < 0 {
+			if info.IsDir && !strings.HasPrefix(after.Bucket, bucket+"/") {
+				return storage.SkipBucket
+			}
+			return nil
+		}
+		if info.IsDir {
+			if params.Depth > 0 && level(bucket) > params.Depth {
+				return storage.SkipBucket
+			}
+			includeBucket(bucket)
+			return nil
+		}
+		if !includeBucket(bucket) || !withFiles || params.Depth > 0 && level(bucket) >= params.Depth {
 			return nil
 		}
+		if matched, _ := path.Match(params.Glob, info.Name()); params.Glob != "" && !matched ||
+			params.MinSize != nil && info.Size < *params.MinSize ||
+			params.MaxSize != nil && info.Size > *params.MaxSize ||
+			info.ModifiedAt.Before(modifiedSince) {
+			return nil
+		}
+		if len(filters) > 0 {
+			meta, err := fileMetadata(info.Key)
+			if err != nil {
+				return err
+			}
+			if !meta.Matches(filters) {
+				return nil
+			}
+		}
+		if counted, ok := pendingBucket[bucket]; ok && !hasFiles[bucket] && counted {
+			listed++
+		}
+		hasFiles[bucket] = true
+		e := listEntry{Bucket: bucket, file: info}
+		entries = append(entries, e)
+		if afterCursor(e) {
+			listed++
+		}
+		return nil
+	})
+	if err != nil {
+		return storageError(err)
+	}
+
+	// Buckets without a single matching file are only of interest when nothing was filtered
+	if withFiles && fileFiltered {
+		kept := entries[:0]
+		for _, e := range entries {
+			if e.file != nil || hasFiles[e.Bucket] {
+				kept = append(kept, e)
+			}
+		}
+		entries = kept
+	}
 
-		if info.IsDir() && (bucket == nil || bucket.Name != info.Name()) {
-			bucket = &ftBucket{Name: bucketName, Files: make([]*ftBucketFile, 0)}
-			if params.Bucket != nil && bucketName == *params.Bucket {
-				buckets = append(buckets, bucket)
-			} else if params.Contains != nil && strings.Contains(bucketName, *params.Contains) {
-				buckets = append(buckets, bucket)
-			} else if params.Bucket == nil && params.Contains == nil {
-				buckets = append(buckets, bucket)
+	page, next := paginate(entries, params.Sort, params.Order, after, params.Limit)
+
+	tree := newBucketTree(root)
+	for _, e := range page {
+		var meta metadata.Metadata
+		if e.file != nil {
+			meta, err = fileMetadata(e.file.Key)
+			if err != nil {
+				return api.Response{Error: err}
 			}
-		} else {
-			file := &ftBucketFile{info.Name(), info.Size(), info.ModTime()}
-			bucket.Files = append(bucket.Files, file)
 		}
 
-		return nil
+		switch {
+		case params.Flat && e.file == nil:
+			tree.root.Buckets = append(tree.root.Buckets, &ftBucket{Name: path.Base(e.Bucket), Path: e.Bucket})
+		case params.Flat:
+			tree.root.Files = append(tree.root.Files, newBucketFile(e.file, true, meta))
+		case e.file == nil:
+			tree.bucket(e.Bucket)
+		default:
+			bucket := tree.bucket(e.Bucket)
+			bucket.Files = append(bucket.Files, newBucketFile(e.file, false, meta))
+		}
+	}
+
+	return api.Response{Data: ftBucketList{ftBucket: tree.root, Next: next}}
+}
+
+// DeleteBucket removes a bucket. Buckets still holding files are only removed with recursive=true, which also
+// removes every bucket nested below it and needs delete access to each of them. The access lists, quotas, retention
+// policies and previous versions of the deleted buckets go with them.
+func DeleteBucket(r *http.Request) api.Response {
+	params := struct {
+		Bucket    string
+		Recursive bool
+	}{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.Bucket, v.Required, is.PrintableASCII),
 	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	bucket, err := storage.CleanBucket(params.Bucket)
+	if err != nil {
+		return storageError(err)
+	}
+	if !acl.Check(r, bucket, acl.Delete) {
+		return storageError(acl.ErrForbidden)
+	}
+	if params.Recursive && acl.Default != nil {
+		// Nested buckets with access lists of their own may be closed to the caller
+		for _, nested := range acl.Default.Nested(bucket) {
+			if !acl.Check(r, nested, acl.Delete) {
+				return storageError(errors.Prefix("'"+nested+"'", acl.ErrForbidden))
+			}
+		}
+	}
+
+	err = storage.Default.DeleteBucket(bucket, params.Recursive)
+	if err != nil {
+		return storageError(err)
+	}
+	err = retention.ForgetBucket(bucket)
 	if err != nil {
 		return api.Response{Error: errors.Err(err)}
 	}
+	return api.Response{Data: "OK"}
+}
 
-	return api.Response{Data: buckets}
+type ftBucketList struct {
+	*ftBucket
+	// Next is the cursor of the following page, empty on the last page
+	Next string `json:",omitempty"`
 }
 
 type ftBucket struct {
-	Name  string
-	Files []*ftBucketFile
+	Name    string
+	Path    string
+	Buckets []*ftBucket     `json:",omitempty"`
+	Files   []*ftBucketFile `json:",omitempty"`
 }
 
 type ftBucketFile struct {
-	Name       string
+	Name string
+	// Path is the full path of the file, only set in flat listings
+	Path       string `json:",omitempty"`
 	Size       int64
 	ModifiedAt time.Time
+	Checksum   string
+	Metadata   metadata.Metadata `json:",omitempty"`
+}
+
+func newBucketFile(info *storage.ObjectInfo, withPath bool, meta metadata.Metadata) *ftBucketFile {
+	file := &ftBucketFile{Name: info.Name(), Size: info.Size, ModifiedAt: info.ModifiedAt, Checksum: info.Checksum, Metadata: meta}
+	if withPath {
+		file.Path = info.Key
+	}
+	return file
+}
+
+// bucketTree assembles a listing into nested buckets below the requested one
+type bucketTree struct {
+	root  *ftBucket
+	nodes map[string]*ftBucket
+}
+
+func newBucketTree(root string) *bucketTree {
+	node := &ftBucket{Name: path.Base(root), Path: root}
+	if root == "" {
+		node.Name = ""
+	}
+	return &bucketTree{root: node, nodes: map[string]*ftBucket{root: node}}
+}
+
+// bucket returns the node of the bucket, creating it and any missing parents below the root
+func (t *bucketTree) bucket(p string) *ftBucket {
+	if node, ok := t.nodes[p]; ok {
+		return node
+	}
+	parent := t.bucket(storage.BucketOf(p))
+	node := &ftBucket{Name: path.Base(p), Path: p}
+	parent.Buckets = append(parent.Buckets, node)
+	t.nodes[p] = node
+	return node
 }
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"strconv"
 
+	"github.com/tiger5226/filetransfer/auth"
 	"github.com/tiger5226/filetransfer/util"
 
 	"github.com/sirupsen/logrus"
@@ -38,6 +39,7 @@ func ConfigureAPIServer() {
 	hs["Content-Type"] = "application/json; charset=utf-8"
 	hs["Access-Control-Allow-Methods"] = "GET, PUT, POST, DELETE, OPTIONS"
 	hs["Access-Control-Allow-Origin"] = "*"
+	hs["Access-Control-Allow-Headers"] = "Authorization, Content-Type"
 	hs["X-Content-Type-Options"] = "nosniff"
 	hs["X-Frame-Options"] = "deny"
 	hs["Content-Security-Policy"] = "default-src 'none'"
@@ -48,6 +50,9 @@ func ConfigureAPIServer() {
 
 	api.Log = func(request *http.Request, response *api.Response, err error) {
 		consoleText := request.RemoteAddr + " [" + strconv.Itoa(response.Status) + "]: " + request.Method + " " + request.URL.Path
+		if user := auth.User(request); user != "" {
+			consoleText += " (" + user + ")"
+		}
 		if err == nil {
 			logrus.Debug(color.GreenString(consoleText))
 		} else {
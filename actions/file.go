@@ -0,0 +1,222 @@
+package actions
+
+import (
+	"net/http"
+
+	"github.com/tiger5226/filetransfer/acl"
+	"github.com/tiger5226/filetransfer/auth"
+	"github.com/tiger5226/filetransfer/metadata"
+	"github.com/tiger5226/filetransfer/quota"
+	"github.com/tiger5226/filetransfer/storage"
+	"github.com/tiger5226/filetransfer/versions"
+
+	"github.com/lbryio/lbry.go/extras/api"
+	"github.com/lbryio/lbry.go/extras/errors"
+	v "github.com/lbryio/ozzo-validation"
+	"github.com/lbryio/ozzo-validation/is"
+	"github.com/sirupsen/logrus"
+)
+
+// DeleteFile removes a single file from its bucket, freeing its space in the quotas. In versioned buckets it can be
+// restored afterwards.
+func DeleteFile(r *http.Request) api.Response {
+	params := struct {
+		File string
+	}{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.File, v.Required, is.PrintableASCII),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	file, err := storage.CleanKey(params.File)
+	if err != nil {
+		return storageError(err)
+	}
+	if !acl.Check(r, storage.BucketOf(file), acl.Delete) {
+		return storageError(acl.ErrForbidden)
+	}
+	info, err := storage.Default.Stat(file)
+	if err != nil {
+		return storageError(err)
+	}
+	kept, err := keepVersion(file)
+	if err != nil {
+		return storageError(err)
+	}
+
+	err = storage.Default.Delete(file)
+	if err != nil {
+		discardVersion(file, kept)
+		return storageError(err)
+	}
+	storedFile(file, -info.Size)
+	if metadata.Default != nil {
+		err = metadata.Default.Remove(file)
+		if err != nil {
+			return api.Response{Error: errors.Err(err)}
+		}
+	}
+	return api.Response{Data: "OK"}
+}
+
+// MoveFile renames a file, possibly into another bucket, taking its metadata along. The destination is only replaced
+// with overwrite=true.
+func MoveFile(r *http.Request) api.Response {
+	return transferFile(r, true)
+}
+
+// CopyFile duplicates a file along with its metadata, possibly into another bucket. The destination is only replaced
+// with overwrite=true.
+func CopyFile(r *http.Request) api.Response {
+	return transferFile(r, false)
+}
+
+// transferFile moves or copies a file. Moving needs read and delete access to the source bucket, copying only
+// read access and room in the quotas of the destination. Both need write access to the destination bucket. A
+// replaced destination in a versioned bucket is kept as a previous version.
+func transferFile(r *http.Request, move bool) api.Response {
+	params := struct {
+		File      string
+		To        string
+		Overwrite bool
+	}{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.File, v.Required, is.PrintableASCII),
+		v.Field(&params.To, v.Required, is.PrintableASCII),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	src, err := storage.CleanKey(params.File)
+	if err != nil {
+		return storageError(err)
+	}
+	dst, err := storage.CleanKey(params.To)
+	if err != nil {
+		return storageError(err)
+	}
+
+	allowed := acl.Check(r, storage.BucketOf(src), acl.Read) && acl.Check(r, storage.BucketOf(dst), acl.Write)
+	if move {
+		allowed = allowed && acl.Check(r, storage.BucketOf(src), acl.Delete)
+	}
+	if !allowed {
+		return storageError(acl.ErrForbidden)
+	}
+
+	// A copy takes up space of its own, a move only shifts its size from one bucket to the other
+	source, err := storage.Default.Stat(src)
+	if err != nil {
+		return storageError(err)
+	}
+	var replaced int64
+	if existing, err := storage.Default.Stat(dst); err == nil && !existing.IsDir && params.Overwrite {
+		replaced = existing.Size
+	}
+	if !move {
+		err = checkQuota(r, storage.BucketOf(dst), source.Size, replaced)
+		if err != nil {
+			return storageError(err)
+		}
+	}
+
+	var kept string
+	if params.Overwrite {
+		kept, err = keepVersion(dst)
+		if err != nil {
+			return storageError(err)
+		}
+	}
+	if move {
+		err = storage.Default.Move(src, dst, params.Overwrite)
+	} else {
+		err = storage.Default.Copy(src, dst, params.Overwrite)
+	}
+	if err != nil {
+		discardVersion(dst, kept)
+		return storageError(err)
+	}
+	if move {
+		storedFile(src, -source.Size)
+	}
+	storedFile(dst, source.Size-replaced)
+	if metadata.Default != nil {
+		if move {
+			err = metadata.Default.Move(src, dst)
+		} else {
+			err = metadata.Default.Copy(src, dst)
+		}
+		if err != nil {
+			return api.Response{Error: errors.Err(err)}
+		}
+	}
+
+	if acl.Default != nil {
+		err = acl.Default.Claim(auth.User(r), storage.BucketOf(dst))
+		if err != nil {
+			return api.Response{Error: errors.Err(err)}
+		}
+	}
+
+	info, err := storage.Default.Stat(dst)
+	if err != nil {
+		return storageError(err)
+	}
+	meta, err := fileMetadata(dst)
+	if err != nil {
+		return api.Response{Error: errors.Err(err)}
+	}
+	return api.Response{Data: newBucketFile(info, true, meta)}
+}
+
+// keepVersion keeps the file as a previous version before it is deleted or replaced, in versioned buckets. It returns
+// the id of the version kept, if any, for discardVersion.
+func keepVersion(key string) (string, error) {
+	if versions.Default == nil {
+		return "", nil
+	}
+	return versions.Default.Keep(storage.Default, key)
+}
+
+// discardVersion removes the version keepVersion kept when the file was not deleted or replaced after all
+func discardVersion(key, id string) {
+	if versions.Default == nil {
+		return
+	}
+	err := versions.Default.Discard(key, id)
+	if err != nil {
+		logrus.Error("Unable to discard version ", id, " of ", key, ": ", err)
+	}
+}
+
+// fileMetadata returns the metadata attached to a file, if any
+func fileMetadata(key string) (metadata.Metadata, error) {
+	if metadata.Default == nil {
+		return nil, nil
+	}
+	return metadata.Default.Get(key)
+}
+
+// storageError converts the errors of the storage backend and access checks into responses with a fitting status
+func storageError(err error) api.Response {
+	switch {
+	case storage.IsInvalidPath(err):
+		return api.Response{Error: errors.Err(err), Status: http.StatusBadRequest}
+	case errors.Is(err, acl.ErrForbidden):
+		return api.Response{Error: errors.Err(err), Status: http.StatusForbidden}
+	case errors.Is(err, storage.ErrNotFound), errors.Is(err, versions.ErrNotFound):
+		return api.Response{Error: errors.Err(err), Status: http.StatusNotFound}
+	case errors.Is(err, storage.ErrExists), errors.Is(err, storage.ErrNotEmpty):
+		return api.Response{Error: errors.Err(err), Status: http.StatusConflict}
+	case errors.Is(err, quota.ErrExceeded):
+		return api.Response{Error: errors.Err(err), Status: http.StatusInsufficientStorage}
+	case errors.Is(err, quota.ErrTooLarge):
+		return api.Response{Error: errors.Err(err), Status: http.StatusRequestEntityTooLarge}
+	}
+	return api.Response{Error: errors.Err(err)}
+}
@@ -0,0 +1,238 @@
+package actions
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tiger5226/filetransfer/acl"
+	"github.com/tiger5226/filetransfer/auth"
+	"github.com/tiger5226/filetransfer/metadata"
+	"github.com/tiger5226/filetransfer/quota"
+	"github.com/tiger5226/filetransfer/storage"
+	"github.com/tiger5226/filetransfer/versions"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+// useTestStores points the storage and the stores at empty temporary ones, with access lists in force and versioning
+// and quotas available
+func useTestStores(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "ft-actions-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := storage.NewLocal(filepath.Join(dir, "data"))
+	local.UID, local.GID = os.Getuid(), os.Getgid()
+	tokens, err := auth.Open(filepath.Join(dir, "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := acl.Open(filepath.Join(dir, "acl.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := metadata.Open(filepath.Join(dir, "metadata"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	versionStorage := storage.NewLocal(filepath.Join(dir, "versions"))
+	versionStorage.UID, versionStorage.GID = os.Getuid(), os.Getgid()
+	history, err := versions.Open(filepath.Join(dir, "versioning.json"), versionStorage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quotas, err := quota.Open(filepath.Join(dir, "quota.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previousStorage, previousTokens, previousRules, previousMeta := storage.Default, auth.Default, acl.Default, metadata.Default
+	previousVersions, previousQuotas := versions.Default, quota.Default
+	storage.Default, auth.Default, acl.Default, metadata.Default = local, tokens, rules, meta
+	versions.Default, quota.Default = history, quotas
+	return func() {
+		storage.Default, auth.Default, acl.Default, metadata.Default = previousStorage, previousTokens, previousRules, previousMeta
+		versions.Default, quota.Default = previousVersions, previousQuotas
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// testRequest builds a request with the parameters, authenticated as the user unless that is empty
+func testRequest(t *testing.T, user string, params url.Values) *http.Request {
+	return authenticatedRequest(t, user, false, params)
+}
+
+// adminRequest builds a request with the parameters, authenticated with an admin token
+func adminRequest(t *testing.T, params url.Values) *http.Request {
+	return authenticatedRequest(t, "admin", true, params)
+}
+
+func authenticatedRequest(t *testing.T, user string, admin bool, params url.Values) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, "/?"+params.Encode(), nil)
+	if user == "" {
+		return request
+	}
+	secret, _, err := auth.Default.Issue(user, admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Authorization", "Bearer "+secret)
+
+	var authenticated *http.Request
+	auth.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authenticated = r
+	})).ServeHTTP(httptest.NewRecorder(), request)
+	if authenticated == nil {
+		t.Fatal("the test token was not accepted")
+	}
+	return authenticated
+}
+
+// putFile stores a file with the metadata for a test
+func putFile(t *testing.T, key, contents string, meta metadata.Metadata) {
+	if _, err := storage.Default.Put(key, strings.NewReader(contents)); err != nil {
+		t.Fatal(err)
+	}
+	if err := metadata.Default.Set(key, meta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readFile returns the contents of a stored file, or "" if it does not exist
+func readFile(t *testing.T, key string) string {
+	object, _, err := storage.Default.Get(key)
+	if err != nil {
+		return ""
+	}
+	defer func() { _ = object.Close() }()
+	contents, err := ioutil.ReadAll(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+func TestDeleteFile(t *testing.T) {
+	defer useTestStores(t)()
+
+	putFile(t, "team/app.tar", "app", metadata.Metadata{"build": "1"})
+	if err := acl.Default.Claim("alice", "team"); err != nil {
+		t.Fatal(err)
+	}
+
+	if response := DeleteFile(testRequest(t, "bob", url.Values{"file": {"team/app.tar"}})); response.Status != http.StatusForbidden {
+		t.Errorf("deleting without access returned %d", response.Status)
+	}
+	if readFile(t, "team/app.tar") != "app" {
+		t.Fatal("a forbidden delete removed the file")
+	}
+
+	if response := DeleteFile(testRequest(t, "alice", url.Values{"file": {"team/app.tar"}})); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if _, err := storage.Default.Stat("team/app.tar"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("the file survived its deletion: %v", err)
+	}
+	if m, _ := metadata.Default.Get("team/app.tar"); m != nil {
+		t.Errorf("the metadata survived the file: %v", m)
+	}
+	if response := DeleteFile(testRequest(t, "alice", url.Values{"file": {"team/app.tar"}})); response.Status != http.StatusNotFound {
+		t.Errorf("deleting a missing file returned %d", response.Status)
+	}
+}
+
+func TestDeleteBucketRecursive(t *testing.T) {
+	defer useTestStores(t)()
+
+	putFile(t, "team/app.tar", "app", nil)
+	putFile(t, "team/secret/key", "key", nil)
+	if err := acl.Default.Claim("alice", "team"); err != nil {
+		t.Fatal(err)
+	}
+	// The nested access list replaces that of the team, so alice has no say over it
+	if err := acl.Default.Grant("team/secret", "carol", []acl.Permission{acl.Admin}); err != nil {
+		t.Fatal(err)
+	}
+
+	if response := DeleteBucket(testRequest(t, "alice", url.Values{"bucket": {"team"}})); response.Status != http.StatusConflict {
+		t.Errorf("deleting a bucket that is not empty returned %d", response.Status)
+	}
+	if response := DeleteBucket(testRequest(t, "alice", url.Values{"bucket": {"team"}, "recursive": {"true"}})); response.Status != http.StatusForbidden {
+		t.Errorf("deleting a nested bucket without access returned %d", response.Status)
+	}
+	if readFile(t, "team/app.tar") != "app" || readFile(t, "team/secret/key") != "key" {
+		t.Fatal("a forbidden recursive delete removed files")
+	}
+
+	if err := acl.Default.Grant("team/secret", "alice", []acl.Permission{acl.Delete}); err != nil {
+		t.Fatal(err)
+	}
+	if response := DeleteBucket(testRequest(t, "alice", url.Values{"bucket": {"team"}, "recursive": {"true"}})); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if _, err := storage.Default.Stat("team"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("the bucket survived its deletion: %v", err)
+	}
+	if len(acl.Default.Nested("team")) != 0 || len(acl.Default.Owners("team")) != 0 {
+		t.Error("the access lists of the deleted buckets were kept")
+	}
+}
+
+func TestMoveAndCopyFile(t *testing.T) {
+	defer useTestStores(t)()
+
+	putFile(t, "a/x", "x", metadata.Metadata{"build": "1"})
+	putFile(t, "a/y", "y", metadata.Metadata{"build": "2"})
+	if err := acl.Default.Claim("alice", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	copyTo := url.Values{"file": {"a/x"}, "to": {"a/y"}}
+	if response := CopyFile(testRequest(t, "bob", copyTo)); response.Status != http.StatusForbidden {
+		t.Errorf("copying without read access returned %d", response.Status)
+	}
+	if response := CopyFile(testRequest(t, "alice", copyTo)); response.Status != http.StatusConflict {
+		t.Errorf("copying onto an existing file returned %d", response.Status)
+	}
+	if readFile(t, "a/y") != "y" {
+		t.Fatal("a refused copy replaced the destination")
+	}
+
+	copyTo.Set("overwrite", "true")
+	if response := CopyFile(testRequest(t, "alice", copyTo)); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if readFile(t, "a/y") != "x" || readFile(t, "a/x") != "x" {
+		t.Errorf("the copy left %q and %q", readFile(t, "a/x"), readFile(t, "a/y"))
+	}
+	if m, _ := metadata.Default.Get("a/y"); m["build"] != "1" {
+		t.Errorf("the copy carries the metadata %v", m)
+	}
+
+	// Moving into a new bucket makes the mover its owner
+	moveTo := url.Values{"file": {"a/x"}, "to": {"b/x"}}
+	if response := MoveFile(testRequest(t, "alice", moveTo)); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if _, err := storage.Default.Stat("a/x"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("the moved file stayed behind: %v", err)
+	}
+	if m, _ := metadata.Default.Get("a/x"); m != nil {
+		t.Errorf("the metadata stayed behind: %v", m)
+	}
+	if m, _ := metadata.Default.Get("b/x"); m["build"] != "1" {
+		t.Errorf("the moved file carries the metadata %v", m)
+	}
+	if owners := acl.Default.Owners("b"); len(owners) != 1 || owners[0] != "alice" {
+		t.Errorf("the new bucket is owned by %v", owners)
+	}
+	if response := MoveFile(testRequest(t, "bob", url.Values{"file": {"b/x"}, "to": {"c/x"}})); response.Status != http.StatusForbidden {
+		t.Errorf("moving out of another's bucket returned %d", response.Status)
+	}
+}
@@ -18,6 +18,9 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// Dir is the directory holding the jenkinsfiles offered by List
+var Dir = "jenkinsfiles"
+
 type jenkinsFile struct {
 	Name       string
 	Contents   string
@@ -55,11 +58,8 @@ func (c webhook) String() string {
 // List generates a list of all possible jenkinsfiles to use
 func List(r *http.Request) api.Response {
 	files := make([]jenkinsFile, 0)
-	currDir, err := os.Getwd()
-	if err != nil {
-		return api.Response{Error: errors.Err(err)}
-	}
-	root := currDir + "/jenkinsfiles"
+	root := Dir
+	var err error
 	err = filepath.Walk(root, func(path string, info os.FileInfo, walkErr error) error {
 		if root == path {
 			return nil
@@ -0,0 +1,149 @@
+package actions
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/tiger5226/filetransfer/acl"
+	"github.com/tiger5226/filetransfer/auth"
+	"github.com/tiger5226/filetransfer/storage"
+
+	"github.com/lbryio/lbry.go/extras/api"
+	"github.com/lbryio/lbry.go/extras/errors"
+	v "github.com/lbryio/ozzo-validation"
+	"github.com/lbryio/ozzo-validation/is"
+)
+
+// LinkMaxExpiry is the longest time a pre-signed link may be valid for
+var LinkMaxExpiry = 7 * 24 * time.Hour
+
+// defaultLinkExpiry is how long a link is valid for when no expiry is passed
+const defaultLinkExpiry = 24 * time.Hour
+
+// CreateLink mints a pre-signed URL for downloading a file, when file is passed, or for uploading into a bucket,
+// when bucket is passed. Anyone holding the URL can use it without a token until it expires after expires (a
+// duration such as 48h, 24h by default), has been used max_uses times or is revoked. The caller needs read access
+// to the file or write access to the bucket, and the link stops working if they lose it or their token is revoked.
+func CreateLink(r *http.Request) api.Response {
+	params := struct {
+		File    string
+		Bucket  *string
+		Expires string
+		MaxUses int
+	}{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.File, is.PrintableASCII),
+		v.Field(&params.Bucket, is.PrintableASCII),
+		v.Field(&params.MaxUses, v.Min(0)),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+	if (params.File == "") == (params.Bucket == nil) {
+		return api.Response{Error: errors.Err("either file or bucket is required"), Status: http.StatusBadRequest}
+	}
+
+	expiry := defaultLinkExpiry
+	if params.Expires != "" {
+		expiry, err = time.ParseDuration(params.Expires)
+		if err != nil || expiry <= 0 || expiry > LinkMaxExpiry {
+			return api.Response{Error: errors.Err("expires must be a positive duration of at most %s", LinkMaxExpiry), Status: http.StatusBadRequest}
+		}
+	}
+	if auth.Links == nil {
+		return api.Response{Error: errors.Err("signed links are not enabled")}
+	}
+	issuer := auth.FromRequest(r)
+	if issuer == nil || issuer.Link != nil {
+		return api.Response{Error: errors.Err("links can only be issued with a token or certificate"), Status: http.StatusUnauthorized}
+	}
+
+	kind, path, target := auth.LinkDownload, "/download", params.File
+	if params.Bucket != nil {
+		kind, path = auth.LinkUpload, "/upload"
+		target, err = storage.CleanBucket(*params.Bucket)
+		if err != nil {
+			return storageError(err)
+		}
+		if !acl.Check(r, target, acl.Write) {
+			return storageError(acl.ErrForbidden)
+		}
+	} else {
+		target, err = storage.CleanKey(target)
+		if err != nil {
+			return storageError(err)
+		}
+		if !acl.Check(r, storage.BucketOf(target), acl.Read) {
+			return storageError(acl.ErrForbidden)
+		}
+		info, err := storage.Default.Stat(target)
+		if err == nil && info.IsDir {
+			err = errors.Err(storage.ErrNotFound)
+		}
+		if err != nil {
+			return storageError(err)
+		}
+	}
+
+	link, query, err := auth.Links.Issue(kind, target, issuer, time.Now().Add(expiry), params.MaxUses)
+	if err != nil {
+		return api.Response{Error: errors.Err(err)}
+	}
+
+	u := url.URL{Scheme: "http", Host: r.Host, Path: path, RawQuery: query.Encode()}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+	return api.Response{Data: struct {
+		*auth.Link
+		URL string
+	}{link, u.String()}}
+}
+
+// ListLinks lists the links issued by the caller, or every link for admins
+func ListLinks(r *http.Request) api.Response {
+	if auth.Links == nil {
+		return api.Response{Error: errors.Err("signed links are not enabled")}
+	}
+
+	token := auth.FromRequest(r)
+	if token != nil && token.Admin {
+		return api.Response{Data: auth.Links.List("")}
+	}
+	return api.Response{Data: auth.Links.List(auth.User(r))}
+}
+
+// RevokeLink revokes a link by id, so it is refused from then on. Links can be revoked by their issuer and by admins.
+func RevokeLink(r *http.Request) api.Response {
+	params := struct {
+		ID string
+	}{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.ID, v.Required, is.Hexadecimal),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+	if auth.Links == nil {
+		return api.Response{Error: errors.Err("signed links are not enabled")}
+	}
+
+	link, ok := auth.Links.Get(params.ID)
+	if !ok {
+		return api.Response{Error: errors.Err(auth.ErrLinkInvalid), Status: http.StatusNotFound}
+	}
+	if token := auth.FromRequest(r); link.Issuer != auth.User(r) && (token == nil || !token.Admin) {
+		return api.Response{Error: errors.Err("only the issuer or an admin can revoke a link"), Status: http.StatusForbidden}
+	}
+
+	err = auth.Links.Revoke(params.ID)
+	if errors.Is(err, auth.ErrLinkInvalid) {
+		return api.Response{Error: err, Status: http.StatusNotFound}
+	} else if err != nil {
+		return api.Response{Error: errors.Err(err)}
+	}
+	return api.Response{Data: "OK"}
+}
@@ -0,0 +1,140 @@
+package actions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tiger5226/filetransfer/acl"
+	"github.com/tiger5226/filetransfer/auth"
+	"github.com/tiger5226/filetransfer/storage"
+)
+
+func TestCreateAndRevokeLinks(t *testing.T) {
+	defer useTestStores(t)()
+	root := storage.Default.(*storage.Local).Root
+	links, err := auth.OpenLinks(filepath.Join(root, "..", "links.json"), filepath.Join(root, "..", "links.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := auth.Links
+	auth.Links = links
+	defer func() { auth.Links = previous }()
+
+	putFile(t, "builds/app.tar", "app", nil)
+	if err := acl.Default.Claim("alice", "builds"); err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(user string, params url.Values) (url.Values, int) {
+		response := CreateLink(testRequest(t, user, params))
+		if response.Error != nil {
+			return nil, response.Status
+		}
+		created := response.Data.(struct {
+			*auth.Link
+			URL string
+		})
+		u, err := url.Parse(created.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Path != "/download" && u.Path != "/upload" {
+			t.Errorf("the link points at %s", u.Path)
+		}
+		return u.Query(), http.StatusOK
+	}
+	// The download handler stands in for the real one, which reads the file when the access list allows it
+	download := auth.Signed(auth.LinkDownload, auth.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acl.Check(r, storage.BucketOf(r.URL.Query().Get("file")), acl.Read) {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})))
+	use := func(query url.Values) int {
+		response := httptest.NewRecorder()
+		download.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/download?"+query.Encode(), nil))
+		return response.Code
+	}
+
+	file := url.Values{"file": {"builds/app.tar"}}
+	for name, params := range map[string]url.Values{
+		"file and bucket": {"file": {"builds/app.tar"}, "bucket": {"builds"}},
+		"long expiry":     {"file": {"builds/app.tar"}, "expires": {(LinkMaxExpiry + time.Hour).String()}},
+		"bad expiry":      {"file": {"builds/app.tar"}, "expires": {"-1h"}},
+	} {
+		if _, status := create("alice", params); status != http.StatusBadRequest {
+			t.Errorf("%s: creating a link returned %d", name, status)
+		}
+	}
+	if _, status := create("bob", file); status != http.StatusForbidden {
+		t.Errorf("creating a link to a file without read access returned %d", status)
+	}
+	if _, status := create("bob", url.Values{"bucket": {"builds"}}); status != http.StatusForbidden {
+		t.Errorf("creating an upload link without write access returned %d", status)
+	}
+	if _, status := create("alice", url.Values{"file": {"builds/missing.tar"}}); status != http.StatusNotFound {
+		t.Errorf("creating a link to a missing file returned %d", status)
+	}
+	if _, status := create("alice", url.Values{"bucket": {"builds"}}); status != http.StatusOK {
+		t.Errorf("creating an upload link returned %d", status)
+	}
+
+	// A link is good for its uses and its file alone
+	once, status := create("alice", url.Values{"file": {"builds/app.tar"}, "max_uses": {"1"}})
+	if status != http.StatusOK {
+		t.Fatalf("creating a link returned %d", status)
+	}
+	once.Set("version", "20200101T000000.000000000Z")
+	if status := use(once); status != http.StatusForbidden {
+		t.Errorf("using a link for an earlier version returned %d", status)
+	}
+	once.Del("version")
+	if status := use(once); status != http.StatusOK {
+		t.Errorf("using a link returned %d", status)
+	}
+	if status := use(once); status != http.StatusGone {
+		t.Errorf("using a link beyond its uses returned %d", status)
+	}
+
+	expiring, _ := create("alice", url.Values{"file": {"builds/app.tar"}, "expires": {"1ns"}})
+	time.Sleep(time.Millisecond)
+	if status := use(expiring); status != http.StatusGone {
+		t.Errorf("using an expired link returned %d", status)
+	}
+
+	revoked, _ := create("alice", file)
+	revoke := url.Values{"id": {revoked.Get("link")}}
+	if response := RevokeLink(testRequest(t, "bob", revoke)); response.Status != http.StatusForbidden {
+		t.Errorf("revoking the link of another user returned %d", response.Status)
+	}
+	if status := use(revoked); status != http.StatusOK {
+		t.Errorf("a link still in force returned %d", status)
+	}
+	if response := RevokeLink(testRequest(t, "alice", revoke)); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if status := use(revoked); status != http.StatusForbidden {
+		t.Errorf("using a revoked link returned %d", status)
+	}
+	if response := RevokeLink(testRequest(t, "alice", revoke)); response.Status != http.StatusNotFound {
+		t.Errorf("revoking a link twice returned %d", response.Status)
+	}
+
+	// Admins revoke any link, and a link stops working once its issuer loses access
+	lost, _ := create("alice", file)
+	if err := acl.Default.Grant("builds", "alice", []acl.Permission{acl.Write}); err != nil {
+		t.Fatal(err)
+	}
+	if status := use(lost); status != http.StatusForbidden {
+		t.Errorf("a link of an issuer without access returned %d", status)
+	}
+	if response := RevokeLink(adminRequest(t, url.Values{"id": {lost.Get("link")}})); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if len(auth.Links.List("alice")) != 1 {
+		t.Errorf("unexpected links left %+v", auth.Links.List("alice"))
+	}
+}
@@ -0,0 +1,156 @@
+package actions
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/tiger5226/filetransfer/storage"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+// defaultListLimit and maxListLimit bound the number of entries returned per page of /bucket/list
+const (
+	defaultListLimit = 1000
+	maxListLimit     = 10000
+)
+
+// listEntry is a single row of a bucket listing, either a file or, without one, the bucket itself
+type listEntry struct {
+	Bucket string
+	file   *storage.ObjectInfo
+}
+
+// listCursor marks the last entry of a page. It carries the sort order so it cannot be used with another one.
+type listCursor struct {
+	Sort     string
+	Order    string
+	Bucket   string
+	Name     string
+	Size     int64
+	Modified int64
+}
+
+// cursorOf returns the cursor pointing at the entry
+func cursorOf(e listEntry, sortBy, order string) listCursor {
+	c := listCursor{Sort: sortBy, Order: order, Bucket: e.Bucket}
+	if e.file != nil {
+		c.Name = e.file.Name()
+		c.Size = e.file.Size
+		c.Modified = e.file.ModifiedAt.UnixNano()
+	}
+	return c
+}
+
+// encode turns the cursor into the opaque token handed to clients
+func (c listCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor reads a token created by encode, checking it belongs to the same sort order
+func decodeCursor(token, sortBy, order string) (listCursor, error) {
+	c := listCursor{}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil {
+		return c, errors.Err("invalid cursor")
+	}
+	if c.Sort != sortBy || c.Order != order {
+		return c, errors.Err("the cursor belongs to a listing with another sort order")
+	}
+	return c, nil
+}
+
+// compareCursors orders entries the way a listing returns them. Sorted by name, entries follow their buckets in the
+// order storage.Walk visits them, each bucket entry before its files and its files by name, and descending order
+// applies within buckets. Sorted by size or modification time, the bucket entries come first in walk order, followed
+// by every file by the field, whichever bucket holds it, with the full key breaking ties. Descending order applies to
+// the files.
+func compareCursors(a, b listCursor) int {
+	if a.Sort != "size" && a.Sort != "modified" {
+		if c := storage.CompareBuckets(a.Bucket, b.Bucket); c != 0 {
+			return c
+		}
+		// The bucket entry has no name and always comes first
+		if a.Name == "" || b.Name == "" {
+			return strings.Compare(a.Name, b.Name)
+		}
+		c := strings.Compare(a.Name, b.Name)
+		if a.Order == "desc" {
+			c = -c
+		}
+		return c
+	}
+
+	// Bucket entries have no name and come before every file
+	if a.Name == "" || b.Name == "" {
+		if a.Name == "" && b.Name == "" {
+			return storage.CompareBuckets(a.Bucket, b.Bucket)
+		}
+		return strings.Compare(a.Name, b.Name)
+	}
+	c := 0
+	if a.Sort == "size" {
+		c = compareInt64(a.Size, b.Size)
+	} else {
+		c = compareInt64(a.Modified, b.Modified)
+	}
+	if c == 0 {
+		c = storage.CompareBuckets(a.Bucket, b.Bucket)
+	}
+	if c == 0 {
+		c = strings.Compare(a.Name, b.Name)
+	}
+	if a.Order == "desc" {
+		c = -c
+	}
+	return c
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// paginate sorts the entries and returns the page following the cursor, along with the cursor of the next page if
+// there are more entries
+func paginate(entries []listEntry, sortBy, order string, after *listCursor, limit int) ([]listEntry, string) {
+	cursors := make([]listCursor, len(entries))
+	for i, e := range entries {
+		cursors[i] = cursorOf(e, sortBy, order)
+	}
+	sort.Sort(byCursor{entries, cursors})
+
+	start := 0
+	if after != nil {
+		start = sort.Search(len(cursors), func(i int) bool { return compareCursors(cursors[i], *after) > 0 })
+	}
+	end := start + limit
+	if end >= len(entries) {
+		return entries[start:], ""
+	}
+	return entries[start:end], cursors[end-1].encode()
+}
+
+// byCursor sorts entries along with their cursors
+type byCursor struct {
+	entries []listEntry
+	cursors []listCursor
+}
+
+func (b byCursor) Len() int           { return len(b.entries) }
+func (b byCursor) Less(i, j int) bool { return compareCursors(b.cursors[i], b.cursors[j]) < 0 }
+func (b byCursor) Swap(i, j int) {
+	b.entries[i], b.entries[j] = b.entries[j], b.entries[i]
+	b.cursors[i], b.cursors[j] = b.cursors[j], b.cursors[i]
+}
@@ -0,0 +1,157 @@
+package actions
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tiger5226/filetransfer/storage"
+)
+
+func TestPaginate(t *testing.T) {
+	base := time.Unix(1500000000, 0)
+	file := func(key string, size int64, age int) listEntry {
+		info := &storage.ObjectInfo{Key: key, Size: size, ModifiedAt: base.Add(-time.Duration(age) * time.Hour)}
+		return listEntry{Bucket: info.Bucket(), file: info}
+	}
+	entries := func() []listEntry {
+		return []listEntry{
+			file("b/small", 1, 3), file("a/large", 30, 1), {Bucket: "a"}, file("a/medium", 20, 2),
+			{Bucket: "b"}, file("a/tiny", 5, 4), file("b/huge", 100, 0),
+		}
+	}
+	names := func(page []listEntry) string {
+		var n []string
+		for _, e := range page {
+			if e.file == nil {
+				n = append(n, e.Bucket+"/")
+			} else {
+				n = append(n, e.file.Key)
+			}
+		}
+		return strings.Join(n, ",")
+	}
+
+	cases := []struct {
+		sort, order string
+		pages       []string
+	}{
+		{"name", "asc", []string{"a/,a/large,a/medium", "a/tiny,b/,b/huge", "b/small"}},
+		{"name", "desc", []string{"a/,a/tiny,a/medium", "a/large,b/,b/small", "b/huge"}},
+		{"size", "desc", []string{"a/,b/,b/huge", "a/large,a/medium,a/tiny", "b/small"}},
+		{"size", "asc", []string{"a/,b/,b/small", "a/tiny,a/medium,a/large", "b/huge"}},
+		{"modified", "asc", []string{"a/,b/,a/tiny", "b/small,a/medium,a/large", "b/huge"}},
+	}
+	for _, c := range cases {
+		var after *listCursor
+		for i, expected := range c.pages {
+			page, next := paginate(entries(), c.sort, c.order, after, 3)
+			if names(page) != expected {
+				t.Errorf("%s %s page %d: got %s, expected %s", c.sort, c.order, i, names(page), expected)
+			}
+			if (next == "") != (i == len(c.pages)-1) {
+				t.Fatalf("%s %s page %d: unexpected next cursor %q", c.sort, c.order, i, next)
+			}
+			if next != "" {
+				cursor, err := decodeCursor(next, c.sort, c.order)
+				if err != nil {
+					t.Fatal(err)
+				}
+				after = &cursor
+			}
+		}
+	}
+
+	// A cursor stays valid when the entry it points at is deleted in the meantime
+	_, next := paginate(entries(), "name", "asc", nil, 2)
+	cursor, _ := decodeCursor(next, "name", "asc")
+	remaining := entries()[:0]
+	for _, e := range entries() {
+		if e.file == nil || e.file.Key != "a/large" {
+			remaining = append(remaining, e)
+		}
+	}
+	if page, _ := paginate(remaining, "name", "asc", &cursor, 2); names(page) != "a/medium,a/tiny" {
+		t.Errorf("page after a deleted entry: got %s", names(page))
+	}
+
+	if _, err := decodeCursor(next, "size", "asc"); err == nil {
+		t.Error("a cursor was accepted for another sort order")
+	}
+	if _, err := decodeCursor("not a cursor", "name", "asc"); err == nil {
+		t.Error("an invalid cursor was accepted")
+	}
+}
+
+func TestListPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ft-list-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	local := storage.NewLocal(dir)
+	local.UID, local.GID = os.Getuid(), os.Getgid()
+	previous := storage.Default
+	storage.Default = local
+	defer func() { storage.Default = previous }()
+
+	for key, size := range map[string]int{"a/1": 4, "a/2": 1, "a/b/3": 6, "a-z/4": 2, "c/5": 5, "c/6": 3} {
+		if _, err := local.Put(key, strings.NewReader(strings.Repeat("x", size))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := func(sortBy, order string) string {
+		var listed []string
+		cursor := ""
+		for page := 0; page < 10; page++ {
+			query := url.Values{"flat": {"true"}, "limit": {"2"}, "sort": {sortBy}, "order": {order}, "cursor": {cursor}}
+			response := List(httptest.NewRequest(http.MethodGet, "/bucket/list?"+query.Encode(), nil))
+			if response.Error != nil {
+				t.Fatal(response.Error)
+			}
+			list := response.Data.(ftBucketList)
+			for _, f := range list.Files {
+				listed = append(listed, f.Path)
+			}
+			if list.Next == "" {
+				break
+			}
+			cursor = list.Next
+		}
+		return strings.Join(listed, ",")
+	}
+	if listed := list("name", "asc"); listed != "a/1,a/2,a/b/3,a-z/4,c/5,c/6" {
+		t.Errorf("the pages sorted by name listed %s", listed)
+	}
+	// Sorted by size the files of every bucket are listed in a single order
+	if listed := list("size", "desc"); listed != "a/b/3,c/5,a/1,c/6,a-z/4,a/2" {
+		t.Errorf("the pages sorted by size listed %s", listed)
+	}
+}
+
+func TestBucketTree(t *testing.T) {
+	tree := newBucketTree("a")
+	for _, p := range []string{"a/b/c", "a/d", "a/b"} {
+		tree.bucket(p)
+	}
+	tree.bucket("a/b").Files = append(tree.bucket("a/b").Files, newBucketFile(&storage.ObjectInfo{Key: "a/b/file"}, false, nil))
+
+	root := tree.root
+	if root.Name != "a" || len(root.Buckets) != 2 || root.Buckets[0].Path != "a/b" || root.Buckets[1].Path != "a/d" {
+		t.Fatalf("unexpected root %+v", root)
+	}
+	b := root.Buckets[0]
+	if len(b.Buckets) != 1 || b.Buckets[0].Name != "c" || len(b.Files) != 1 || b.Files[0].Name != "file" || b.Files[0].Path != "" {
+		t.Errorf("unexpected bucket %+v", b)
+	}
+
+	if top := newBucketTree(""); top.bucket("x").Path != "x" || len(top.root.Buckets) != 1 || top.root.Name != "" {
+		t.Errorf("unexpected tree below the root %+v", top.root)
+	}
+}
@@ -0,0 +1,201 @@
+package actions
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/tiger5226/filetransfer/acl"
+	"github.com/tiger5226/filetransfer/auth"
+	"github.com/tiger5226/filetransfer/quota"
+	"github.com/tiger5226/filetransfer/storage"
+
+	"github.com/lbryio/lbry.go/extras/api"
+	"github.com/lbryio/lbry.go/extras/errors"
+	v "github.com/lbryio/ozzo-validation"
+	"github.com/lbryio/ozzo-validation/is"
+)
+
+// bucketUsage is the space taken by a bucket and everything nested below it. A quota of zero is unlimited.
+type bucketUsage struct {
+	Bucket string
+	Used   int64
+	Files  int
+	Quota  int64
+}
+
+// userUsage is the space taken by the top level buckets a user owns
+type userUsage struct {
+	User  string
+	Used  int64
+	Quota int64
+}
+
+// BucketUsage reports the usage of every bucket below the requested bucket (the root by default) that the caller
+// is allowed to read, next to the quota set on it, along with the usage and quota of the caller.
+func BucketUsage(r *http.Request) api.Response {
+	params := struct {
+		Bucket string
+	}{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.Bucket, is.PrintableASCII),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	root, err := storage.CleanBucket(params.Bucket)
+	if err != nil {
+		return storageError(err)
+	}
+	infos, err := storage.Default.List(root)
+	if err != nil {
+		return storageError(err)
+	}
+
+	usages := make(map[string]*bucketUsage)
+	usage := func(bucket string) *bucketUsage {
+		u, ok := usages[bucket]
+		if !ok {
+			u = &bucketUsage{Bucket: bucket}
+			usages[bucket] = u
+		}
+		return u
+	}
+	if root != "" {
+		usage(root)
+	}
+	for _, info := range infos {
+		if info.IsDir {
+			usage(info.Key)
+			continue
+		}
+		// A file counts towards every bucket it is nested in
+		for b := storage.BucketOf(info.Key); b != "" && (root == "" || b == root || strings.HasPrefix(b, root+"/")); b = storage.BucketOf(b) {
+			u := usage(b)
+			u.Used += info.Size
+			u.Files++
+		}
+	}
+
+	buckets := make([]*bucketUsage, 0, len(usages))
+	for bucket, u := range usages {
+		if !acl.Check(r, bucket, acl.Read) {
+			continue
+		}
+		if quota.Default != nil {
+			u.Quota = quota.Default.Bucket(bucket)[bucket]
+		}
+		buckets = append(buckets, u)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Bucket < buckets[j].Bucket })
+
+	user := &userUsage{User: auth.User(r)}
+	if quota.Default != nil && user.User != "" {
+		user.Quota = quota.Default.User(user.User)
+		user.Used, err = quota.UserUsage(storage.Default, user.User)
+		if err != nil {
+			return storageError(err)
+		}
+	}
+
+	return api.Response{Data: struct {
+		Buckets []*bucketUsage
+		User    *userUsage
+	}{buckets, user}}
+}
+
+// SetQuota sets the quota, in bytes, of either a bucket or a user. Zero means unlimited. Only admins may set quotas.
+func SetQuota(r *http.Request) api.Response {
+	params := struct {
+		Bucket string
+		User   string
+		Quota  int64
+	}{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.Bucket, is.PrintableASCII),
+		v.Field(&params.User, is.PrintableASCII),
+		v.Field(&params.Quota, v.Min(0)),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	return updateQuota(r, params.Bucket, params.User, &params.Quota)
+}
+
+// RemoveQuota removes the quota of either a bucket or a user, so the configured default applies again
+func RemoveQuota(r *http.Request) api.Response {
+	params := struct {
+		Bucket string
+		User   string
+	}{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.Bucket, is.PrintableASCII),
+		v.Field(&params.User, is.PrintableASCII),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	return updateQuota(r, params.Bucket, params.User, nil)
+}
+
+// checkQuota makes sure the caller may store size more bytes in the bucket, less the size of the file they replace
+func checkQuota(r *http.Request, bucket string, size, replaced int64) error {
+	if quota.Default == nil {
+		return nil
+	}
+	remaining, err := quota.Default.Remaining(storage.Default, bucket, auth.User(r), replaced)
+	if err != nil {
+		return err
+	}
+	if remaining != quota.Unlimited && size > remaining {
+		return errors.Err(quota.ErrTooLarge)
+	}
+	return nil
+}
+
+// storedFile accounts for the change in size of the file stored under the key in the cached usage of the quotas
+func storedFile(key string, delta int64) {
+	if quota.Default != nil && delta != 0 {
+		quota.Default.Stored(key, delta)
+	}
+}
+
+// updateQuota stores the quota of the bucket or user and responds with the quota now in effect
+func updateQuota(r *http.Request, bucket, user string, limit *int64) api.Response {
+	if rsp, ok := requireAdmin(r); !ok {
+		return rsp
+	}
+	if quota.Default == nil {
+		return api.Response{Error: errors.Err("quotas are not enabled")}
+	}
+	if (bucket == "") == (user == "") {
+		return api.Response{Error: errors.Err("either a bucket or a user is required"), Status: http.StatusBadRequest}
+	}
+
+	if user != "" {
+		err := quota.Default.SetUser(user, limit)
+		if err != nil {
+			return api.Response{Error: errors.Err(err)}
+		}
+		return api.Response{Data: userUsage{User: user, Quota: quota.Default.User(user)}}
+	}
+
+	bucket, err := storage.CleanBucket(bucket)
+	if err != nil {
+		return storageError(err)
+	}
+	if bucket == "" {
+		return api.Response{Error: errors.Err("the root bucket has no quota"), Status: http.StatusBadRequest}
+	}
+	err = quota.Default.SetBucket(bucket, limit)
+	if err != nil {
+		return api.Response{Error: errors.Err(err)}
+	}
+	return api.Response{Data: bucketUsage{Bucket: bucket, Quota: quota.Default.Bucket(bucket)[bucket]}}
+}
@@ -0,0 +1,137 @@
+package actions
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/tiger5226/filetransfer/acl"
+	"github.com/tiger5226/filetransfer/quota"
+	"github.com/tiger5226/filetransfer/storage"
+	"github.com/tiger5226/filetransfer/versions"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+func TestSetQuotaAndBucketUsage(t *testing.T) {
+	defer useTestStores(t)()
+
+	putFile(t, "team/a", "123456", nil)
+	putFile(t, "team/nested/b", "12", nil)
+	putFile(t, "other/c", "1", nil)
+	if err := acl.Default.Claim("alice", "team"); err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.Default.Claim("carol", "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	if response := SetQuota(testRequest(t, "alice", url.Values{"bucket": {"team"}, "quota": {"10"}})); response.Status != http.StatusForbidden {
+		t.Errorf("setting a quota without admin rights returned %d", response.Status)
+	}
+	if response := SetQuota(adminRequest(t, url.Values{"bucket": {"team"}, "user": {"alice"}, "quota": {"10"}})); response.Status != http.StatusBadRequest {
+		t.Errorf("setting a quota on a bucket and a user at once returned %d", response.Status)
+	}
+	if response := SetQuota(adminRequest(t, url.Values{"bucket": {"team"}, "quota": {"10"}})); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if response := SetQuota(adminRequest(t, url.Values{"user": {"alice"}, "quota": {"100"}})); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+
+	response := BucketUsage(testRequest(t, "alice", url.Values{}))
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	usage := response.Data.(struct {
+		Buckets []*bucketUsage
+		User    *userUsage
+	})
+	// The bucket of carol is closed to alice
+	if len(usage.Buckets) != 2 {
+		t.Fatalf("unexpected buckets %+v", usage.Buckets)
+	}
+	if team := usage.Buckets[0]; team.Bucket != "team" || team.Used != 8 || team.Files != 2 || team.Quota != 10 {
+		t.Errorf("unexpected usage of the team %+v", team)
+	}
+	if nested := usage.Buckets[1]; nested.Bucket != "team/nested" || nested.Used != 2 || nested.Quota != 0 {
+		t.Errorf("unexpected usage of the nested bucket %+v", nested)
+	}
+	if usage.User.User != "alice" || usage.User.Used != 8 || usage.User.Quota != 100 {
+		t.Errorf("unexpected usage of alice %+v", usage.User)
+	}
+
+	if response := RemoveQuota(adminRequest(t, url.Values{"bucket": {"team"}})); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if quota.Default.Bucket("team")["team"] != 0 {
+		t.Error("the quota of the team was not removed")
+	}
+}
+
+func TestFileActionsUpdateUsage(t *testing.T) {
+	defer useTestStores(t)()
+
+	putFile(t, "team/a", "123456", nil)
+	putFile(t, "other/x", "1234", nil)
+	limit := int64(10)
+	if err := quota.Default.SetBucket("team", &limit); err != nil {
+		t.Fatal(err)
+	}
+	if err := versions.Default.Enable("team", true); err != nil {
+		t.Fatal(err)
+	}
+	// The usage is cached from here on, so only the actions themselves can keep it right
+	remaining := func() int64 {
+		left, err := quota.Default.Remaining(storage.Default, "team", "", 0)
+		if errors.Is(err, quota.ErrExceeded) {
+			return 0
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return left
+	}
+	if left := remaining(); left != 4 {
+		t.Fatalf("%d bytes are left to begin with", left)
+	}
+
+	if response := CopyFile(testRequest(t, "", url.Values{"file": {"team/a"}, "to": {"team/b"}})); response.Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("a copy beyond the quota returned %d", response.Status)
+	}
+	if response := MoveFile(testRequest(t, "", url.Values{"file": {"other/x"}, "to": {"team/x"}})); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if left := remaining(); left != 0 {
+		t.Errorf("%d bytes are left after moving a file in", left)
+	}
+	if response := DeleteFile(testRequest(t, "", url.Values{"file": {"team/a"}})); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if left := remaining(); left != 6 {
+		t.Errorf("%d bytes are left after a delete", left)
+	}
+	if response := CopyFile(testRequest(t, "", url.Values{"file": {"team/x"}, "to": {"team/y"}})); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if left := remaining(); left != 2 {
+		t.Errorf("%d bytes are left after a copy", left)
+	}
+
+	history, err := versions.Default.List(storage.Default, "team/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := url.Values{"file": {"team/a"}, "version": {history[0].ID}}
+	if response := RestoreFile(testRequest(t, "", restore)); response.Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("a restore beyond the quota returned %d", response.Status)
+	}
+	if response := DeleteFile(testRequest(t, "", url.Values{"file": {"team/y"}})); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if response := RestoreFile(testRequest(t, "", restore)); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if left := remaining(); left != 0 {
+		t.Errorf("%d bytes are left after a restore", left)
+	}
+}
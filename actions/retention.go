@@ -0,0 +1,166 @@
+package actions
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/tiger5226/filetransfer/auth"
+	"github.com/tiger5226/filetransfer/retention"
+	"github.com/tiger5226/filetransfer/storage"
+
+	"github.com/lbryio/lbry.go/extras/api"
+	"github.com/lbryio/lbry.go/extras/errors"
+	v "github.com/lbryio/ozzo-validation"
+	"github.com/lbryio/ozzo-validation/is"
+)
+
+// retentionParams are the fields describing a retention policy
+type retentionParams struct {
+	Bucket   string
+	Unit     string
+	MaxAge   string
+	MaxFiles int
+	MaxSize  int64
+	KeepLast int
+}
+
+// BucketRetention shows the retention policy of a bucket
+func BucketRetention(r *http.Request) api.Response {
+	params := struct {
+		Bucket string
+	}{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.Bucket, v.Required, is.PrintableASCII),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	bucket, rsp, ok := retentionBucket(r, params.Bucket)
+	if !ok {
+		return rsp
+	}
+
+	policy, ok := retention.Default.Get(bucket)
+	if !ok {
+		return api.Response{Error: errors.Err("bucket '%s' has no retention policy", bucket), Status: http.StatusNotFound}
+	}
+	return api.Response{Data: policy}
+}
+
+// SetRetention replaces the retention policy of a bucket. max_age is a duration such as 168h, unit is file
+// (the default) to expire single files or bucket to expire the buckets directly below as a whole.
+func SetRetention(r *http.Request) api.Response {
+	bucket, policy, rsp, ok := retentionPolicy(r)
+	if !ok {
+		return rsp
+	}
+
+	err := retention.Default.Set(bucket, policy)
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+	return api.Response{Data: policy}
+}
+
+// RemoveRetention removes the retention policy of a bucket, so its contents are kept forever
+func RemoveRetention(r *http.Request) api.Response {
+	params := struct {
+		Bucket string
+	}{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.Bucket, v.Required, is.PrintableASCII),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	bucket, rsp, ok := retentionBucket(r, params.Bucket)
+	if !ok {
+		return rsp
+	}
+
+	err = retention.Default.Set(bucket, nil)
+	if err != nil {
+		return api.Response{Error: errors.Err(err)}
+	}
+	return api.Response{Data: "OK"}
+}
+
+// RetentionDryRun reports what the janitor would expire without removing anything. Given a bucket it uses the
+// policy passed along, or the stored one when no limit is passed. Without a bucket every stored policy is
+// reported, which requires an admin token.
+func RetentionDryRun(r *http.Request) api.Response {
+	if r.FormValue("bucket") == "" {
+		if retention.Default == nil {
+			return api.Response{Error: errors.Err("retention policies are not enabled")}
+		}
+		if token := auth.FromRequest(r); token == nil || !token.Admin {
+			return api.Response{Error: errors.Err("only admins can review every retention policy"), Status: http.StatusForbidden}
+		}
+		return api.Response{Data: retention.Default.Sweep(storage.Default, true, time.Now())}
+	}
+
+	bucket, policy, rsp, ok := retentionPolicy(r)
+	if !ok {
+		return rsp
+	}
+	if policy.MaxAge == 0 && policy.MaxFiles == 0 && policy.MaxSize == 0 {
+		stored, ok := retention.Default.Get(bucket)
+		if !ok {
+			return api.Response{Error: errors.Err("bucket '%s' has no retention policy", bucket), Status: http.StatusNotFound}
+		}
+		policy = &stored
+	} else if err := policy.Validate(); err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	report, err := retention.Plan(storage.Default, bucket, *policy, time.Now())
+	if err != nil {
+		return storageError(err)
+	}
+	return api.Response{Data: report}
+}
+
+// retentionPolicy reads the bucket and the policy fields of the request
+func retentionPolicy(r *http.Request) (string, *retention.Policy, api.Response, bool) {
+	params := retentionParams{}
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.Bucket, v.Required, is.PrintableASCII),
+		v.Field(&params.Unit, v.In(retention.Files, retention.Buckets)),
+		v.Field(&params.MaxFiles, v.Min(0)),
+		v.Field(&params.MaxSize, v.Min(0)),
+		v.Field(&params.KeepLast, v.Min(0)),
+	})
+	if err != nil {
+		return "", nil, api.Response{Error: err, Status: http.StatusBadRequest}, false
+	}
+
+	bucket, rsp, ok := retentionBucket(r, params.Bucket)
+	if !ok {
+		return "", nil, rsp, false
+	}
+
+	policy := &retention.Policy{Unit: params.Unit, MaxFiles: params.MaxFiles, MaxSize: params.MaxSize, KeepLast: params.KeepLast}
+	if policy.Unit == "" {
+		policy.Unit = retention.Files
+	}
+	if params.MaxAge != "" {
+		err = policy.MaxAge.UnmarshalText([]byte(params.MaxAge))
+		if err != nil {
+			return "", nil, api.Response{Error: errors.Prefix("max_age", err), Status: http.StatusBadRequest}, false
+		}
+	}
+	return bucket, policy, api.Response{}, true
+}
+
+// retentionBucket cleans the bucket name and makes sure the caller administers it. Retention policies delete
+// files, so they are managed by the same people as the access list.
+func retentionBucket(r *http.Request, bucket string) (string, api.Response, bool) {
+	if retention.Default == nil {
+		return "", api.Response{Error: errors.Err("retention policies are not enabled")}, false
+	}
+	return adminBucket(r, bucket)
+}
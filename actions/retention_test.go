@@ -0,0 +1,118 @@
+package actions
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tiger5226/filetransfer/acl"
+	"github.com/tiger5226/filetransfer/auth"
+	"github.com/tiger5226/filetransfer/metadata"
+	"github.com/tiger5226/filetransfer/retention"
+	"github.com/tiger5226/filetransfer/storage"
+)
+
+// testServer serves every route the way main does, behind the token check
+func testServer() *httptest.Server {
+	mux := http.NewServeMux()
+	routes := GetRoutes()
+	routes.Walk(func(pattern string, h http.Handler) http.Handler { return auth.Require(h) })
+	routes.Each(func(pattern string, h http.Handler) { mux.Handle(pattern, h) })
+	return httptest.NewServer(mux)
+}
+
+func TestRetentionDryRunOverHTTP(t *testing.T) {
+	defer useTestStores(t)()
+	policies, err := retention.Open(filepath.Join(storage.Default.(*storage.Local).Root, "..", "retention.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := retention.Default
+	retention.Default = policies
+	defer func() { retention.Default = previous }()
+
+	for _, key := range []string{"team/a", "team/b", "team/c"} {
+		putFile(t, key, key, metadata.Metadata{"build": key})
+	}
+	if err := acl.Default.Claim("alice", "team"); err != nil {
+		t.Fatal(err)
+	}
+	server := testServer()
+	defer server.Close()
+
+	call := func(user string, admin bool, path string, params url.Values, data interface{}) int {
+		request, err := http.NewRequest(http.MethodPost, server.URL+path+"?"+params.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secret, _, err := auth.Default.Issue(user, admin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Authorization", "Bearer "+secret)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = response.Body.Close() }()
+		body := struct{ Data json.RawMessage }{}
+		if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if data != nil && response.StatusCode == http.StatusOK {
+			if err := json.Unmarshal(body.Data, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return response.StatusCode
+	}
+	expired := func(report *retention.Report) string {
+		keys := make([]string, 0)
+		for _, item := range report.Expired {
+			keys = append(keys, item.Key)
+		}
+		return strings.Join(keys, ",")
+	}
+
+	policy := url.Values{"bucket": {"team"}, "max_files": {"1"}}
+	if status := call("bob", false, "/bucket/retention/set", policy, nil); status != http.StatusForbidden {
+		t.Errorf("setting a policy without admin rights returned %d", status)
+	}
+	if status := call("alice", false, "/bucket/retention/set", policy, nil); status != http.StatusOK {
+		t.Fatalf("setting a policy returned %d", status)
+	}
+	if stored, ok := retention.Default.Get("team"); !ok || stored.MaxFiles != 1 {
+		t.Fatalf("the policy was not stored: %+v", stored)
+	}
+
+	report := &retention.Report{}
+	if status := call("alice", false, "/bucket/retention/dryrun", url.Values{"bucket": {"team"}}, report); status != http.StatusOK {
+		t.Fatalf("the dry run of the bucket returned %d", status)
+	}
+	if len(report.Expired) != 2 || report.Kept != 1 {
+		t.Errorf("the dry run expires %s and keeps %d", expired(report), report.Kept)
+	}
+	if status := call("alice", false, "/bucket/retention/dryrun", url.Values{}, nil); status != http.StatusForbidden {
+		t.Errorf("reviewing every policy without an admin token returned %d", status)
+	}
+	var reports []*retention.Report
+	if status := call("admin", true, "/bucket/retention/dryrun", url.Values{}, &reports); status != http.StatusOK {
+		t.Fatalf("the dry run of every policy returned %d", status)
+	}
+	if len(reports) != 1 || reports[0].Bucket != "team" || expired(reports[0]) != expired(report) {
+		t.Errorf("the dry run of every policy differs from that of the bucket: %+v", reports)
+	}
+
+	for _, key := range []string{"team/a", "team/b", "team/c"} {
+		if readFile(t, key) != key {
+			t.Errorf("the dry run removed %s", key)
+		}
+		if m, _ := metadata.Default.Get(key); m["build"] != key {
+			t.Errorf("the dry run removed the metadata of %s: %v", key, m)
+		}
+	}
+}
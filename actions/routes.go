@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	"github.com/tiger5226/filetransfer/actions/jenkinsfile"
+	"github.com/tiger5226/filetransfer/handler"
 	"github.com/tiger5226/filetransfer/orderedmap"
 
 	"github.com/lbryio/lbry.go/extras/api"
@@ -30,6 +31,33 @@ func GetRoutes() *Routes {
 	routes.Set("/test", Test)
 
 	routes.Set("/bucket/list", List)
+	routes.Set("/bucket/acl", BucketACL)
+	routes.Set("/bucket/grant", GrantBucket)
+	routes.Set("/bucket/revoke", RevokeBucket)
+	routes.Set("/bucket/delete", DeleteBucket)
+	routes.Set("/bucket/usage", BucketUsage)
+	routes.Set("/bucket/versioning", BucketVersioning)
+	routes.Set("/bucket/retention", BucketRetention)
+	routes.Set("/bucket/retention/set", SetRetention)
+	routes.Set("/bucket/retention/remove", RemoveRetention)
+	routes.Set("/bucket/retention/dryrun", RetentionDryRun)
+	routes.Set("/file/delete", DeleteFile)
+	routes.Set("/file/move", MoveFile)
+	routes.Set("/file/copy", CopyFile)
+	routes.Set("/file/versions", FileVersions)
+	routes.Set("/file/restore", RestoreFile)
+	routes.Set("/upload/session", handler.CreateUploadSession)
+	routes.Set("/upload/chunk", handler.UploadChunk)
+	routes.Set("/upload/status", handler.UploadSessionStatus)
+	routes.Set("/upload/finalize", handler.FinalizeUploadSession)
+	routes.Set("/quota/set", SetQuota)
+	routes.Set("/quota/remove", RemoveQuota)
+	routes.Set("/token/issue", IssueToken)
+	routes.Set("/token/list", ListTokens)
+	routes.Set("/token/revoke", RevokeToken)
+	routes.Set("/link/create", CreateLink)
+	routes.Set("/link/list", ListLinks)
+	routes.Set("/link/revoke", RevokeLink)
 	routes.Set("/jenkinsfile/list", jenkinsfile.List)
 	routes.Set("/jenkinsfile/publish", jenkinsfile.Publish)
 
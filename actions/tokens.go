@@ -0,0 +1,88 @@
+package actions
+
+import (
+	"net/http"
+
+	"github.com/tiger5226/filetransfer/auth"
+
+	"github.com/lbryio/lbry.go/extras/api"
+	"github.com/lbryio/lbry.go/extras/errors"
+	v "github.com/lbryio/ozzo-validation"
+	"github.com/lbryio/ozzo-validation/is"
+)
+
+// IssueToken creates a new API token. The secret is only returned in this response.
+func IssueToken(r *http.Request) api.Response {
+	if rsp, ok := requireAdmin(r); !ok {
+		return rsp
+	}
+
+	params := struct {
+		Name  string
+		Admin bool
+	}{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.Name, v.Required, is.PrintableASCII),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	secret, token, err := auth.Default.Issue(params.Name, params.Admin)
+	if errors.Is(err, auth.ErrReservedName) {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	} else if err != nil {
+		return api.Response{Error: errors.Err(err)}
+	}
+
+	return api.Response{Data: struct {
+		*auth.Token
+		Secret string
+	}{token, secret}}
+}
+
+// ListTokens lists the issued API tokens without their secrets
+func ListTokens(r *http.Request) api.Response {
+	if rsp, ok := requireAdmin(r); !ok {
+		return rsp
+	}
+
+	return api.Response{Data: auth.Default.List()}
+}
+
+// RevokeToken revokes an API token by id
+func RevokeToken(r *http.Request) api.Response {
+	if rsp, ok := requireAdmin(r); !ok {
+		return rsp
+	}
+
+	params := struct {
+		ID string
+	}{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.ID, v.Required, is.Hexadecimal),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	err = auth.Default.Revoke(params.ID)
+	if errors.Is(err, auth.ErrTokenNotFound) {
+		return api.Response{Error: err, Status: http.StatusNotFound}
+	} else if err != nil {
+		return api.Response{Error: errors.Err(err)}
+	}
+
+	return api.Response{Data: "OK"}
+}
+
+// requireAdmin only lets requests authenticated with an admin token through
+func requireAdmin(r *http.Request) (api.Response, bool) {
+	token := auth.FromRequest(r)
+	if token == nil || !token.Admin {
+		return api.Response{Status: http.StatusForbidden, Error: errors.Err("an admin token is required")}, false
+	}
+	return api.Response{}, true
+}
@@ -0,0 +1,149 @@
+package actions
+
+import (
+	"net/http"
+
+	"github.com/tiger5226/filetransfer/acl"
+	"github.com/tiger5226/filetransfer/storage"
+	"github.com/tiger5226/filetransfer/versions"
+
+	"github.com/lbryio/lbry.go/extras/api"
+	"github.com/lbryio/lbry.go/extras/errors"
+	v "github.com/lbryio/ozzo-validation"
+	"github.com/lbryio/ozzo-validation/is"
+)
+
+// BucketVersioning shows whether files in a bucket are versioned, and turns versioning on or off when enabled is
+// passed. The setting covers every bucket nested below that has none of its own.
+func BucketVersioning(r *http.Request) api.Response {
+	params := struct {
+		Bucket  string
+		Enabled *bool
+	}{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.Bucket, v.Required, is.PrintableASCII),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	if versions.Default == nil {
+		return api.Response{Error: errors.Err("versioning is not enabled")}
+	}
+	bucket, rsp, ok := adminBucket(r, params.Bucket)
+	if !ok {
+		return rsp
+	}
+
+	if params.Enabled != nil {
+		err = versions.Default.Enable(bucket, *params.Enabled)
+		if err != nil {
+			return api.Response{Error: errors.Err(err)}
+		}
+	}
+	return api.Response{Data: struct {
+		Bucket  string
+		Enabled bool
+	}{bucket, versions.Default.Enabled(bucket)}}
+}
+
+// FileVersions lists the versions of a file, newest first. The current contents are marked as such, and any
+// version can be downloaded by passing its id as version.
+func FileVersions(r *http.Request) api.Response {
+	params := struct {
+		File string
+	}{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.File, v.Required, is.PrintableASCII),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	file, err := storage.CleanKey(params.File)
+	if err != nil {
+		return storageError(err)
+	}
+	if !acl.Check(r, storage.BucketOf(file), acl.Read) {
+		return storageError(acl.ErrForbidden)
+	}
+	if versions.Default == nil {
+		return api.Response{Error: errors.Err("versioning is not enabled")}
+	}
+
+	history, err := versions.Default.List(storage.Default, file)
+	if err != nil {
+		return storageError(err)
+	}
+	return api.Response{Data: history}
+}
+
+// RestoreFile makes a previous version the current contents of a file, which also brings back deleted files. The
+// contents it replaces are kept as another version, and the restored contents count towards the quotas.
+func RestoreFile(r *http.Request) api.Response {
+	params := struct {
+		File    string
+		Version string
+	}{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.File, v.Required, is.PrintableASCII),
+		v.Field(&params.Version, v.Required, is.PrintableASCII),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	file, err := storage.CleanKey(params.File)
+	if err != nil {
+		return storageError(err)
+	}
+	bucket := storage.BucketOf(file)
+	if !acl.Check(r, bucket, acl.Read) || !acl.Check(r, bucket, acl.Write) {
+		return storageError(acl.ErrForbidden)
+	}
+	if versions.Default == nil {
+		return api.Response{Error: errors.Err("versioning is not enabled")}
+	}
+
+	// The restored contents take up space in the quotas, less that of the contents they replace
+	history, err := versions.Default.List(storage.Default, file)
+	if err != nil {
+		return storageError(err)
+	}
+	var restored *versions.Version
+	var replaced int64
+	for _, version := range history {
+		if version.ID == params.Version {
+			restored = version
+		}
+		if version.Current {
+			replaced = version.Size
+		}
+	}
+	if restored == nil {
+		return storageError(versions.ErrNotFound)
+	}
+	err = checkQuota(r, bucket, restored.Size, replaced)
+	if err != nil {
+		return storageError(err)
+	}
+
+	err = versions.Default.Restore(storage.Default, file, params.Version)
+	if err != nil {
+		return storageError(err)
+	}
+	storedFile(file, restored.Size-replaced)
+
+	info, err := storage.Default.Stat(file)
+	if err != nil {
+		return storageError(err)
+	}
+	meta, err := fileMetadata(file)
+	if err != nil {
+		return api.Response{Error: errors.Err(err)}
+	}
+	return api.Response{Data: newBucketFile(info, true, meta)}
+}
@@ -0,0 +1,88 @@
+package actions
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/tiger5226/filetransfer/acl"
+	"github.com/tiger5226/filetransfer/metadata"
+	"github.com/tiger5226/filetransfer/versions"
+
+	"github.com/lbryio/lbry.go/extras/api"
+)
+
+func TestFileVersionsAndRestore(t *testing.T) {
+	defer useTestStores(t)()
+
+	if err := versions.Default.Enable("release", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.Default.Claim("alice", "release"); err != nil {
+		t.Fatal(err)
+	}
+	putFile(t, "release/app", "v1", metadata.Metadata{"build": "1"})
+	putFile(t, "release/next", "v2!", metadata.Metadata{"build": "2"})
+	replace := url.Values{"file": {"release/next"}, "to": {"release/app"}, "overwrite": {"true"}}
+	if response := CopyFile(testRequest(t, "alice", replace)); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+
+	history := func() []*versions.Version {
+		response := FileVersions(testRequest(t, "alice", url.Values{"file": {"release/app"}}))
+		if response.Error != nil {
+			t.Fatal(response.Error)
+		}
+		return response.Data.([]*versions.Version)
+	}
+	if response := FileVersions(testRequest(t, "bob", url.Values{"file": {"release/app"}})); response.Status != http.StatusForbidden {
+		t.Errorf("listing the versions without read access returned %d", response.Status)
+	}
+	first := history()
+	if len(first) != 2 || !first[0].Current || first[0].Size != 3 || first[1].Size != 2 {
+		t.Fatalf("unexpected history %+v", first)
+	}
+
+	restore := func(id string) api.Response {
+		return RestoreFile(testRequest(t, "alice", url.Values{"file": {"release/app"}, "version": {id}}))
+	}
+	response := restore(first[1].ID)
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if readFile(t, "release/app") != "v1" {
+		t.Errorf("the restored file holds %q", readFile(t, "release/app"))
+	}
+	if file := response.Data.(*ftBucketFile); file.Metadata["build"] != "1" {
+		t.Errorf("the restored file carries the metadata %v", file.Metadata)
+	}
+
+	// The replaced contents are kept with their metadata, so the restore can be undone
+	if second := history(); len(second) != 3 {
+		t.Fatalf("the restore kept no version of the replaced contents: %+v", second)
+	}
+	if response := restore(first[0].ID); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if m, _ := metadata.Default.Get("release/app"); readFile(t, "release/app") != "v2!" || m["build"] != "2" {
+		t.Errorf("undoing the restore left %q with %v", readFile(t, "release/app"), m)
+	}
+
+	// Deleted files come back as well
+	if response := DeleteFile(testRequest(t, "alice", url.Values{"file": {"release/app"}})); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if response := restore(first[0].ID); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if m, _ := metadata.Default.Get("release/app"); readFile(t, "release/app") != "v2!" || m["build"] != "2" {
+		t.Errorf("restoring a deleted file left %q with %v", readFile(t, "release/app"), m)
+	}
+
+	if response := restore("20000101T000000.000000000Z"); response.Status != http.StatusNotFound {
+		t.Errorf("restoring an unknown version returned %d", response.Status)
+	}
+	if response := RestoreFile(testRequest(t, "bob", url.Values{"file": {"release/app"}, "version": {first[1].ID}})); response.Status != http.StatusForbidden {
+		t.Errorf("restoring without access returned %d", response.Status)
+	}
+}
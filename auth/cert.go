@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+// certPrefix starts the IDs of the tokens standing in for client certificates
+const certPrefix = "cert-"
+
+// CertUser prefixes the names of certificate identities, so they cannot be mistaken for token names in access lists
+const CertUser = "cert:"
+
+// ClientCerts maps verified TLS client certificates to identities. Certificates are ignored while it is nil.
+var ClientCerts *CertMapper
+
+// CertMapper turns the subject of a client certificate into the identity used by the handlers and access lists
+type CertMapper struct {
+	// Field selects the part of the subject used as the identity: "cn" for the common name or "subject" for the
+	// full distinguished name
+	Field  string
+	admins map[string]bool
+}
+
+// NewCertMapper creates a mapper using the given subject field. The listed identities are treated like admin tokens.
+func NewCertMapper(field string, admins []string) (*CertMapper, error) {
+	if field == "" {
+		field = "cn"
+	}
+	if field != "cn" && field != "subject" {
+		return nil, errors.Err("unknown client certificate identity field '" + field + "'")
+	}
+
+	m := &CertMapper{Field: field, admins: map[string]bool{}}
+	for _, admin := range admins {
+		m.admins[admin] = true
+	}
+	return m, nil
+}
+
+// Identity returns the identity of the certificate, or an empty string if the selected field is empty
+func (m *CertMapper) Identity(cert *x509.Certificate) string {
+	if m.Field == "subject" {
+		return cert.Subject.String()
+	}
+	return cert.Subject.CommonName
+}
+
+// Token returns a token standing in for the certificate, so certificate and token authentication look the same to
+// the rest of the server. Its name is the identity prefixed with CertUser.
+func (m *CertMapper) Token(cert *x509.Certificate) (*Token, bool) {
+	identity := m.Identity(cert)
+	if identity == "" {
+		return nil, false
+	}
+	return &Token{
+		ID:        certPrefix + hex.EncodeToString(cert.SerialNumber.Bytes()),
+		Name:      CertUser + identity,
+		Admin:     m.admins[identity],
+		CreatedAt: cert.NotBefore,
+	}, true
+}
+
+// certificate authenticates the request with its client certificate. Only certificates the TLS handshake verified
+// against the configured certificate authorities are accepted.
+func certificate(r *http.Request) (*Token, bool) {
+	if ClientCerts == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+	return ClientCerts.Token(r.TLS.VerifiedChains[0][0])
+}
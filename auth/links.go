@@ -0,0 +1,370 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tiger5226/filetransfer/util"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The kinds of pre-signed links
+const (
+	LinkDownload = "download"
+	LinkUpload   = "upload"
+)
+
+// linkTargets maps the kind of a link to the query parameter holding its target
+var linkTargets = map[string]string{LinkDownload: "file", LinkUpload: "bucket"}
+
+// ErrLinkInvalid is returned for links that were never issued, were revoked or carry a wrong signature
+var ErrLinkInvalid = errors.Base("invalid or revoked link")
+
+// ErrLinkExpired is returned for links past their expiry or with no uses left
+var ErrLinkExpired = errors.Base("the link has expired")
+
+// Links is the store of pre-signed links. Signed links are refused while it is nil.
+var Links *LinkStore
+
+// Link is a pre-signed URL letting anyone holding it download a single file, or upload into a single bucket, without
+// a token. It acts with the current rights of the issuer, so it stops working when the issuer loses access or their
+// token is revoked.
+type Link struct {
+	ID     string
+	Kind   string
+	Target string
+	Issuer string
+	// IssuerID is the ID of the token or certificate the link was issued with
+	IssuerID  string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	// MaxUses is the number of successful requests the link may be used for, 0 for no limit
+	MaxUses int
+	Uses    int
+
+	// pending counts the requests using the link that have not completed yet
+	pending int
+}
+
+// LinkStore keeps the issued links in a JSON file, so they can be counted and revoked. Links are signed with a key
+// generated on first use and kept in its own file.
+type LinkStore struct {
+	l     sync.Mutex
+	path  string
+	key   []byte
+	links map[string]*Link
+}
+
+// OpenLinks loads the links from the file at path and the signing key from keyPath, creating the key if needed
+func OpenLinks(path, keyPath string) (*LinkStore, error) {
+	s := &LinkStore{path: path, links: map[string]*Link{}}
+
+	key, err := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		var secret string
+		secret, err = randomHex(32)
+		if err == nil {
+			key = []byte(secret)
+			err = util.WriteFileAtomic(keyPath, key, 0600)
+		}
+	}
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	s.key = []byte(strings.TrimSpace(string(key)))
+	if len(s.key) < 32 {
+		return nil, errors.Err("the link signing key in %s is too short", keyPath)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	var links []*Link
+	err = json.Unmarshal(contents, &links)
+	if err != nil {
+		return nil, errors.Prefix("unable to read links: ", err)
+	}
+	for _, link := range links {
+		s.links[link.ID] = link
+	}
+	return s, nil
+}
+
+// Issue signs a new link and returns it with the query parameters that have to be added to the URL of the handler
+func (s *LinkStore) Issue(kind, target string, issuer *Token, expiresAt time.Time, maxUses int) (*Link, url.Values, error) {
+	if _, ok := linkTargets[kind]; !ok {
+		return nil, nil, errors.Err("unknown link kind '%s'", kind)
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, nil, errors.Err(err)
+	}
+	link := &Link{
+		ID:        id,
+		Kind:      kind,
+		Target:    target,
+		Issuer:    issuer.Name,
+		IssuerID:  issuer.ID,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+		MaxUses:   maxUses,
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.prune()
+	s.links[id] = link
+	err = s.save()
+	if err != nil {
+		delete(s.links, id)
+		return nil, nil, err
+	}
+
+	c := *link
+	return &c, s.query(link), nil
+}
+
+// Use checks the link parameters of a request for the kind of link and holds one of its uses until Done is called
+// with the outcome of the request. It returns the link used.
+func (s *LinkStore) Use(kind string, query url.Values) (*Link, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	link, ok := s.links[query.Get("link")]
+	if !ok || link.Kind != kind {
+		return nil, errors.Err(ErrLinkInvalid)
+	}
+	expected := s.query(link)
+	if !hmac.Equal([]byte(query.Get("signature")), []byte(expected.Get("signature"))) ||
+		query.Get("expires") != expected.Get("expires") || query.Get(linkTargets[kind]) != link.Target {
+		return nil, errors.Err(ErrLinkInvalid)
+	}
+	// The signature pins the current contents of the file, so a download link cannot reach its earlier versions
+	if kind == LinkDownload && query.Get("version") != "" {
+		return nil, errors.Err(ErrLinkInvalid)
+	}
+	if !time.Now().Before(link.ExpiresAt) || link.MaxUses > 0 && link.Uses+link.pending >= link.MaxUses {
+		return nil, errors.Err(ErrLinkExpired)
+	}
+
+	link.pending++
+	c := *link
+	return &c, nil
+}
+
+// Done releases the use held by Use. Only requests that succeeded count as a use of the link.
+func (s *LinkStore) Done(id string, succeeded bool) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	link, ok := s.links[id]
+	if !ok {
+		return nil
+	}
+	link.pending--
+	if !succeeded {
+		return nil
+	}
+	link.Uses++
+	err := s.save()
+	if err != nil {
+		link.Uses--
+	}
+	return err
+}
+
+// List returns the links issued by the user, or every link for an empty user, oldest first
+func (s *LinkStore) List(issuer string) []*Link {
+	s.l.Lock()
+	defer s.l.Unlock()
+	links := make([]*Link, 0)
+	for _, link := range s.links {
+		if issuer == "" || link.Issuer == issuer {
+			c := *link
+			links = append(links, &c)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].CreatedAt.Before(links[j].CreatedAt) })
+	return links
+}
+
+// Get returns the link with the given id
+func (s *LinkStore) Get(id string) (*Link, bool) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	link, ok := s.links[id]
+	if !ok {
+		return nil, false
+	}
+	c := *link
+	return &c, true
+}
+
+// Revoke removes the link with the given id, after which it is refused
+func (s *LinkStore) Revoke(id string) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	link, ok := s.links[id]
+	if !ok {
+		return errors.Err(ErrLinkInvalid)
+	}
+	delete(s.links, id)
+	err := s.save()
+	if err != nil {
+		s.links[id] = link
+	}
+	return err
+}
+
+// query returns the signed query parameters of the link. The signature covers everything the parameters grant.
+// The caller must hold the lock.
+func (s *LinkStore) query(link *Link) url.Values {
+	expires := strconv.FormatInt(link.ExpiresAt.Unix(), 10)
+	mac := hmac.New(sha256.New, s.key)
+	_, _ = mac.Write([]byte(strings.Join([]string{link.ID, link.Kind, link.Target, expires}, "\n")))
+	return url.Values{
+		linkTargets[link.Kind]: {link.Target},
+		"link":                 {link.ID},
+		"expires":              {expires},
+		"signature":            {hex.EncodeToString(mac.Sum(nil))},
+	}
+}
+
+// prune forgets links that can no longer be used. The caller must hold the lock.
+func (s *LinkStore) prune() {
+	now := time.Now()
+	for id, link := range s.links {
+		if link.pending > 0 {
+			continue
+		}
+		if !now.Before(link.ExpiresAt) || link.MaxUses > 0 && link.Uses >= link.MaxUses {
+			delete(s.links, id)
+		}
+	}
+}
+
+// save writes the links to disk. The caller must hold the lock.
+func (s *LinkStore) save() error {
+	links := make([]*Link, 0, len(s.links))
+	for _, link := range s.links {
+		links = append(links, link)
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].CreatedAt.Before(links[j].CreatedAt) })
+
+	contents, err := json.MarshalIndent(links, "", "  ")
+	if err != nil {
+		return errors.Err(err)
+	}
+	return util.WriteFileAtomic(s.path, contents, 0600)
+}
+
+// Token returns a token standing in for the link, so handlers and access lists treat the request as the issuer's,
+// limited to what the link was issued for. It returns false when the issuer can no longer be found.
+func (l *Link) Token() (*Token, bool) {
+	issuer, ok := l.issuer()
+	if !ok {
+		return nil, false
+	}
+	return &Token{ID: "link-" + l.ID, Name: issuer.Name, Admin: issuer.Admin, CreatedAt: l.CreatedAt, Link: l}, true
+}
+
+// issuer looks up the token the link was issued with as it is now. Certificates cannot be revoked here, so links
+// issued with a certificate last as long as certificates are accepted, with the admin rights configured for them.
+func (l *Link) issuer() (*Token, bool) {
+	if strings.HasPrefix(l.IssuerID, certPrefix) {
+		if ClientCerts == nil {
+			return nil, false
+		}
+		return &Token{ID: l.IssuerID, Name: l.Issuer, Admin: ClientCerts.admins[strings.TrimPrefix(l.Issuer, CertUser)]}, true
+	}
+	if Default == nil || l.IssuerID == "" {
+		return nil, false
+	}
+	return Default.Get(l.IssuerID)
+}
+
+// statusWriter remembers the status of the response written through it
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Signed lets requests carrying the parameters of a pre-signed link of the kind through to h without a token.
+// Requests without a signature are passed on untouched, so h is usually wrapped in Require. A request only counts
+// as a use of the link when h answers it successfully, and HEAD requests never count.
+func Signed(kind string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			preflight(w)
+			return
+		}
+		query := r.URL.Query()
+		if query.Get("signature") == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if Links == nil {
+			reject(w, r, http.StatusForbidden, "signed links are not enabled")
+			return
+		}
+
+		link, err := Links.Use(kind, query)
+		if errors.Is(err, ErrLinkExpired) {
+			reject(w, r, http.StatusGone, errors.Unwrap(err).Error())
+			return
+		} else if errors.Is(err, ErrLinkInvalid) {
+			reject(w, r, http.StatusForbidden, errors.Unwrap(err).Error())
+			return
+		} else if err != nil {
+			reject(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		token, ok := link.Token()
+		if !ok {
+			_ = Links.Done(link.ID, false)
+			reject(w, r, http.StatusForbidden, "the issuer of the link no longer exists")
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), tokenKey, token)))
+		succeeded := r.Method != http.MethodHead && (sw.status == 0 || sw.status < http.StatusBadRequest)
+		err = Links.Done(link.ID, succeeded)
+		if err != nil {
+			logrus.Error("Unable to count the use of link ", link.ID, ": ", err)
+		}
+	})
+}
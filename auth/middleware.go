@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/lbryio/lbry.go/extras/api"
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+type contextKey int
+
+// tokenKey stores the authenticated token in the request context
+const tokenKey contextKey = 0
+
+// preflightHeaders are the CORS headers sent in answer to preflight OPTIONS requests
+var preflightHeaders = map[string]string{
+	"Access-Control-Allow-Methods": "GET, HEAD, PUT, POST, DELETE, OPTIONS",
+	"Access-Control-Allow-Origin":  "*",
+	"Access-Control-Allow-Headers": "Authorization, Content-Type, Content-MD5, Digest, If-Match, If-None-Match, If-Modified-Since, If-Range, Range"}
+
+// Require wraps a handler so it is only reached with a valid bearer token or a verified client certificate. A bearer
+// token takes precedence over the certificate. Preflight OPTIONS requests are answered with the CORS headers alone,
+// without reaching h, and requests already authenticated with a pre-signed link by Signed pass through.
+func Require(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			preflight(w)
+			return
+		}
+		if FromRequest(r) != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := authenticate(r)
+		if !ok {
+			token, ok = certificate(r)
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="filetransfer"`)
+			reject(w, r, http.StatusUnauthorized, "a valid bearer token or client certificate is required")
+			return
+		}
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey, token)))
+	})
+}
+
+// FromRequest returns the token the request was authenticated with, if any
+func FromRequest(r *http.Request) *Token {
+	token, _ := r.Context().Value(tokenKey).(*Token)
+	return token
+}
+
+// User returns the identity of the caller, or an empty string for anonymous requests
+func User(r *http.Request) string {
+	if token := FromRequest(r); token != nil {
+		return token.Name
+	}
+	return ""
+}
+
+// authenticate looks up the bearer token from the Authorization header
+func authenticate(r *http.Request) (*Token, bool) {
+	if Default == nil {
+		return nil, false
+	}
+
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return nil, false
+	}
+
+	return Default.Authenticate(strings.TrimSpace(header[7:]))
+}
+
+// preflight answers a CORS preflight request with an empty body
+func preflight(w http.ResponseWriter) {
+	for k, v := range preflightHeaders {
+		w.Header().Set(k, v)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// reject replies with the standard JSON error response
+func reject(w http.ResponseWriter, r *http.Request, status int, message string) {
+	api.Handler(func(*http.Request) api.Response {
+		return api.Response{Status: status, Error: errors.Err(message)}
+	}).ServeHTTP(w, r)
+}
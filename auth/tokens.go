@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tiger5226/filetransfer/util"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+// tokenPrefix makes tokens easy to recognise in configuration files and logs
+const tokenPrefix = "ft_"
+
+// ErrTokenNotFound is returned when revoking a token that does not exist
+var ErrTokenNotFound = errors.Base("token not found")
+
+// ErrReservedName is returned when issuing a token with a name reserved for client certificates
+var ErrReservedName = errors.Base("token names may not start with '" + CertUser + "'")
+
+// Default is the token store used to authenticate requests
+var Default *Store
+
+// Token is an issued API token. Only the SHA-256 hash of the secret is ever kept.
+type Token struct {
+	ID        string
+	Name      string
+	Admin     bool
+	Hash      string `json:",omitempty"`
+	CreatedAt time.Time
+	// Link is set on tokens standing in for a pre-signed link
+	Link *Link `json:",omitempty"`
+}
+
+// Store keeps the issued tokens in a JSON file on disk
+type Store struct {
+	l      sync.RWMutex
+	path   string
+	tokens map[string]*Token
+}
+
+// Open loads the token store from the file at path. A missing file results in an empty store.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, tokens: map[string]*Token{}}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	var tokens []*Token
+	err = json.Unmarshal(contents, &tokens)
+	if err != nil {
+		return nil, errors.Prefix("unable to read token store: ", err)
+	}
+	for _, token := range tokens {
+		s.tokens[token.Hash] = token
+	}
+
+	return s, nil
+}
+
+// Issue creates a new token and returns its secret. The secret cannot be recovered afterwards.
+func (s *Store) Issue(name string, admin bool) (string, *Token, error) {
+	if strings.HasPrefix(name, CertUser) {
+		return "", nil, errors.Err(ErrReservedName)
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", nil, errors.Err(err)
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return "", nil, errors.Err(err)
+	}
+	secret = tokenPrefix + secret
+
+	token := &Token{ID: id, Name: name, Admin: admin, Hash: hash(secret), CreatedAt: time.Now()}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.tokens[token.Hash] = token
+	err = s.save()
+	if err != nil {
+		delete(s.tokens, token.Hash)
+		return "", nil, err
+	}
+
+	return secret, token.public(), nil
+}
+
+// Authenticate returns the token matching the secret
+func (s *Store) Authenticate(secret string) (*Token, bool) {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	token, ok := s.tokens[hash(secret)]
+	if !ok {
+		return nil, false
+	}
+	return token.public(), true
+}
+
+// Get returns the token with the given id
+func (s *Store) Get(id string) (*Token, bool) {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	for _, token := range s.tokens {
+		if token.ID == id {
+			return token.public(), true
+		}
+	}
+	return nil, false
+}
+
+// List returns all issued tokens, oldest first, without their hashes
+func (s *Store) List() []*Token {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	tokens := make([]*Token, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		tokens = append(tokens, token.public())
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+	return tokens
+}
+
+// Revoke removes the token with the given id
+func (s *Store) Revoke(id string) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	for key, token := range s.tokens {
+		if token.ID == id {
+			delete(s.tokens, key)
+			err := s.save()
+			if err != nil {
+				s.tokens[key] = token
+			}
+			return err
+		}
+	}
+	return errors.Err(ErrTokenNotFound)
+}
+
+// Len returns the number of issued tokens
+func (s *Store) Len() int {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	return len(s.tokens)
+}
+
+// save writes the store to a temporary file and renames it over the old one. The caller must hold the lock.
+func (s *Store) save() error {
+	tokens := make([]*Token, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+
+	contents, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return errors.Err(err)
+	}
+
+	return util.WriteFileAtomic(s.path, contents, 0600)
+}
+
+// public returns a copy of the token without its hash
+func (t *Token) public() *Token {
+	c := *t
+	c.Hash = ""
+	return &c
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,324 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+func newTestStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "ft-auth-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := Open(filepath.Join(dir, "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestIssueAuthenticateRevoke(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+
+	secret, token, err := store.Issue("ci", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(secret, tokenPrefix) || token.Hash != "" {
+		t.Errorf("unexpected issued token %q %+v", secret, token)
+	}
+
+	found, ok := store.Authenticate(secret)
+	if !ok || found.ID != token.ID || found.Name != "ci" {
+		t.Errorf("Authenticate returned %+v, %v", found, ok)
+	}
+	if _, _, err := store.Issue(CertUser+"ops", true); !errors.Is(err, ErrReservedName) {
+		t.Errorf("a token was issued with a certificate name: %v", err)
+	}
+	if _, ok := store.Authenticate(secret + "x"); ok {
+		t.Error("Authenticate accepted a wrong secret")
+	}
+
+	// Only the hash may be persisted, and it must survive a reload
+	contents, _ := ioutil.ReadFile(store.path)
+	if strings.Contains(string(contents), secret) {
+		t.Error("the secret was written to disk")
+	}
+	reloaded, err := Open(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.Authenticate(secret); !ok {
+		t.Error("token did not survive a reload")
+	}
+
+	if err := store.Revoke(token.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.Authenticate(secret); ok {
+		t.Error("revoked token still authenticates")
+	}
+	if err := store.Revoke(token.ID); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("expected ErrTokenNotFound, got %v", err)
+	}
+}
+
+func TestRequire(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+	previous := Default
+	Default = store
+	defer func() { Default = previous }()
+
+	secret, _, err := store.Issue("ci", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen *Token
+	h := Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = FromRequest(r)
+		_, _ = w.Write([]byte("secret contents"))
+	}))
+
+	headers := map[string]int{
+		"":                             http.StatusUnauthorized,
+		"Bearer":                       http.StatusUnauthorized,
+		"Bearer wrong":                 http.StatusUnauthorized,
+		"Basic " + secret:              http.StatusUnauthorized,
+		"Bearer " + secret:             http.StatusOK,
+		"bearer " + secret:             http.StatusOK,
+		"Bearer  " + secret + "  \t  ": http.StatusOK,
+	}
+	for header, expected := range headers {
+		seen = nil
+		request := httptest.NewRequest(http.MethodGet, "/bucket/list", nil)
+		if header != "" {
+			request.Header.Set("Authorization", header)
+		}
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, request)
+		if response.Code != expected {
+			t.Errorf("Authorization %q returned %d, expected %d", header, response.Code, expected)
+		}
+		if expected == http.StatusOK && (seen == nil || seen.Name != "ci") {
+			t.Errorf("Authorization %q did not pass the token on", header)
+		}
+	}
+
+	// Preflight requests are answered without a token, and without reaching the handler
+	for _, wrapped := range []http.Handler{h, Signed(LinkDownload, h)} {
+		request := httptest.NewRequest(http.MethodOptions, "/download?file=builds/app.tar", nil)
+		response := httptest.NewRecorder()
+		wrapped.ServeHTTP(response, request)
+		if response.Code != http.StatusOK || response.Body.Len() != 0 {
+			t.Errorf("preflight request returned %d with body %q", response.Code, response.Body.String())
+		}
+		if response.Header().Get("Access-Control-Allow-Origin") != "*" {
+			t.Error("preflight request is missing the CORS headers")
+		}
+	}
+}
+
+func TestRequireClientCertificate(t *testing.T) {
+	previous := ClientCerts
+	defer func() { ClientCerts = previous }()
+	var err error
+	ClientCerts, err = NewCertMapper("cn", []string{"ops"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seen *Token
+	h := Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = FromRequest(r)
+	}))
+	request := func(cn string, verified bool) *http.Request {
+		cert := &x509.Certificate{SerialNumber: big.NewInt(42), Subject: pkix.Name{CommonName: cn, Organization: []string{"Builds"}}}
+		r := httptest.NewRequest(http.MethodGet, "/bucket/list", nil)
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		if verified {
+			r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+		}
+		return r
+	}
+
+	cases := []struct {
+		cn       string
+		verified bool
+		status   int
+		admin    bool
+	}{
+		{"agent-1", true, http.StatusOK, false},
+		{"ops", true, http.StatusOK, true},
+		{"agent-1", false, http.StatusUnauthorized, false},
+		{"", true, http.StatusUnauthorized, false},
+	}
+	for _, c := range cases {
+		seen = nil
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, request(c.cn, c.verified))
+		if response.Code != c.status {
+			t.Errorf("certificate %q (verified %v) returned %d, expected %d", c.cn, c.verified, response.Code, c.status)
+			continue
+		}
+		if c.status == http.StatusOK && (seen == nil || seen.Name != CertUser+c.cn || seen.Admin != c.admin) {
+			t.Errorf("certificate %q was mapped to %+v", c.cn, seen)
+		}
+	}
+
+	ClientCerts.Field = "subject"
+	h.ServeHTTP(httptest.NewRecorder(), request("agent-1", true))
+	if seen == nil || seen.Name != "cert:CN=agent-1,O=Builds" {
+		t.Errorf("expected the full subject as identity, got %+v", seen)
+	}
+
+	if _, err := NewCertMapper("email", nil); err == nil {
+		t.Error("an unknown identity field was accepted")
+	}
+}
+
+func TestSignedLinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ft-links-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	links, err := OpenLinks(filepath.Join(dir, "links.json"), filepath.Join(dir, "links.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := Links
+	Links = links
+	defer func() { Links = previous }()
+
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+	previousStore := Default
+	Default = store
+	defer func() { Default = previousStore }()
+
+	var seen *Token
+	status := http.StatusOK
+	h := Signed(LinkDownload, Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = FromRequest(r)
+		w.WriteHeader(status)
+	})))
+	request := func(method, query string) int {
+		seen = nil
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, httptest.NewRequest(method, "/download?"+query, nil))
+		return response.Code
+	}
+	get := func(query string) int {
+		return request(http.MethodGet, query)
+	}
+
+	_, issuer, err := store.Issue("release-manager", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, query, err := links.Issue(LinkDownload, "builds/app.tar", issuer, time.Now().Add(time.Hour), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := get(query.Encode()); status != http.StatusOK || seen == nil || seen.Name != "release-manager" || seen.Link == nil {
+		t.Fatalf("a valid link returned %d as %+v", status, seen)
+	}
+
+	// Failed and HEAD requests do not use the link up
+	status = http.StatusNotFound
+	for i := 0; i < 3; i++ {
+		get(query.Encode())
+	}
+	status = http.StatusOK
+	for i := 0; i < 3; i++ {
+		request(http.MethodHead, query.Encode())
+	}
+	if current, _ := links.Get(link.ID); current.Uses != 1 {
+		t.Errorf("expected a single use to be counted, got %d", current.Uses)
+	}
+
+	tampered := url.Values{}
+	for name, values := range query {
+		tampered[name] = values
+	}
+	tampered.Set("file", "builds/other.tar")
+	if status := get(tampered.Encode()); status != http.StatusForbidden {
+		t.Errorf("a link for another file returned %d", status)
+	}
+	tampered.Set("file", "builds/app.tar")
+	tampered.Set("version", "20200101T000000.000000000Z")
+	if status := get(tampered.Encode()); status != http.StatusForbidden {
+		t.Errorf("a link for an earlier version of the file returned %d", status)
+	}
+	tampered.Del("version")
+	tampered.Set("expires", "99999999999")
+	if status := get(tampered.Encode()); status != http.StatusForbidden {
+		t.Errorf("a link with a later expiry returned %d", status)
+	}
+	if status := get("file=builds/app.tar"); status != http.StatusUnauthorized {
+		t.Errorf("a request without link or token returned %d", status)
+	}
+
+	// The second use is the last one, and the count survives a restart
+	if status := get(query.Encode()); status != http.StatusOK {
+		t.Errorf("the second use returned %d", status)
+	}
+	reopened, err := OpenLinks(filepath.Join(dir, "links.json"), filepath.Join(dir, "links.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Links = reopened
+	if status := get(query.Encode()); status != http.StatusGone {
+		t.Errorf("a used up link returned %d", status)
+	}
+
+	_, query, err = reopened.Issue(LinkDownload, "builds/app.tar", issuer, time.Now().Add(time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.List("release-manager")) != 1 {
+		t.Errorf("the used up link %s was not pruned: %+v", link.ID, reopened.List(""))
+	}
+	if err := reopened.Revoke(query.Get("link")); err != nil {
+		t.Fatal(err)
+	}
+	if status := get(query.Encode()); status != http.StatusForbidden {
+		t.Errorf("a revoked link returned %d", status)
+	}
+
+	_, query, err = reopened.Issue(LinkDownload, "builds/app.tar", issuer, time.Now().Add(-time.Second), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := get(query.Encode()); status != http.StatusGone {
+		t.Errorf("an expired link returned %d", status)
+	}
+
+	// Links act with the issuer's current rights and die with their token
+	_, query, err = reopened.Issue(LinkDownload, "builds/app.tar", issuer, time.Now().Add(time.Hour), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Revoke(issuer.ID); err != nil {
+		t.Fatal(err)
+	}
+	if status := get(query.Encode()); status != http.StatusForbidden {
+		t.Errorf("a link of a revoked token returned %d", status)
+	}
+}
@@ -0,0 +1,126 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+// Reloader serves a certificate loaded from disk that can be replaced while the server is running. Connections
+// already established keep the certificate they were negotiated with.
+type Reloader struct {
+	l        sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+}
+
+// NewReloader loads the certificate and key from the given files
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the certificate and key again. The previous certificate stays in use if they cannot be loaded.
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.Prefix("unable to load certificate: ", err)
+	}
+
+	r.l.Lock()
+	r.cert = &cert
+	r.l.Unlock()
+	return nil
+}
+
+// GetCertificate returns the current certificate. It is meant for tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.l.RLock()
+	defer r.l.RUnlock()
+	return r.cert, nil
+}
+
+// TLSConfig returns the server configuration serving the reloadable certificate
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+}
+
+// ClientCAs loads the PEM encoded certificate authorities client certificates are verified against
+func ClientCAs(file string) (*x509.CertPool, error) {
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(contents) {
+		return nil, errors.Err("no certificates found in " + file)
+	}
+	return pool, nil
+}
+
+// ClientAuth translates a configured client certificate mode into the TLS setting. "optional" verifies a certificate
+// when the client presents one, "require" refuses connections without a valid certificate.
+func ClientAuth(mode string) (tls.ClientAuthType, error) {
+	switch mode {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, errors.Err("unknown client certificate mode '" + mode + "'")
+}
+
+// SelfSignedHosts returns the comma separated host names and addresses a self-signed certificate is issued for: the
+// configured hostnames, or else the host of the listen address. An address listening on every interface names no
+// host, so the certificate is issued for localhost instead.
+func SelfSignedHosts(hostnames []string, listen string) string {
+	if len(hostnames) > 0 {
+		return strings.Join(hostnames, ",")
+	}
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		host = listen
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		return "localhost,127.0.0.1,::1"
+	}
+	return host
+}
+
+// RedirectHandler sends every request to the same host and path over HTTPS on the port of httpsAddr
+func RedirectHandler(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,102 @@
+package certs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kabukky/httpscerts"
+)
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	if _, err := NewReloader(certFile, keyFile); err == nil {
+		t.Fatal("expected an error for missing certificate files")
+	}
+
+	if err := httpscerts.Generate(certFile, keyFile, "127.0.0.1:9999"); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := r.GetCertificate(nil)
+
+	if err := ioutil.WriteFile(certFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Error("expected an error reloading a broken certificate")
+	}
+	if current, _ := r.GetCertificate(nil); current != first {
+		t.Error("the previous certificate should stay in use after a failed reload")
+	}
+
+	if err := httpscerts.Generate(certFile, keyFile, "127.0.0.1:9999"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	current, _ := r.GetCertificate(nil)
+	if bytes.Equal(current.Certificate[0], first.Certificate[0]) {
+		t.Error("expected the regenerated certificate after reloading")
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		httpsAddr, host, target string
+	}{
+		{"0.0.0.0:9999", "example.com:8080", "https://example.com:9999/download?file=a"},
+		{"0.0.0.0:443", "example.com", "https://example.com/download?file=a"},
+		{":9999", "[::1]:8080", "https://[::1]:9999/download?file=a"},
+		{":443", "[::1]:8080", "https://[::1]/download?file=a"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/download?file=a", nil)
+		req.Host = test.host
+		rec := httptest.NewRecorder()
+		RedirectHandler(test.httpsAddr).ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusPermanentRedirect {
+			t.Errorf("%s: expected status %d, got %d", test.host, http.StatusPermanentRedirect, rec.Code)
+		}
+		if location := rec.Header().Get("Location"); location != test.target {
+			t.Errorf("%s: expected redirect to %s, got %s", test.host, test.target, location)
+		}
+	}
+}
+
+func TestSelfSignedHosts(t *testing.T) {
+	tests := []struct {
+		hostnames []string
+		listen    string
+		hosts     string
+	}{
+		{nil, ":8443", "localhost,127.0.0.1,::1"},
+		{nil, "0.0.0.0:8443", "localhost,127.0.0.1,::1"},
+		{nil, "[::]:8443", "localhost,127.0.0.1,::1"},
+		{nil, "10.0.0.5:8443", "10.0.0.5"},
+		{nil, "files.example.com:8443", "files.example.com"},
+		{[]string{"files.example.com", "10.0.0.5"}, ":8443", "files.example.com,10.0.0.5"},
+	}
+
+	for _, test := range tests {
+		if hosts := SelfSignedHosts(test.hostnames, test.listen); hosts != test.hosts {
+			t.Errorf("%v %s: expected %s, got %s", test.hostnames, test.listen, test.hosts, hosts)
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tiger5226/filetransfer/storage"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds every setting of the server
+type Config struct {
+	Listen          string        `yaml:"listen"`
+	ReadTimeout     time.Duration `yaml:"read_timeout"`
+	WriteTimeout    time.Duration `yaml:"write_timeout"`
+	DataDir         string        `yaml:"data_dir"`
+	JenkinsfilesDir string        `yaml:"jenkinsfiles_dir"`
+	TokenFile       string        `yaml:"token_file"`
+	ACLFile         string        `yaml:"acl_file"`
+	MetadataDir     string        `yaml:"metadata_dir"`
+	MaxUploadSize   int64         `yaml:"max_upload_size"`
+	SessionTTL      time.Duration `yaml:"session_ttl"`
+	Extract         Extract       `yaml:"extract"`
+	Retention       Retention     `yaml:"retention"`
+	Quota           Quota         `yaml:"quota"`
+	Versioning      Versioning    `yaml:"versioning"`
+	Links           Links         `yaml:"links"`
+	Owner           Owner         `yaml:"owner"`
+	TLS             TLS           `yaml:"tls"`
+	Storage         Storage       `yaml:"storage"`
+}
+
+// Owner is the user and group that uploaded files and buckets are handed to
+type Owner struct {
+	UID int `yaml:"uid"`
+	GID int `yaml:"gid"`
+}
+
+// Extract limits what a single uploaded archive may unpack to
+type Extract struct {
+	MaxSize    int64 `yaml:"max_size"`
+	MaxEntries int   `yaml:"max_entries"`
+}
+
+// Retention configures the janitor enforcing the bucket retention policies
+type Retention struct {
+	// File holds the policies set through the API
+	File string `yaml:"file"`
+	// Interval between two runs of the janitor, 0 disables it
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Quota configures the storage quotas. Quotas of single buckets and users are set through the API.
+type Quota struct {
+	// File holds the quotas set through the API
+	File string `yaml:"file"`
+	// Bucket is the default quota in bytes of every top level bucket, 0 for no limit
+	Bucket int64 `yaml:"bucket"`
+	// User is the default quota in bytes of every user, 0 for no limit
+	User int64 `yaml:"user"`
+}
+
+// Versioning configures where previous versions of files in versioned buckets are kept. Buckets are versioned
+// through the API.
+type Versioning struct {
+	// File holds which buckets are versioned
+	File string `yaml:"file"`
+	// Dir holds the previous versions with the local backend
+	Dir string `yaml:"dir"`
+	// S3Bucket holds the previous versions with the s3 backend, using the same endpoint and credentials. Without it
+	// versioning is not available with the s3 backend.
+	S3Bucket string `yaml:"s3_bucket"`
+}
+
+// Links configures the pre-signed download and upload links
+type Links struct {
+	// File holds the issued links, so their uses can be counted and they can be revoked
+	File string `yaml:"file"`
+	// KeyFile holds the key links are signed with. It is generated when missing; replacing it invalidates every link.
+	KeyFile string `yaml:"key_file"`
+	// MaxExpiry is the longest time a link may be valid for
+	MaxExpiry time.Duration `yaml:"max_expiry"`
+}
+
+// TLS enables HTTPS and holds the certificate used by the server
+type TLS struct {
+	Enabled        bool   `yaml:"enabled"`
+	Cert           string `yaml:"cert"`
+	Key            string `yaml:"key"`
+	SelfSigned     bool   `yaml:"self_signed"`
+	RedirectListen string `yaml:"redirect_listen"`
+	Client         Client `yaml:"client"`
+	// Hostnames the self-signed certificate is issued for, by default the host of the listen address or localhost
+	Hostnames []string `yaml:"hostnames"`
+}
+
+// Client configures authentication with TLS client certificates
+type Client struct {
+	// Auth is none, optional or require
+	Auth string `yaml:"auth"`
+	// CA is the PEM bundle of certificate authorities client certificates must be issued by
+	CA string `yaml:"ca"`
+	// Identity is the subject field used as the user name, cn or subject
+	Identity string `yaml:"identity"`
+	// Admins are the identities given the same rights as admin tokens
+	Admins []string `yaml:"admins"`
+}
+
+// Storage selects and configures the storage backend
+type Storage struct {
+	Backend string           `yaml:"backend"`
+	S3      storage.S3Config `yaml:"s3"`
+}
+
+// setting is a value that can be overridden from the environment and the command line
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	apply func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{"listen", "FT_LISTEN", "address to listen on", func(c *Config, v string) error { c.Listen = v; return nil }},
+	{"read-timeout", "FT_READ_TIMEOUT", "maximum duration for reading a request", durationSetter(func(c *Config) *time.Duration { return &c.ReadTimeout })},
+	{"write-timeout", "FT_WRITE_TIMEOUT", "maximum duration for writing a response", durationSetter(func(c *Config) *time.Duration { return &c.WriteTimeout })},
+	{"data-dir", "FT_DATA_DIR", "directory holding the buckets", func(c *Config, v string) error { c.DataDir = v; return nil }},
+	{"jenkinsfiles-dir", "FT_JENKINSFILES_DIR", "directory holding the jenkinsfiles", func(c *Config, v string) error { c.JenkinsfilesDir = v; return nil }},
+	{"token-file", "FT_TOKEN_FILE", "file holding the API tokens", func(c *Config, v string) error { c.TokenFile = v; return nil }},
+	{"acl-file", "FT_ACL_FILE", "file holding the bucket access lists", func(c *Config, v string) error { c.ACLFile = v; return nil }},
+	{"metadata-dir", "FT_METADATA_DIR", "directory holding the metadata of the files", func(c *Config, v string) error { c.MetadataDir = v; return nil }},
+	{"max-upload-size", "FT_MAX_UPLOAD_SIZE", "largest accepted upload in bytes, 0 for no limit", int64Setter(func(c *Config) *int64 { return &c.MaxUploadSize })},
+	{"session-ttl", "FT_SESSION_TTL", "time after the last chunk an unfinished resumable upload is removed, 0 to keep them", durationSetter(func(c *Config) *time.Duration { return &c.SessionTTL })},
+	{"extract-max-size", "FT_EXTRACT_MAX_SIZE", "largest total size in bytes an uploaded archive may unpack to, 0 for no limit", int64Setter(func(c *Config) *int64 { return &c.Extract.MaxSize })},
+	{"extract-max-entries", "FT_EXTRACT_MAX_ENTRIES", "most entries an uploaded archive may contain, 0 for no limit", intSetter(func(c *Config) *int { return &c.Extract.MaxEntries })},
+	{"retention-file", "FT_RETENTION_FILE", "file holding the bucket retention policies", func(c *Config, v string) error { c.Retention.File = v; return nil }},
+	{"retention-interval", "FT_RETENTION_INTERVAL", "time between retention runs, 0 to disable expiry", durationSetter(func(c *Config) *time.Duration { return &c.Retention.Interval })},
+	{"quota-file", "FT_QUOTA_FILE", "file holding the bucket and user quotas", func(c *Config, v string) error { c.Quota.File = v; return nil }},
+	{"quota-bucket", "FT_QUOTA_BUCKET", "default quota in bytes of every top level bucket, 0 for no limit", int64Setter(func(c *Config) *int64 { return &c.Quota.Bucket })},
+	{"quota-user", "FT_QUOTA_USER", "default quota in bytes of every user, 0 for no limit", int64Setter(func(c *Config) *int64 { return &c.Quota.User })},
+	{"versioning-file", "FT_VERSIONING_FILE", "file holding which buckets are versioned", func(c *Config, v string) error { c.Versioning.File = v; return nil }},
+	{"versioning-dir", "FT_VERSIONING_DIR", "directory holding previous versions of files", func(c *Config, v string) error { c.Versioning.Dir = v; return nil }},
+	{"versioning-s3-bucket", "FT_VERSIONING_S3_BUCKET", "S3 bucket holding previous versions of files", func(c *Config, v string) error { c.Versioning.S3Bucket = v; return nil }},
+	{"links-file", "FT_LINKS_FILE", "file holding the pre-signed links", func(c *Config, v string) error { c.Links.File = v; return nil }},
+	{"links-key-file", "FT_LINKS_KEY_FILE", "file holding the key pre-signed links are signed with", func(c *Config, v string) error { c.Links.KeyFile = v; return nil }},
+	{"links-max-expiry", "FT_LINKS_MAX_EXPIRY", "longest time a pre-signed link may be valid for", durationSetter(func(c *Config) *time.Duration { return &c.Links.MaxExpiry })},
+	{"owner-uid", "FT_OWNER_UID", "user id that uploaded files are owned by", intSetter(func(c *Config) *int { return &c.Owner.UID })},
+	{"owner-gid", "FT_OWNER_GID", "group id that uploaded files are owned by", intSetter(func(c *Config) *int { return &c.Owner.GID })},
+	{"tls", "FT_TLS", "serve HTTPS", boolSetter(func(c *Config) *bool { return &c.TLS.Enabled })},
+	{"tls-cert", "FT_TLS_CERT", "TLS certificate file", func(c *Config, v string) error { c.TLS.Cert = v; return nil }},
+	{"tls-key", "FT_TLS_KEY", "TLS private key file", func(c *Config, v string) error { c.TLS.Key = v; return nil }},
+	{"tls-self-signed", "FT_TLS_SELF_SIGNED", "generate a self-signed certificate when none exists", boolSetter(func(c *Config) *bool { return &c.TLS.SelfSigned })},
+	{"tls-redirect-listen", "FT_TLS_REDIRECT_LISTEN", "address of a plain HTTP listener redirecting to HTTPS", func(c *Config, v string) error { c.TLS.RedirectListen = v; return nil }},
+	{"tls-client-auth", "FT_TLS_CLIENT_AUTH", "client certificate mode, none, optional or require", func(c *Config, v string) error { c.TLS.Client.Auth = v; return nil }},
+	{"tls-client-ca", "FT_TLS_CLIENT_CA", "CA bundle client certificates are verified against", func(c *Config, v string) error { c.TLS.Client.CA = v; return nil }},
+	{"tls-client-identity", "FT_TLS_CLIENT_IDENTITY", "client certificate subject field used as the user, cn or subject", func(c *Config, v string) error { c.TLS.Client.Identity = v; return nil }},
+	{"storage", "FT_STORAGE", "storage backend, local or s3", func(c *Config, v string) error { c.Storage.Backend = v; return nil }},
+	{"s3-endpoint", "FT_S3_ENDPOINT", "S3 endpoint URL", func(c *Config, v string) error { c.Storage.S3.Endpoint = v; return nil }},
+	{"s3-region", "FT_S3_REGION", "S3 region", func(c *Config, v string) error { c.Storage.S3.Region = v; return nil }},
+	{"s3-bucket", "FT_S3_BUCKET", "S3 bucket holding the data", func(c *Config, v string) error { c.Storage.S3.Bucket = v; return nil }},
+	{"s3-access-key", "FT_S3_ACCESS_KEY", "S3 access key", func(c *Config, v string) error { c.Storage.S3.AccessKey = v; return nil }},
+	{"s3-secret-key", "FT_S3_SECRET_KEY", "S3 secret key", func(c *Config, v string) error { c.Storage.S3.SecretKey = v; return nil }},
+}
+
+// Defaults returns the settings used when nothing else is configured, with every path inside dir
+func Defaults(dir string) *Config {
+	return &Config{
+		Listen:          "0.0.0.0:9999",
+		ReadTimeout:     15 * time.Minute,
+		WriteTimeout:    15 * time.Minute,
+		DataDir:         filepath.Join(dir, "data"),
+		JenkinsfilesDir: filepath.Join(dir, "jenkinsfiles"),
+		TokenFile:       filepath.Join(dir, "tokens.json"),
+		ACLFile:         filepath.Join(dir, "acl.json"),
+		MetadataDir:     filepath.Join(dir, "metadata"),
+		MaxUploadSize:   10 << 30,
+		SessionTTL:      24 * time.Hour,
+		Extract:         Extract{MaxSize: 50 << 30, MaxEntries: 100000},
+		Retention:       Retention{File: filepath.Join(dir, "retention.json"), Interval: time.Hour},
+		Quota:           Quota{File: filepath.Join(dir, "quota.json")},
+		Versioning:      Versioning{File: filepath.Join(dir, "versioning.json"), Dir: filepath.Join(dir, "versions")},
+		Links:           Links{File: filepath.Join(dir, "links.json"), KeyFile: filepath.Join(dir, "links.key"), MaxExpiry: 7 * 24 * time.Hour},
+		Owner:           Owner{UID: 65534, GID: 65534},
+		TLS: TLS{
+			Cert:   filepath.Join(dir, "cert.pem"),
+			Key:    filepath.Join(dir, "key.pem"),
+			Client: Client{Auth: "none", Identity: "cn"},
+		},
+		Storage: Storage{Backend: "local"},
+	}
+}
+
+// Load builds the configuration from the defaults, the YAML file given with -config (or FT_CONFIG), the FT_*
+// environment variables and finally the remaining command line flags, each overriding the one before.
+func Load(args []string) (*Config, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	fs := flag.NewFlagSet("filetransfer", flag.ContinueOnError)
+	file := fs.String("config", os.Getenv("FT_CONFIG"), "YAML configuration file")
+	values := make(map[string]*rawValue, len(settings))
+	for _, s := range settings {
+		values[s.flag] = &rawValue{}
+		fs.Var(values[s.flag], s.flag, s.usage+" ("+s.env+")")
+	}
+	err = fs.Parse(args)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	c := Defaults(dir)
+	if *file != "" {
+		contents, err := ioutil.ReadFile(*file)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		err = yaml.UnmarshalStrict(contents, c)
+		if err != nil {
+			return nil, errors.Prefix("unable to read "+*file+": ", err)
+		}
+		c.resolvePaths(filepath.Dir(*file))
+	}
+
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env); ok {
+			if err := s.apply(c, value); err != nil {
+				return nil, errors.Prefix(s.env+": ", err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if values[s.flag].set {
+			if err := s.apply(c, values[s.flag].value); err != nil {
+				return nil, errors.Prefix("-"+s.flag+": ", err)
+			}
+		}
+	}
+
+	return c, c.Validate()
+}
+
+// resolvePaths makes the relative paths of the configuration file relative to the directory it is in, so the server
+// finds the same files wherever it is started from. The defaults are absolute already.
+func (c *Config) resolvePaths(dir string) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+	paths := []*string{
+		&c.DataDir, &c.JenkinsfilesDir, &c.TokenFile, &c.ACLFile, &c.MetadataDir, &c.Retention.File, &c.Quota.File,
+		&c.Versioning.File, &c.Versioning.Dir, &c.Links.File, &c.Links.KeyFile, &c.TLS.Cert, &c.TLS.Key, &c.TLS.Client.CA,
+	}
+	for _, p := range paths {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+}
+
+// Validate checks the configuration for values the server cannot start with
+func (c *Config) Validate() error {
+	var problems []string
+
+	if _, port, err := net.SplitHostPort(c.Listen); err != nil {
+		problems = append(problems, "listen: "+err.Error())
+	} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		problems = append(problems, "listen: invalid port '"+port+"'")
+	}
+	if c.ReadTimeout <= 0 {
+		problems = append(problems, "read_timeout must be positive")
+	}
+	if c.WriteTimeout <= 0 {
+		problems = append(problems, "write_timeout must be positive")
+	}
+	if c.DataDir == "" {
+		problems = append(problems, "data_dir is required")
+	}
+	if c.TokenFile == "" {
+		problems = append(problems, "token_file is required")
+	}
+	if c.ACLFile == "" {
+		problems = append(problems, "acl_file is required")
+	}
+	if c.MetadataDir == "" {
+		problems = append(problems, "metadata_dir is required")
+	}
+	if c.MaxUploadSize < 0 {
+		problems = append(problems, "max_upload_size may not be negative")
+	}
+	if c.SessionTTL < 0 {
+		problems = append(problems, "session_ttl may not be negative")
+	}
+	if c.Extract.MaxSize < 0 || c.Extract.MaxEntries < 0 {
+		problems = append(problems, "extract limits may not be negative")
+	}
+	if c.Retention.File == "" {
+		problems = append(problems, "retention file is required")
+	}
+	if c.Retention.Interval < 0 {
+		problems = append(problems, "retention interval may not be negative")
+	}
+	if c.Quota.File == "" {
+		problems = append(problems, "quota file is required")
+	}
+	if c.Quota.Bucket < 0 || c.Quota.User < 0 {
+		problems = append(problems, "default quotas may not be negative")
+	}
+	if c.Versioning.File == "" {
+		problems = append(problems, "versioning file is required")
+	}
+	if c.Versioning.Dir == "" && c.Storage.Backend == "local" {
+		problems = append(problems, "versioning dir is required")
+	}
+	if c.Links.File == "" || c.Links.KeyFile == "" {
+		problems = append(problems, "links file and key_file are required")
+	}
+	if c.Links.MaxExpiry <= 0 {
+		problems = append(problems, "links max_expiry must be positive")
+	}
+	if c.Owner.UID < 0 || c.Owner.GID < 0 {
+		problems = append(problems, "owner uid and gid may not be negative")
+	}
+	if c.TLS.Enabled && (c.TLS.Cert == "" || c.TLS.Key == "") {
+		problems = append(problems, "tls cert and key are required")
+	}
+	if c.TLS.RedirectListen != "" {
+		if !c.TLS.Enabled {
+			problems = append(problems, "tls redirect_listen requires tls to be enabled")
+		} else if _, _, err := net.SplitHostPort(c.TLS.RedirectListen); err != nil {
+			problems = append(problems, "tls redirect_listen: "+err.Error())
+		}
+	}
+
+	switch c.TLS.Client.Auth {
+	case "", "none":
+	case "optional", "require":
+		if !c.TLS.Enabled {
+			problems = append(problems, "tls client auth requires tls to be enabled")
+		}
+		if c.TLS.Client.CA == "" {
+			problems = append(problems, "tls client ca is required for client certificates")
+		}
+	default:
+		problems = append(problems, "tls client: unknown auth mode '"+c.TLS.Client.Auth+"'")
+	}
+	if c.TLS.Client.Identity != "" && c.TLS.Client.Identity != "cn" && c.TLS.Client.Identity != "subject" {
+		problems = append(problems, "tls client: unknown identity field '"+c.TLS.Client.Identity+"'")
+	}
+
+	switch c.Storage.Backend {
+	case "local":
+	case "s3":
+		s3 := c.Storage.S3
+		if s3.Endpoint == "" || s3.Bucket == "" || s3.AccessKey == "" || s3.SecretKey == "" {
+			problems = append(problems, "storage: s3 requires an endpoint, bucket, access key and secret key")
+		}
+		if c.Versioning.S3Bucket != "" && c.Versioning.S3Bucket == s3.Bucket {
+			problems = append(problems, "versioning: s3_bucket has to differ from the storage bucket")
+		}
+	default:
+		problems = append(problems, "storage: unknown backend '"+c.Storage.Backend+"'")
+	}
+
+	if len(problems) > 0 {
+		return errors.Err("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// rawValue records a flag without interpreting it, so flags can be applied after the file and environment
+type rawValue struct {
+	set   bool
+	value string
+}
+
+func (r *rawValue) String() string { return r.value }
+
+func (r *rawValue) Set(value string) error {
+	r.set = true
+	r.value = value
+	return nil
+}
+
+func durationSetter(field func(c *Config) *time.Duration) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+func boolSetter(field func(c *Config) *bool) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+func int64Setter(field func(c *Config) *int64) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		*field(c) = i
+		return nil
+	}
+}
+
+func intSetter(field func(c *Config) *int) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = i
+		return nil
+	}
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "ft-config-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestLoadDefaults(t *testing.T) {
+	c, err := Load(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Listen != "0.0.0.0:9999" || c.ReadTimeout != 15*time.Minute || c.Owner.UID != 65534 {
+		t.Errorf("unexpected defaults %+v", c)
+	}
+	if filepath.Base(c.DataDir) != "data" || !filepath.IsAbs(c.DataDir) {
+		t.Errorf("unexpected data dir %s", c.DataDir)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+listen: 127.0.0.1:8000
+read_timeout: 1m
+data_dir: /srv/file
+owner:
+  uid: 1000
+storage:
+  backend: s3
+  s3:
+    endpoint: http://minio:9000
+    bucket: artifacts
+    access_key: access
+    secret_key: secret
+`)
+	defer cleanup()
+
+	os.Setenv("FT_LISTEN", "127.0.0.1:8001")
+	os.Setenv("FT_DATA_DIR", "/srv/env")
+	defer os.Unsetenv("FT_LISTEN")
+	defer os.Unsetenv("FT_DATA_DIR")
+
+	c, err := Load([]string{"-config", path, "-data-dir", "/srv/flag", "serve"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Listen != "127.0.0.1:8001" {
+		t.Errorf("environment did not override the file: %s", c.Listen)
+	}
+	if c.DataDir != "/srv/flag" {
+		t.Errorf("flag did not override the environment: %s", c.DataDir)
+	}
+	if c.ReadTimeout != time.Minute || c.WriteTimeout != 15*time.Minute {
+		t.Errorf("unexpected timeouts %v %v", c.ReadTimeout, c.WriteTimeout)
+	}
+	if c.Owner.UID != 1000 || c.Owner.GID != 65534 {
+		t.Errorf("unexpected owner %+v", c.Owner)
+	}
+	if c.Storage.Backend != "s3" || c.Storage.S3.Bucket != "artifacts" || c.Storage.S3.AccessKey != "access" {
+		t.Errorf("unexpected storage %+v", c.Storage)
+	}
+}
+
+func TestLoadResolvesPaths(t *testing.T) {
+	path, cleanup := writeConfig(t, `
+data_dir: ./data
+token_file: /etc/ft/tokens.json
+tls:
+  cert: certs/cert.pem
+`)
+	defer cleanup()
+
+	os.Setenv("FT_ACL_FILE", "acl.json")
+	defer os.Unsetenv("FT_ACL_FILE")
+
+	c, err := Load([]string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Dir(path)
+	if c.DataDir != filepath.Join(dir, "data") || c.TLS.Cert != filepath.Join(dir, "certs", "cert.pem") {
+		t.Errorf("relative paths were not resolved against the config file: %s, %s", c.DataDir, c.TLS.Cert)
+	}
+	if c.TokenFile != "/etc/ft/tokens.json" {
+		t.Errorf("an absolute path was changed: %s", c.TokenFile)
+	}
+	if c.ACLFile != "acl.json" {
+		t.Errorf("a path from the environment was resolved against the config file: %s", c.ACLFile)
+	}
+}
+
+func TestLoadRejectsInvalid(t *testing.T) {
+	cases := map[string]string{
+		"unknown_field: true\n":                                  "unknown_field",
+		"listen: nowhere\n":                                      "listen",
+		"listen: 0.0.0.0:99999\n":                                "invalid port",
+		"read_timeout: 0s\n":                                     "read_timeout",
+		"extract:\n  max_entries: -1\n":                          "extract limits",
+		"max_upload_size: -1\n":                                  "max_upload_size",
+		"session_ttl: -1h\n":                                     "session_ttl",
+		"retention:\n  interval: -1h\n":                          "retention interval",
+		"quota:\n  user: -1\n":                                   "default quotas",
+		"storage:\n  backend: s3\n":                              "s3 requires",
+		"versioning:\n  dir: ''\n":                               "versioning dir",
+		"links:\n  max_expiry: 0s\n":                             "links max_expiry",
+		"storage:\n  backend: ftp\n":                             "unknown backend",
+		"owner:\n  uid: -1\n":                                    "owner uid",
+		"tls:\n  enabled: true\n  cert: ''\n":                    "tls cert",
+		"tls:\n  redirect_listen: :80\n":                         "requires tls",
+		"tls:\n  client:\n    auth: require\n":                   "requires tls",
+		"tls:\n  enabled: true\n  client:\n    auth: optional\n": "client ca",
+		"tls:\n  client:\n    auth: always\n":                    "unknown auth mode",
+		"tls:\n  client:\n    identity: email\n":                 "unknown identity",
+	}
+
+	for contents, expected := range cases {
+		path, cleanup := writeConfig(t, contents)
+		_, err := Load([]string{"-config", path})
+		cleanup()
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("config %q returned %v, expected an error mentioning %q", contents, err, expected)
+		}
+	}
+
+	if _, err := Load([]string{"-read-timeout", "soon"}); err == nil {
+		t.Error("an invalid duration flag was accepted")
+	}
+}
@@ -16,4 +16,5 @@ require (
 	github.com/ogier/pflag v0.0.1 // indirect
 	github.com/sirupsen/logrus v1.4.1
 	github.com/spf13/cast v1.2.0
+	gopkg.in/yaml.v2 v2.4.0
 )
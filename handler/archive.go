@@ -0,0 +1,250 @@
+package handler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/tiger5226/filetransfer/acl"
+	"github.com/tiger5226/filetransfer/storage"
+	"github.com/tiger5226/filetransfer/util"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// archiveFormats maps the accepted format names and media types to the archive format
+var archiveFormats = map[string]string{
+	"zip":                "zip",
+	"tar.gz":             "tar.gz",
+	"tgz":                "tar.gz",
+	"application/zip":    "zip",
+	"application/gzip":   "tar.gz",
+	"application/x-gzip": "tar.gz",
+	"application/x-gtar": "tar.gz",
+}
+
+// Archive Handles a server request to download a whole bucket, including the buckets nested below it, or a
+// selection of its files as a single archive. The archive is generated while it is sent, so nothing is written to
+// disk. The format is zip or tar.gz, chosen with the format query parameter or otherwise the Accept header.
+// Files are named relative to the bucket. Nested buckets the caller cannot read are left out. HEAD requests are
+// answered with the headers alone, without looking up any file, so they do not tell whether the bucket exists.
+func Archive(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		logrus.Error("Archive requested with method ", request.Method)
+		response.Header().Set("Allow", "GET, HEAD")
+		http.Error(response, "Archives must be requested with GET.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := request.URL.Query()
+	bucket, err := storage.CleanBucket(query.Get("bucket"))
+	if err != nil {
+		logrus.Error(err)
+		http.Error(response, errors.Unwrap(err).Error(), http.StatusBadRequest)
+		return
+	}
+
+	format, ok := archiveFormat(query.Get("format"), request.Header.Get("Accept"))
+	if !ok {
+		logrus.Error("Unsupported archive format requested: '", query.Get("format"), "', Accept: ", request.Header.Get("Accept"))
+		http.Error(response, "Unsupported archive format, use zip or tar.gz.", http.StatusNotAcceptable)
+		return
+	}
+
+	if !acl.Check(request, bucket, acl.Read) {
+		logrus.Error("Read access to '", bucket, "' denied")
+		http.Error(response, "Permission denied.", http.StatusForbidden)
+		return
+	}
+
+	name := path.Base(bucket)
+	if bucket == "" {
+		name = "files"
+	}
+	contentType := "application/zip"
+	if format == "tar.gz" {
+		contentType = "application/gzip"
+	}
+	//The size of the archive is only known once it is written, so HEAD is answered without looking at the files
+	if request.Method == http.MethodHead {
+		setArchiveHeaders(response, name+"."+format, contentType)
+		return
+	}
+
+	// Everything is looked up before the first byte is sent, while errors can still be reported properly
+	infos, status, err := archiveFiles(request, bucket, query["file"])
+	if err != nil {
+		logrus.Error(err)
+		http.Error(response, errors.Unwrap(err).Error(), status)
+		return
+	}
+
+	setArchiveHeaders(response, name+"."+format, contentType)
+
+	if format == "zip" {
+		err = writeZip(response, bucket, infos)
+	} else {
+		err = writeTarGz(response, bucket, infos)
+	}
+	if err != nil {
+		logrus.Error("Archive of '", bucket, "' aborted: ", err)
+		//The status is gone already, so the connection is dropped to keep the client from taking a truncated
+		//archive for a complete one
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// setArchiveHeaders describes the archive sent as the response
+func setArchiveHeaders(response http.ResponseWriter, filename, contentType string) {
+	response.Header().Set("Content-Type", contentType)
+	response.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+}
+
+// archiveFormat picks the format from the query parameter, or the first supported type in the Accept header.
+// Zip is used when neither asks for anything in particular.
+func archiveFormat(param, accept string) (string, bool) {
+	if param != "" {
+		format, ok := archiveFormats[strings.ToLower(param)]
+		return format, ok
+	}
+
+	for _, value := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(value)
+		if err != nil {
+			continue
+		}
+		if format, ok := archiveFormats[mediaType]; ok {
+			return format, true
+		}
+		if mediaType == "*/*" || mediaType == "application/*" {
+			return "zip", true
+		}
+	}
+	return "zip", accept == ""
+}
+
+// archiveFiles returns the files to include. Selected files are named relative to the bucket and must all exist,
+// otherwise every readable file in and below the bucket is included.
+func archiveFiles(request *http.Request, bucket string, selected []string) ([]*storage.ObjectInfo, int, error) {
+	infos := make([]*storage.ObjectInfo, 0)
+	if len(selected) > 0 {
+		for _, file := range selected {
+			if strings.Trim(file, "/ ") == "" {
+				return nil, http.StatusBadRequest, errors.Err("file names may not be empty")
+			}
+			key, err := storage.JoinKey(bucket, file)
+			if err != nil {
+				return nil, http.StatusBadRequest, err
+			}
+			if !acl.Check(request, storage.BucketOf(key), acl.Read) {
+				return nil, http.StatusForbidden, errors.Err("read access to '%s' denied", key)
+			}
+			info, err := storage.Default.Stat(key)
+			if errors.Is(err, storage.ErrNotFound) || err == nil && info.IsDir {
+				return nil, http.StatusNotFound, errors.Err("file '%s' not found", file)
+			} else if err != nil {
+				return nil, http.StatusInternalServerError, err
+			}
+			infos = append(infos, info)
+		}
+		return infos, http.StatusOK, nil
+	}
+
+	all, err := storage.Default.List(bucket)
+	if storage.IsInvalidPath(err) {
+		return nil, http.StatusBadRequest, err
+	} else if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	readable := map[string]bool{}
+	for _, info := range all {
+		if info.IsDir {
+			continue
+		}
+		allowed, ok := readable[info.Bucket()]
+		if !ok {
+			allowed = acl.Check(request, info.Bucket(), acl.Read)
+			readable[info.Bucket()] = allowed
+		}
+		if allowed {
+			infos = append(infos, info)
+		}
+	}
+	if len(infos) == 0 && bucket != "" {
+		if _, err := storage.Default.Stat(bucket); errors.Is(err, storage.ErrNotFound) {
+			return nil, http.StatusNotFound, errors.Err("bucket '%s' not found", bucket)
+		}
+	}
+	return infos, http.StatusOK, nil
+}
+
+// archiveName returns the name of a file within the archive
+func archiveName(bucket string, info *storage.ObjectInfo) string {
+	if bucket == "" {
+		return info.Key
+	}
+	return strings.TrimPrefix(info.Key, bucket+"/")
+}
+
+func writeZip(w io.Writer, bucket string, infos []*storage.ObjectInfo) error {
+	archive := zip.NewWriter(w)
+	for _, info := range infos {
+		header := &zip.FileHeader{Name: archiveName(bucket, info), Method: zip.Deflate}
+		header.SetModTime(info.ModifiedAt)
+		entry, err := archive.CreateHeader(header)
+		if err != nil {
+			return errors.Err(err)
+		}
+		err = copyObject(entry, info)
+		if err != nil {
+			return err
+		}
+	}
+	return errors.Err(archive.Close())
+}
+
+func writeTarGz(w io.Writer, bucket string, infos []*storage.ObjectInfo) error {
+	compressed := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressed)
+	for _, info := range infos {
+		err := archive.WriteHeader(&tar.Header{
+			Name:    archiveName(bucket, info),
+			Mode:    0644,
+			Size:    info.Size,
+			ModTime: info.ModifiedAt,
+		})
+		if err != nil {
+			return errors.Err(err)
+		}
+		err = copyObject(archive, info)
+		if err != nil {
+			return err
+		}
+	}
+	err := archive.Close()
+	if err != nil {
+		return errors.Err(err)
+	}
+	return errors.Err(compressed.Close())
+}
+
+// copyObject writes the contents of a stored file, which must not have changed size since it was listed
+func copyObject(w io.Writer, info *storage.ObjectInfo) error {
+	object, _, err := storage.Default.Get(info.Key)
+	if err != nil {
+		return err
+	}
+	defer util.CloseObject(object)
+
+	n, err := io.Copy(w, io.LimitReader(object, info.Size))
+	if err == nil && n != info.Size {
+		err = errors.Err("'%s' changed while it was archived", info.Key)
+	}
+	return errors.Err(err)
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tiger5226/filetransfer/storage"
+)
+
+func TestArchive(t *testing.T) {
+	defer useTestStorage(t)()
+
+	files := map[string]string{"build/app.bin": "binary", "build/docs/readme.txt": "read me", "other/x": "x"}
+	for key, contents := range files {
+		if _, err := storage.Default.Put(key, strings.NewReader(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archive := func(query, accept string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/bucket/archive?"+query, nil)
+		if accept != "" {
+			request.Header.Set("Accept", accept)
+		}
+		response := httptest.NewRecorder()
+		Archive(response, request)
+		return response
+	}
+
+	response := archive("bucket=build", "")
+	if response.Code != http.StatusOK || response.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("zip archive returned %d %s", response.Code, response.Header().Get("Content-Type"))
+	}
+	zipped, err := zip.NewReader(bytes.NewReader(response.Body.Bytes()), int64(response.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zipped.File {
+		r, _ := f.Open()
+		data, _ := ioutil.ReadAll(r)
+		_ = r.Close()
+		names = append(names, f.Name+"="+string(data))
+	}
+	if strings.Join(names, ",") != "app.bin=binary,docs/readme.txt=read me" {
+		t.Errorf("zip archive contains %v", names)
+	}
+
+	response = archive("bucket=build&file=docs/readme.txt", "application/gzip, */*;q=0.5")
+	if response.Code != http.StatusOK || !strings.Contains(response.Header().Get("Content-Disposition"), "build.tar.gz") {
+		t.Fatalf("tar.gz archive returned %d %s", response.Code, response.Header().Get("Content-Disposition"))
+	}
+	compressed, err := gzip.NewReader(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarred := tar.NewReader(compressed)
+	header, err := tarred.Next()
+	if err != nil || header.Name != "docs/readme.txt" {
+		t.Fatalf("unexpected tar entry %v, %v", header, err)
+	}
+	data, _ := ioutil.ReadAll(tarred)
+	if string(data) != "read me" {
+		t.Errorf("tar entry contains %q", data)
+	}
+	if _, err := tarred.Next(); err != io.EOF {
+		t.Errorf("expected a single tar entry, got %v", err)
+	}
+
+	statuses := map[string]int{
+		"bucket=missing":                 http.StatusNotFound,
+		"bucket=build&file=missing":      http.StatusNotFound,
+		"bucket=build&file=../other/x":   http.StatusBadRequest,
+		"bucket=../etc":                  http.StatusBadRequest,
+		"bucket=build&format=rar":        http.StatusNotAcceptable,
+		"bucket=build&format=tgz":        http.StatusOK,
+		"bucket=build&file=docs/../x":    http.StatusBadRequest,
+		"bucket=build&file=app.bin&file": http.StatusBadRequest,
+	}
+	for query, expected := range statuses {
+		if response := archive(query, ""); response.Code != expected {
+			t.Errorf("archive?%s returned %d, expected %d", query, response.Code, expected)
+		}
+	}
+	if response := archive("bucket=build", "text/html"); response.Code != http.StatusNotAcceptable {
+		t.Errorf("an unsupported Accept header returned %d", response.Code)
+	}
+
+	// HEAD only sends the headers, without listing or reading a single file
+	previous := storage.Default
+	storage.Default = nil
+	response = httptest.NewRecorder()
+	Archive(response, httptest.NewRequest(http.MethodHead, "/bucket/archive?bucket=build&format=tgz", nil))
+	storage.Default = previous
+	if response.Code != http.StatusOK || response.Header().Get("Content-Type") != "application/gzip" ||
+		!strings.Contains(response.Header().Get("Content-Disposition"), "build.tar.gz") || response.Body.Len() != 0 {
+		t.Errorf("HEAD returned %d %v with %q", response.Code, response.Header(), response.Body.String())
+	}
+
+	for _, method := range []string{http.MethodOptions, http.MethodPost, http.MethodDelete} {
+		response := httptest.NewRecorder()
+		Archive(response, httptest.NewRequest(method, "/bucket/archive?bucket=build", nil))
+		if response.Code != http.StatusMethodNotAllowed || strings.Contains(response.Body.String(), "binary") {
+			t.Errorf("%s returned %d with %q", method, response.Code, response.Body.String())
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/tiger5226/filetransfer/auth"
+
+	"github.com/sirupsen/logrus"
+)
+
+// audit records a file transferred by the request along with who sent it: the user, the token, certificate or link
+// it authenticated with and the remote address
+func audit(request *http.Request, action, key string, size int64) {
+	fields := logrus.Fields{"user": auth.User(request), "remote": request.RemoteAddr, "key": key, "size": size}
+	if token := auth.FromRequest(request); token != nil {
+		fields["token"] = token.ID
+	}
+	logrus.WithFields(fields).Info("Audit: ", action)
+}
+
+// auditUpload records the files an upload stored, including those extracted from archives
+func auditUpload(request *http.Request, results []*uploadResult) {
+	for _, result := range results {
+		switch {
+		case result.Status != http.StatusOK || result.Skipped:
+		case result.Manifest != nil:
+			for _, f := range result.Manifest.Files {
+				audit(request, "extract", f.File, f.Size)
+			}
+		default:
+			audit(request, "upload", result.File, result.Size)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tiger5226/filetransfer/storage"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+// The ways an upload can deal with a file that already exists
+const (
+	conflictOverwrite = "overwrite"
+	conflictFail      = "fail"
+	conflictRename    = "rename"
+	conflictKeepNewer = "keep-newer"
+)
+
+// maxRenames bounds the numeric suffixes tried when renaming an upload
+const maxRenames = 10000
+
+// ErrConflict is returned when an upload would replace an existing file and onConflict is fail
+var ErrConflict = errors.Base("the file already exists")
+
+// ErrPreconditionFailed is returned when the existing file does not satisfy the If-Match or If-None-Match headers
+var ErrPreconditionFailed = errors.Base("precondition failed")
+
+// ErrInvalidConflict is returned for an unknown onConflict value
+var ErrInvalidConflict = errors.Base("onConflict must be overwrite, fail, rename or keep-newer")
+
+// conflictOptions say what happens when an upload meets an existing file. Modified is the time the uploaded file was
+// last changed, which keep-newer compares with the existing file; without it the upload counts as the newer one.
+type conflictOptions struct {
+	Policy      string
+	Modified    time.Time
+	IfMatch     string
+	IfNoneMatch string
+}
+
+// setPolicy validates and sets the onConflict policy. An empty value means overwrite.
+func (o *conflictOptions) setPolicy(value string) error {
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch value {
+	case "":
+		o.Policy = conflictOverwrite
+	case conflictOverwrite, conflictFail, conflictRename, conflictKeepNewer:
+		o.Policy = value
+	default:
+		return errors.Prefix("'"+value+"'", ErrInvalidConflict)
+	}
+	return nil
+}
+
+// parseModified parses the modification time of an uploaded file, given in RFC 3339 format
+func parseModified(value string) (time.Time, error) {
+	modified, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(value))
+	if err != nil {
+		return time.Time{}, errors.Err("invalid modification time '%s'", value)
+	}
+	return modified, nil
+}
+
+// parsePreconditions reads the If-Match and If-None-Match headers. Headers that are absent keep their current value.
+func (o *conflictOptions) parsePreconditions(header textproto.MIMEHeader) {
+	if value := header.Get("If-Match"); value != "" {
+		o.IfMatch = value
+	}
+	if value := header.Get("If-None-Match"); value != "" {
+		o.IfNoneMatch = value
+	}
+}
+
+// resolveConflict decides where an upload meant for key is stored. It returns key itself, another key in the same
+// bucket when the upload is renamed, or "" when the existing file is kept and the upload is skipped. The caller
+// should hold lockKey(key) until the upload is stored, so concurrent uploads of the same file see each other.
+func resolveConflict(key string, o conflictOptions) (string, error) {
+	info, err := storage.Default.Stat(key)
+	if errors.Is(err, storage.ErrNotFound) {
+		info = nil
+	} else if err != nil {
+		return "", err
+	} else if info.IsDir {
+		return "", errors.Err(storage.PathError{Path: key, Reason: "a bucket of that name exists"})
+	}
+
+	err = checkPreconditions(info, o)
+	if err != nil || info == nil {
+		return key, err
+	}
+
+	switch o.Policy {
+	case conflictFail:
+		return "", errors.Prefix("'"+key+"'", ErrConflict)
+	case conflictKeepNewer:
+		modified := o.Modified
+		if modified.IsZero() {
+			modified = time.Now()
+		}
+		if !info.ModifiedAt.Before(modified) {
+			return "", nil
+		}
+	case conflictRename:
+		for n := 1; n <= maxRenames; n++ {
+			renamed := renameKey(key, n)
+			_, err := storage.Default.Stat(renamed)
+			if errors.Is(err, storage.ErrNotFound) {
+				return renamed, nil
+			} else if err != nil {
+				return "", err
+			}
+		}
+		return "", errors.Prefix("no free name for '"+key+"'", ErrConflict)
+	}
+	return key, nil
+}
+
+// checkPreconditions evaluates If-Match and If-None-Match against the existing file, which is nil if there is none.
+// If-Match compares entity tags strongly and If-None-Match weakly, as for any other request (RFC 7232).
+func checkPreconditions(info *storage.ObjectInfo, o conflictOptions) error {
+	etag := ""
+	if info != nil {
+		etag = info.ETag
+	}
+	if o.IfMatch != "" && (info == nil || !matchETag(o.IfMatch, etag, false)) {
+		return errors.Prefix("If-Match", ErrPreconditionFailed)
+	}
+	if o.IfNoneMatch != "" && info != nil && matchETag(o.IfNoneMatch, etag, true) {
+		return errors.Prefix("If-None-Match", ErrPreconditionFailed)
+	}
+	return nil
+}
+
+// matchETag reports whether an entity tag is in the comma separated list of a precondition header, or the list is *
+func matchETag(list, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		} else if !strings.HasPrefix(candidate, "W/") && !strings.HasPrefix(etag, "W/") && candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// renameKey adds a numeric suffix to the name of a file, in front of its extension: app.tar.gz becomes app-1.tar.gz
+func renameKey(key string, n int) string {
+	dir, name := path.Split(key)
+	ext := path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	if base := strings.TrimSuffix(name, ext); strings.HasSuffix(strings.ToLower(base), ".tar") {
+		ext = base[len(base)-len(".tar"):] + ext
+	}
+	return dir + strings.TrimSuffix(name, ext) + "-" + strconv.Itoa(n) + ext
+}
+
+// keyLocks serialises the uploads of the same file, so the existing file cannot change between resolving a conflict
+// and storing the upload
+var keyLocks = struct {
+	sync.Mutex
+	held map[string]*keyLock
+}{held: map[string]*keyLock{}}
+
+type keyLock struct {
+	sync.Mutex
+	waiting int
+}
+
+// lockKey locks the key against other uploads and returns the function releasing it
+func lockKey(key string) func() {
+	keyLocks.Lock()
+	l, ok := keyLocks.held[key]
+	if !ok {
+		l = &keyLock{}
+		keyLocks.held[key] = l
+	}
+	l.waiting++
+	keyLocks.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		keyLocks.Lock()
+		l.waiting--
+		if l.waiting == 0 {
+			delete(keyLocks.held, key)
+		}
+		keyLocks.Unlock()
+	}
+}
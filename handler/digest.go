@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/textproto"
+	"strings"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+// ErrDigestMismatch is returned when an upload does not match the digest the client sent along with it
+var ErrDigestMismatch = errors.Base("the uploaded file does not match the expected digest")
+
+// digests holds the SHA-256 and MD5 digests of a file. Either may be nil when not known.
+type digests struct {
+	SHA256 []byte
+	MD5    []byte
+}
+
+// parseDigestHeaders reads the expected digests from the Content-MD5 and Digest (RFC 3230) headers
+func (d *digests) parseDigestHeaders(header textproto.MIMEHeader) error {
+	if value := header.Get("Content-MD5"); value != "" {
+		err := d.set("md5", value)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, instance := range strings.Split(header.Get("Digest"), ",") {
+		algorithm := instance
+		value := ""
+		if i := strings.Index(instance, "="); i >= 0 {
+			algorithm, value = instance[:i], instance[i+1:]
+		}
+		algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+		// Other algorithms are allowed by the RFC, but cannot be verified here
+		if algorithm == "sha-256" || algorithm == "md5" {
+			err := d.set(strings.Replace(algorithm, "-", "", 1), value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// set records an expected digest given as hex or base64. Conflicting digests for the same algorithm are rejected.
+func (d *digests) set(algorithm, value string) error {
+	target, size := &d.SHA256, sha256.Size
+	if algorithm == "md5" {
+		target, size = &d.MD5, md5.Size
+	}
+
+	value = strings.TrimSpace(value)
+	sum, err := hex.DecodeString(value)
+	if err != nil || len(sum) != size {
+		sum, err = base64.StdEncoding.DecodeString(value)
+	}
+	if err != nil || len(sum) != size {
+		return errors.Err("invalid %s digest '%s'", algorithm, value)
+	}
+
+	if *target != nil && !bytes.Equal(*target, sum) {
+		return errors.Err("conflicting %s digests", algorithm)
+	}
+	*target = sum
+	return nil
+}
+
+// verifier computes the digests of everything read through it. Once the underlying reader is exhausted, the
+// digests are compared with the expected ones and a mismatch is reported instead of io.EOF, so the storage
+// backend discards the file rather than committing it.
+type verifier struct {
+	r        io.Reader
+	sha256   hash.Hash
+	md5      hash.Hash
+	expected digests
+}
+
+func newVerifier(r io.Reader, expected digests) *verifier {
+	return &verifier{r: r, sha256: sha256.New(), md5: md5.New(), expected: expected}
+}
+
+func (v *verifier) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	_, _ = v.sha256.Write(p[:n])
+	_, _ = v.md5.Write(p[:n])
+
+	if err == io.EOF {
+		computed := v.Sum()
+		if v.expected.SHA256 != nil && !bytes.Equal(v.expected.SHA256, computed.SHA256) ||
+			v.expected.MD5 != nil && !bytes.Equal(v.expected.MD5, computed.MD5) {
+			return n, errors.Err(ErrDigestMismatch)
+		}
+	}
+	return n, err
+}
+
+// Sum returns the digests of everything read so far
+func (v *verifier) Sum() digests {
+	return digests{SHA256: v.sha256.Sum(nil), MD5: v.md5.Sum(nil)}
+}
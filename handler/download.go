@@ -1,76 +1,109 @@
 package handler
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
-	"io"
 	"net/http"
-	"os"
-	"strconv"
 
+	"github.com/tiger5226/filetransfer/acl"
+	"github.com/tiger5226/filetransfer/metadata"
+	"github.com/tiger5226/filetransfer/storage"
 	"github.com/tiger5226/filetransfer/util"
+	"github.com/tiger5226/filetransfer/versions"
 
 	"github.com/lbryio/lbry.go/extras/errors"
 	"github.com/sirupsen/logrus"
 )
 
-// Download Handles a server request to download content from one of the project buckets
+// metaHeader prefixes the response headers carrying the metadata of a file
+const metaHeader = "X-Meta-"
+
+// Download Handles a server request to download content from one of the project buckets. Range, If-Range,
+// If-None-Match and If-Modified-Since are honoured so clients can resume downloads and revalidate their caches.
+// The metadata of the file is sent as X-Meta-<name> headers, and a content-type entry sets the Content-Type.
+// Previous versions of a file are downloaded by passing their id as version.
 func Download(response http.ResponseWriter, request *http.Request) {
 	//First of check if Get is set in the URL
-	Filename := "data/" + request.URL.Query().Get("file")
-	if Filename == "" {
+	file := request.URL.Query().Get("file")
+	if file == "" {
 		logrus.Error("Get 'file' not specified in url.")
 		//Get not set, send a 400 bad request
 		http.Error(response, "Get 'file' not specified in url.", 400)
 		return
 	}
-	fmt.Println("Client requests: " + Filename)
-
-	//Check if file exists and open
-	Openfile, err := os.Open(Filename)
-	defer util.CloseOSFile(Openfile) //Close after function return
+	file, err := storage.CleanKey(file)
 	if err != nil {
 		logrus.Error(err)
-		//File not found, send 404
-		http.Error(response, "File not found.", 404)
+		http.Error(response, errors.Unwrap(err).Error(), http.StatusBadRequest)
 		return
 	}
+	fmt.Println("Client requests: " + file)
 
-	//File is found, create and send the correct headers
-
-	//Get the Content-Type of the file
-	//Create a buffer to store the header of the file in
-	FileHeader := make([]byte, 512)
-	//Copy the headers into the FileHeader buffer
-	_, err = Openfile.Read(FileHeader)
-	if err != nil {
-		http.Error(response, errors.FullTrace(err), http.StatusInternalServerError)
+	if !acl.Check(request, storage.BucketOf(file), acl.Read) {
+		logrus.Error("Read access to '", file, "' denied")
+		http.Error(response, "Permission denied.", http.StatusForbidden)
 		return
 	}
 
-	//Get content type of file
-	FileContentType := http.DetectContentType(FileHeader)
-
-	//Get the file size
-	FileStat, _ := Openfile.Stat()                     //Get info from file
-	FileSize := strconv.FormatInt(FileStat.Size(), 10) //Get file size as a string
+	//Check if file exists and open, or the requested version of it
+	var Openfile storage.Object
+	var FileStat *storage.ObjectInfo
+	if version := request.URL.Query().Get("version"); version != "" && versions.Default == nil {
+		err = errors.Err(versions.ErrNotFound)
+	} else if version != "" {
+		Openfile, FileStat, err = versions.Default.Get(storage.Default, file, version)
+	} else {
+		Openfile, FileStat, err = storage.Default.Get(file)
+	}
+	if storage.IsInvalidPath(err) {
+		logrus.Error(err)
+		http.Error(response, errors.Unwrap(err).Error(), http.StatusBadRequest)
+		return
+	} else if errors.Is(err, storage.ErrNotFound) || errors.Is(err, versions.ErrNotFound) {
+		logrus.Error(err)
+		//File not found, send 404
+		http.Error(response, "File not found.", 404)
+		return
+	} else if err != nil {
+		logrus.Error(err)
+		http.Error(response, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer util.CloseObject(Openfile) //Close after function return
 
 	//Send the headers
 	shortName := FileStat.Name()
 	fmt.Println("Sending client: " + shortName)
 	response.Header().Set("Content-Disposition", "attachment; filename="+shortName)
-	response.Header().Set("Content-Type", FileContentType)
-	response.Header().Set("Content-Length", FileSize)
+	response.Header().Set("Accept-Ranges", "bytes")
+	response.Header().Set("ETag", FileStat.ETag)
+	if sum, err := hex.DecodeString(FileStat.Checksum); err == nil && len(sum) > 0 {
+		//Lets clients verify the integrity of what they received (RFC 3230)
+		response.Header().Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum))
+	}
 
-	//Send the file
-	//We read 512 bytes from the file already so we reset the offset back to 0
-	_, err = Openfile.Seek(0, 0)
+	meta, err := fileMetadata(file)
 	if err != nil {
-		http.Error(response, errors.FullTrace(err), http.StatusInternalServerError)
-		return
+		//The file itself is still fine to send
+		logrus.Error(err)
 	}
-	_, err = io.Copy(response, Openfile) //'Copy' the file to the client
-	if err != nil {
-		http.Error(response, errors.FullTrace(err), http.StatusInternalServerError)
-		return
+	for name, value := range meta {
+		response.Header().Set(metaHeader+name, value)
+	}
+	if contentType, ok := meta["content-type"]; ok {
+		response.Header().Set("Content-Type", contentType)
+	}
+
+	audit(request, "download", file, FileStat.Size)
+	//ServeContent takes care of the content type, Last-Modified, conditional requests and (multi-)range responses
+	http.ServeContent(response, request, shortName, FileStat.ModifiedAt, Openfile)
+}
+
+// fileMetadata returns the metadata attached to a file, if any
+func fileMetadata(key string) (metadata.Metadata, error) {
+	if metadata.Default == nil {
+		return nil, nil
 	}
+	return metadata.Default.Get(key)
 }
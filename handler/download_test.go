@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tiger5226/filetransfer/storage"
+)
+
+func useTestStorage(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "ft-handler-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := storage.NewLocal(dir)
+	local.UID, local.GID = os.Getuid(), os.Getgid()
+	previous := storage.Default
+	storage.Default = local
+	return func() {
+		storage.Default = previous
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestDownloadRejectsTraversal(t *testing.T) {
+	defer useTestStorage(t)()
+
+	queries := []string{
+		"file=../main.go",
+		"file=bucket/../../etc/passwd",
+		"file=..%2f..%2fetc%2fpasswd",
+		"file=%2e%2e/%2e%2e/etc/passwd",
+		"file=bucket/.uploads/x",
+		"file=.blobs/d7/d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592",
+		"file=..\\..\\secret",
+	}
+
+	for _, query := range queries {
+		request := httptest.NewRequest(http.MethodGet, "/download?"+query, nil)
+		response := httptest.NewRecorder()
+		Download(response, request)
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("Download(%s) returned %d, expected 400", query, response.Code)
+		}
+	}
+}
+
+func TestDownloadSendsDigest(t *testing.T) {
+	defer useTestStorage(t)()
+
+	if _, err := storage.Default.Put("deps/lib.tar", strings.NewReader("The quick brown fox jumps over the lazy dog")); err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/download?file=deps/lib.tar", nil)
+	response := httptest.NewRecorder()
+	Download(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Download returned %d", response.Code)
+	}
+	if digest := response.Header().Get("Digest"); digest != "SHA-256=16j7swfXgJRpypq8sAguT41WUeRtPNt2LQLQvzfJ5ZI=" {
+		t.Errorf("unexpected Digest %q", digest)
+	}
+}
+
+func TestDownloadRangesAndConditions(t *testing.T) {
+	defer useTestStorage(t)()
+
+	if _, err := storage.Default.Put("deps/lib.tar", strings.NewReader("The quick brown fox jumps over the lazy dog")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := storage.Default.Stat("deps/lib.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := info.ModifiedAt.UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+		body    string
+	}{
+		{"range", map[string]string{"Range": "bytes=4-8"}, http.StatusPartialContent, "quick"},
+		{"suffix range", map[string]string{"Range": "bytes=-3"}, http.StatusPartialContent, "dog"},
+		{"unsatisfiable range", map[string]string{"Range": "bytes=100-"}, http.StatusRequestedRangeNotSatisfiable, ""},
+		{"if-range matches", map[string]string{"Range": "bytes=0-2", "If-Range": info.ETag}, http.StatusPartialContent, "The"},
+		{"if-range changed", map[string]string{"Range": "bytes=0-2", "If-Range": `"other"`}, http.StatusOK, "The quick brown fox jumps over the lazy dog"},
+		{"if-none-match", map[string]string{"If-None-Match": info.ETag}, http.StatusNotModified, ""},
+		{"if-none-match changed", map[string]string{"If-None-Match": `"other"`}, http.StatusOK, "The quick brown fox jumps over the lazy dog"},
+		{"if-modified-since", map[string]string{"If-Modified-Since": modified}, http.StatusNotModified, ""},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/download?file=deps/lib.tar", nil)
+		for name, value := range test.headers {
+			request.Header.Set(name, value)
+		}
+		response := httptest.NewRecorder()
+		Download(response, request)
+		if response.Code != test.status {
+			t.Errorf("%s: Download returned %d, expected %d", test.name, response.Code, test.status)
+			continue
+		}
+		if test.body != "" && response.Body.String() != test.body {
+			t.Errorf("%s: Download sent %q, expected %q", test.name, response.Body.String(), test.body)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package handler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/tiger5226/filetransfer/acl"
+	"github.com/tiger5226/filetransfer/metadata"
+	"github.com/tiger5226/filetransfer/quota"
+	"github.com/tiger5226/filetransfer/storage"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+// MaxExtractSize is the largest total size, in bytes, an uploaded archive may unpack to. Zero disables the limit.
+var MaxExtractSize int64 = 50 << 30
+
+// MaxExtractEntries is the largest number of entries an uploaded archive may contain. Zero disables the limit.
+var MaxExtractEntries = 100000
+
+// ErrExtractLimit is returned when an archive exceeds MaxExtractSize or MaxExtractEntries
+var ErrExtractLimit = errors.Base("the archive exceeds the extraction limits")
+
+// ErrInvalidArchive is returned when an upload to extract cannot be read as the archive it claims to be
+var ErrInvalidArchive = errors.Base("invalid archive")
+
+// ErrUnsupportedArchive is returned when an upload to extract is neither a zip nor a tar.gz archive
+var ErrUnsupportedArchive = errors.Base("only zip and tar.gz archives can be extracted")
+
+// extractManifest lists what an uploaded archive was unpacked to
+type extractManifest struct {
+	Archive string
+	Size    int64
+	SHA256  string
+	MD5     string
+	Files   []*uploadResult
+	Skipped []skippedEntry
+}
+
+// skippedEntry is an archive entry that was not extracted, such as a link or device
+type skippedEntry struct {
+	Name   string
+	Reason string
+}
+
+// archiveEntry is a single entry of an uploaded archive. open is only valid while the entry is being visited.
+type archiveEntry struct {
+	name     string
+	size     int64
+	modified time.Time
+	dir      bool
+	regular  bool
+	open     func() (io.ReadCloser, error)
+}
+
+// extractFile unpacks an uploaded zip or tar.gz archive into the bucket. The archive is spooled to a temporary file
+// and checked completely before anything is written: the caller needs write access to every bucket written to, the
+// limits and storage quotas must hold and no entry may fail onConflict or the preconditions, which includes an entry
+// meeting an earlier one of the same name. Only regular files are extracted, with the permissions and owner the
+// storage gives every file, and all share the metadata given for the archive. Links and other special entries are
+// skipped, as are hidden entries, entries leading outside of the bucket and entries kept back by onConflict=keep-newer.
+func extractFile(request *http.Request, f uploadedFile, bucket string, expected digests, meta metadata.Metadata, conflict conflictOptions) (*extractManifest, error) {
+	bucket, err := storage.CleanBucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := storage.TempFile("ft-extract-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	v := newVerifier(f.body, expected)
+	size, err := io.Copy(tmp, v)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	computed := v.Sum()
+
+	walk, err := archiveWalker(tmp, size)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &extractManifest{
+		Archive: f.name,
+		Size:    size,
+		SHA256:  hex.EncodeToString(computed.SHA256),
+		MD5:     hex.EncodeToString(computed.MD5),
+		Files:   make([]*uploadResult, 0),
+		Skipped: make([]skippedEntry, 0),
+	}
+
+	// First pass: validate everything without writing a single file
+	var entries int
+	var total int64
+	writable := map[string]bool{}
+	seen := map[string]bool{}
+	err = walk(func(e archiveEntry) error {
+		entries++
+		if MaxExtractEntries > 0 && entries > MaxExtractEntries {
+			return errors.Err(ErrExtractLimit)
+		}
+		if e.dir {
+			return nil
+		}
+		key, reason := entryKey(bucket, e.name)
+		if reason != "" {
+			manifest.Skipped = append(manifest.Skipped, skippedEntry{e.name, reason})
+			return nil
+		}
+		if !e.regular {
+			manifest.Skipped = append(manifest.Skipped, skippedEntry{key, "not a regular file"})
+			return nil
+		}
+		total += e.size
+		if e.size < 0 || MaxExtractSize > 0 && total > MaxExtractSize {
+			return errors.Err(ErrExtractLimit)
+		}
+		if _, ok := writable[storage.BucketOf(key)]; !ok {
+			writable[storage.BucketOf(key)] = acl.Check(request, storage.BucketOf(key), acl.Write)
+		}
+		if !writable[storage.BucketOf(key)] {
+			return errors.Err(acl.ErrForbidden)
+		}
+		// A second entry of the same name meets the first one once that is extracted
+		if seen[key] {
+			if conflict.Policy == conflictFail {
+				return errors.Prefix("'"+key+"' is in the archive twice", ErrConflict)
+			} else if conflict.IfMatch != "" || conflict.IfNoneMatch != "" {
+				return errors.Prefix("'"+key+"' is in the archive twice", ErrPreconditionFailed)
+			}
+		}
+		seen[key] = true
+		conflict.Modified = e.modified
+		_, err = resolveConflict(key, conflict)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	remaining, err := quotaRemaining(request, bucket, 0)
+	if err != nil {
+		return nil, err
+	}
+	if remaining != quota.Unlimited && total > remaining {
+		return nil, errors.Err(quota.ErrTooLarge)
+	}
+
+	// Second pass: store the files. The declared sizes were checked above and both formats refuse to return more
+	// data than declared.
+	err = walk(func(e archiveEntry) error {
+		key, reason := entryKey(bucket, e.name)
+		if e.dir || !e.regular || reason != "" {
+			return nil
+		}
+		contents, err := e.open()
+		if err != nil {
+			return errors.Err(err)
+		}
+		defer func() { _ = contents.Close() }()
+
+		unlock := lockKey(key)
+		defer unlock()
+		conflict.Modified = e.modified
+		target, err := resolveConflict(key, conflict)
+		if err != nil {
+			return err
+		} else if target == "" {
+			manifest.Skipped = append(manifest.Skipped, skippedEntry{key, "the existing file is newer"})
+			return nil
+		}
+		key = target
+
+		v := newVerifier(io.LimitReader(contents, e.size), digests{})
+		n, err := putFile(key, v)
+		if err != nil {
+			return errors.Err(err)
+		}
+		err = storeMetadata(key, meta)
+		if err != nil {
+			return err
+		}
+		sum := v.Sum()
+		manifest.Files = append(manifest.Files, &uploadResult{
+			Name:   e.name,
+			Status: http.StatusOK,
+			File:   key,
+			Size:   n,
+			SHA256: hex.EncodeToString(sum.SHA256),
+			MD5:    hex.EncodeToString(sum.MD5),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for b := range writable {
+		err = claimBucket(request, b)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// entryKey returns the key an archive entry is extracted to, after cleaning its name so ./a.txt becomes a.txt and
+// /a.txt is extracted into the bucket as well. For entries that cannot be extracted, such as hidden files or names
+// leading outside of the bucket, it returns the reason instead.
+func entryKey(bucket, name string) (string, string) {
+	cleaned := path.Clean(strings.TrimLeft(name, "/"))
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", "the path leaves the bucket"
+	}
+	key, err := storage.JoinKey(bucket, cleaned)
+	if pathErr, ok := errors.Unwrap(err).(storage.PathError); ok {
+		return "", pathErr.Reason
+	} else if err != nil {
+		return "", err.Error()
+	}
+	return key, ""
+}
+
+// archiveWalker detects the archive format from its first bytes and returns a function visiting every entry
+func archiveWalker(file *os.File, size int64) (func(func(archiveEntry) error) error, error) {
+	magic := make([]byte, 4)
+	_, err := file.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return nil, errors.Err(err)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		archive, err := zip.NewReader(file, size)
+		if err != nil {
+			return nil, invalidArchive(err)
+		}
+		return func(visit func(archiveEntry) error) error {
+			for _, f := range archive.File {
+				mode := f.Mode()
+				err := visit(archiveEntry{
+					name:     f.Name,
+					size:     int64(f.UncompressedSize64),
+					modified: f.Modified,
+					dir:      mode.IsDir() || strings.HasSuffix(f.Name, "/"),
+					regular:  mode.IsRegular(),
+					open:     f.Open,
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}, nil
+
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return func(visit func(archiveEntry) error) error {
+			_, err := file.Seek(0, io.SeekStart)
+			if err != nil {
+				return errors.Err(err)
+			}
+			compressed, err := gzip.NewReader(bufio.NewReader(file))
+			if err != nil {
+				return invalidArchive(err)
+			}
+			archive := tar.NewReader(compressed)
+			for {
+				header, err := archive.Next()
+				if err == io.EOF {
+					return nil
+				} else if err != nil {
+					return invalidArchive(err)
+				}
+				err = visit(archiveEntry{
+					name:     header.Name,
+					size:     header.Size,
+					modified: header.ModTime,
+					dir:      header.Typeflag == tar.TypeDir,
+					regular:  header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA,
+					open:     func() (io.ReadCloser, error) { return ioutil.NopCloser(archive), nil },
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}, nil
+	}
+
+	return nil, errors.Err(ErrUnsupportedArchive)
+}
+
+// invalidArchive keeps the reason an archive could not be read while still matching ErrInvalidArchive
+func invalidArchive(err error) error {
+	return errors.Prefix(err.Error()+": ", ErrInvalidArchive)
+}
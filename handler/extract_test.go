@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tiger5226/filetransfer/storage"
+)
+
+func TestUploadExtract(t *testing.T) {
+	defer useTestStorage(t)()
+
+	zipOf := func(names ...string) []byte {
+		buf := &bytes.Buffer{}
+		w := zip.NewWriter(buf)
+		for _, name := range names {
+			header := &zip.FileHeader{Name: name}
+			if name == "link" {
+				header.SetMode(os.ModeSymlink | 0777)
+			}
+			f, _ := w.CreateHeader(header)
+			_, _ = f.Write([]byte("contents of " + name))
+		}
+		_ = w.Close()
+		return buf.Bytes()
+	}
+	tarGzOf := func(names ...string) []byte {
+		buf := &bytes.Buffer{}
+		gz := gzip.NewWriter(buf)
+		w := tar.NewWriter(gz)
+		for _, name := range names {
+			contents := "contents of " + name
+			_ = w.WriteHeader(&tar.Header{Name: name, Mode: 04777, Size: int64(len(contents)), Typeflag: tar.TypeReg})
+			_, _ = w.Write([]byte(contents))
+		}
+		_ = w.Close()
+		_ = gz.Close()
+		return buf.Bytes()
+	}
+	upload := func(bucket, fileName string, data []byte, fields ...string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		_ = writer.WriteField("extract", "true")
+		for i := 0; i+1 < len(fields); i += 2 {
+			_ = writer.WriteField(fields[i], fields[i+1])
+		}
+		part, _ := writer.CreateFormFile("file", fileName)
+		_, _ = part.Write(data)
+		_ = writer.Close()
+
+		request := httptest.NewRequest(http.MethodPost, "/upload?bucket="+bucket, body)
+		request.Header.Set("Content-Type", writer.FormDataContentType())
+		response := httptest.NewRecorder()
+		Upload(response, request)
+		return response
+	}
+	stored := func(prefix string) string {
+		infos, _ := storage.Default.List(prefix)
+		var keys []string
+		for _, info := range infos {
+			if !info.IsDir {
+				keys = append(keys, info.Key)
+			}
+		}
+		return strings.Join(keys, ",")
+	}
+
+	response := upload("zipped", "out.zip", zipOf("bin/app", "docs/", "docs/readme.txt", "link"))
+	if response.Code != http.StatusOK {
+		t.Fatalf("zip extraction returned %d: %s", response.Code, response.Body.String())
+	}
+	if stored("zipped") != "zipped/bin/app,zipped/docs/readme.txt" {
+		t.Errorf("zip extraction stored %s", stored("zipped"))
+	}
+	if !strings.Contains(response.Body.String(), `"File":"zipped/bin/app"`) || !strings.Contains(response.Body.String(), `"Name":"zipped/link"`) {
+		t.Errorf("unexpected manifest %s", response.Body.String())
+	}
+
+	response = upload("tarred", "out.tar.gz", tarGzOf("a/b/c.txt", "/abs.txt"))
+	if response.Code != http.StatusOK || stored("tarred") != "tarred/a/b/c.txt,tarred/abs.txt" {
+		t.Errorf("tar.gz extraction returned %d and stored %s", response.Code, stored("tarred"))
+	}
+	obj, _, err := storage.Default.Get("tarred/a/b/c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(obj)
+	_ = obj.Close()
+	if string(data) != "contents of a/b/c.txt" {
+		t.Errorf("extracted file contains %q", data)
+	}
+
+	// Names are cleaned, and entries that cannot be stored are skipped without failing the rest of the archive
+	response = upload("cleaned", "out.zip", zipOf("./a.txt", "b/./c.txt", "./.env"))
+	if response.Code != http.StatusOK || stored("cleaned") != "cleaned/a.txt,cleaned/b/c.txt" {
+		t.Errorf("extraction returned %d and stored %s", response.Code, stored("cleaned"))
+	}
+	if !strings.Contains(response.Body.String(), `"Name":"./.env"`) {
+		t.Errorf("the hidden entry is missing from the skipped entries: %s", response.Body.String())
+	}
+	for name, archive := range map[string][]byte{
+		"zip slip":    zipOf("fine.txt", "../../evil.txt"),
+		"tar slip":    tarGzOf("fine.txt", "a/../../evil.txt"),
+		"hidden":      zipOf("fine.txt", ".uploads/x"),
+		"backslashes": zipOf("fine.txt", "..\\evil.txt"),
+	} {
+		response := upload("skipped", name, archive)
+		if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"Skipped":[{"Name"`) {
+			t.Errorf("%s: returned %d: %s", name, response.Code, response.Body.String())
+		}
+	}
+	if stored("") != strings.Join([]string{
+		"cleaned/a.txt", "cleaned/b/c.txt", "skipped/fine.txt",
+		"tarred/a/b/c.txt", "tarred/abs.txt", "zipped/bin/app", "zipped/docs/readme.txt"}, ",") {
+		t.Errorf("unsafe entries were stored: %s", stored(""))
+	}
+
+	// Nothing may be written when the archive is rejected
+	for name, archive := range map[string][]byte{
+		"not archived": []byte("plain text"),
+		"broken zip":   []byte("PK\x03\x04broken"),
+	} {
+		if response := upload("rejected", name, archive); response.Code < 400 {
+			t.Errorf("%s: returned %d", name, response.Code)
+		}
+	}
+	if stored("rejected") != "" {
+		t.Errorf("rejected archives stored %s", stored("rejected"))
+	}
+	// Two entries cleaned to the same name conflict with each other before either is written
+	if response := upload("rejected", "twice.zip", zipOf("a.txt", "x.txt", "./a.txt"), "onConflict", "fail"); response.Code != http.StatusConflict {
+		t.Errorf("an archive with a duplicate entry returned %d", response.Code)
+	}
+	if stored("rejected") != "" {
+		t.Errorf("an archive with a duplicate entry stored %s", stored("rejected"))
+	}
+	if response := upload("renamed", "twice.zip", zipOf("a.txt", "./a.txt"), "onConflict", "rename"); response.Code != http.StatusOK || stored("renamed") != "renamed/a-1.txt,renamed/a.txt" {
+		t.Errorf("renaming a duplicate entry returned %d and stored %s", response.Code, stored("renamed"))
+	}
+	if response := upload("rejected", "x", []byte("plain text")); response.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("a plain file returned %d", response.Code)
+	}
+
+	previousEntries, previousSize := MaxExtractEntries, MaxExtractSize
+	defer func() { MaxExtractEntries, MaxExtractSize = previousEntries, previousSize }()
+	MaxExtractEntries = 2
+	if response := upload("limited", "x.zip", zipOf("1", "2", "3")); response.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("too many entries returned %d", response.Code)
+	}
+	MaxExtractEntries, MaxExtractSize = 0, 20
+	if response := upload("limited", "x.zip", zipOf("1", "2")); response.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("too large an archive returned %d", response.Code)
+	}
+	if stored("limited") != "" {
+		t.Errorf("archives over the limits stored %s", stored("limited"))
+	}
+}
@@ -0,0 +1,594 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tiger5226/filetransfer/acl"
+	"github.com/tiger5226/filetransfer/quota"
+	"github.com/tiger5226/filetransfer/storage"
+	"github.com/tiger5226/filetransfer/util"
+
+	"github.com/lbryio/lbry.go/extras/api"
+	"github.com/lbryio/lbry.go/extras/errors"
+	v "github.com/lbryio/ozzo-validation"
+	"github.com/lbryio/ozzo-validation/is"
+	"github.com/sirupsen/logrus"
+)
+
+// sessionDirName is the hidden directory inside a bucket where in-flight chunked uploads are kept
+const sessionDirName = ".uploads"
+
+// sessionFileName holds the metadata for a chunked upload session
+const sessionFileName = "session.json"
+
+// chunkExtension is appended to the index of each chunk stored for a session
+const chunkExtension = ".part"
+
+// DataDir is the local directory under which the chunks of upload sessions are staged. They are kept on local disk
+// with every storage backend and only written to the storage once the upload is finalized.
+var DataDir = "data"
+
+// ErrPastSessionSize is returned for a chunk that would make the upload larger than the size declared for its session
+var ErrPastSessionSize = errors.Base("the chunk goes past the declared size of the upload")
+
+// SessionTTL is how long an upload session is kept after a chunk last arrived. Zero keeps sessions until they are
+// finalized.
+var SessionTTL = 24 * time.Hour
+
+type uploadSession struct {
+	ID        string
+	Bucket    string
+	Filename  string
+	Size      int64
+	CreatedAt time.Time
+}
+
+type uploadSessionStatus struct {
+	*uploadSession
+	Chunks   []int
+	Offset   int64
+	Received int64
+}
+
+type sessionParams struct {
+	Bucket  string
+	Session string
+}
+
+// CreateUploadSession starts a resumable upload of a single file into a bucket. The returned session id is
+// used to PUT numbered chunks to /upload/chunk and to finalize the upload once all chunks have arrived.
+func CreateUploadSession(r *http.Request) api.Response {
+	params := struct {
+		Bucket   string
+		Filename string
+		Size     int64
+	}{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.Bucket, is.PrintableASCII),
+		v.Field(&params.Filename, v.Required, is.PrintableASCII),
+		v.Field(&params.Size, v.Min(0)),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	// The filename may carry its own directories, just like a regular upload
+	key, err := storage.JoinKey(params.Bucket, params.Filename)
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+	pathElements := strings.Split(key, "/")
+	if !acl.Check(r, storage.BucketOf(key), acl.Write) {
+		return api.Response{Error: errors.Err(acl.ErrForbidden), Status: http.StatusForbidden}
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		return api.Response{Error: errors.Err(err)}
+	}
+
+	session := &uploadSession{
+		ID:        id,
+		Bucket:    strings.Join(pathElements[:len(pathElements)-1], "/"),
+		Filename:  pathElements[len(pathElements)-1],
+		Size:      params.Size,
+		CreatedAt: time.Now(),
+	}
+
+	sessionDir, err := sessionPath(session.Bucket, session.ID)
+	if err != nil {
+		return api.Response{Error: errors.Err(err)}
+	}
+	err = os.MkdirAll(sessionDir, 0755)
+	if err != nil {
+		return api.Response{Error: errors.Err(err)}
+	}
+
+	contents, err := json.Marshal(session)
+	if err != nil {
+		return api.Response{Error: errors.Err(err)}
+	}
+	err = ioutil.WriteFile(filepath.Join(sessionDir, sessionFileName), contents, 0644)
+	if err != nil {
+		return api.Response{Error: errors.Err(err)}
+	}
+
+	logrus.Debug("Created upload session ", session.ID, " for ", session.Bucket, "/", session.Filename)
+	return api.Response{Data: session}
+}
+
+// UploadChunk stores the body of the request as the numbered chunk of an upload session. Re-sending a chunk
+// replaces the previous copy, so clients can simply retry whatever did not make it through.
+func UploadChunk(r *http.Request) api.Response {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		return api.Response{Status: http.StatusMethodNotAllowed, Error: errors.Err("chunks must be sent with PUT")}
+	}
+
+	params := struct {
+		Bucket  string
+		Session string
+		Index   int
+	}{}
+
+	// The body is the chunk itself, so parameters may only come from the query string
+	r.Form = r.URL.Query()
+	r.PostForm = url.Values{}
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.Bucket, is.PrintableASCII),
+		v.Field(&params.Session, v.Required, is.Hexadecimal),
+		v.Field(&params.Index, v.Min(0)),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	session, sessionDir, err := loadSession(params.Bucket, params.Session)
+	if storage.IsInvalidPath(err) {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	} else if err != nil {
+		return api.Response{Error: err, Status: http.StatusNotFound}
+	}
+	if !acl.Check(r, session.Bucket, acl.Write) {
+		return api.Response{Error: errors.Err(acl.ErrForbidden), Status: http.StatusForbidden}
+	}
+
+	body, allowed, err := chunkBody(r, session, sessionDir, params.Index)
+	if err != nil {
+		return api.Response{Error: err, Status: uploadStatus(err)}
+	}
+
+	// Write to the staging directory first so an interrupted request never leaves a partial chunk behind
+	chunkPath := filepath.Join(sessionDir, strconv.Itoa(params.Index)+chunkExtension)
+	chunk, err := storage.TempFile("ft-chunk-")
+	if err != nil {
+		return api.Response{Error: err}
+	}
+	tmpPath := chunk.Name()
+	written, err := io.Copy(chunk, body)
+	if err == nil && allowed >= 0 && written > allowed {
+		err = errors.Err(ErrPastSessionSize)
+	}
+	if err != nil {
+		util.CloseOSFile(chunk)
+		_ = os.Remove(tmpPath)
+		logrus.Error("Error while reading chunk from client: ", err)
+		status := uploadStatus(err)
+		if status == http.StatusInternalServerError {
+			status = http.StatusBadRequest
+		}
+		return api.Response{Error: errors.Err(err), Status: status}
+	}
+	err = chunk.Sync()
+	if err != nil {
+		util.CloseOSFile(chunk)
+		_ = os.Remove(tmpPath)
+		return api.Response{Error: errors.Err(err)}
+	}
+	err = chunk.Close()
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return api.Response{Error: errors.Err(err)}
+	}
+	err = os.Rename(tmpPath, chunkPath)
+	if err != nil {
+		return api.Response{Error: errors.Err(err)}
+	}
+
+	logrus.Debug("Session ", session.ID, ": stored chunk ", params.Index, " (", written, " bytes)")
+	return sessionStatus(session, sessionDir)
+}
+
+// UploadSessionStatus reports which chunks the server already holds and the contiguous offset a client can
+// resume from.
+func UploadSessionStatus(r *http.Request) api.Response {
+	params := sessionParams{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.Bucket, is.PrintableASCII),
+		v.Field(&params.Session, v.Required, is.Hexadecimal),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	session, sessionDir, err := loadSession(params.Bucket, params.Session)
+	if storage.IsInvalidPath(err) {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	} else if err != nil {
+		return api.Response{Error: err, Status: http.StatusNotFound}
+	}
+	if !acl.Check(r, session.Bucket, acl.Write) {
+		return api.Response{Error: errors.Err(acl.ErrForbidden), Status: http.StatusForbidden}
+	}
+
+	return sessionStatus(session, sessionDir)
+}
+
+// FinalizeUploadSession assembles the chunks of a session, in order, into the destination file in storage. The
+// storage only exposes the file once it is complete, so readers never see a partial file.
+func FinalizeUploadSession(r *http.Request) api.Response {
+	params := sessionParams{}
+
+	err := api.FormValues(r, &params, []*v.FieldRules{
+		v.Field(&params.Bucket, is.PrintableASCII),
+		v.Field(&params.Session, v.Required, is.Hexadecimal),
+	})
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+
+	// Finalizing the same session twice at once would store the file twice
+	sessionDir, err := sessionPath(params.Bucket, params.Session)
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+	unlockSession := lockKey(sessionDir)
+	defer unlockSession()
+
+	session, sessionDir, err := loadSession(params.Bucket, params.Session)
+	if storage.IsInvalidPath(err) {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	} else if err != nil {
+		return api.Response{Error: err, Status: http.StatusNotFound}
+	}
+	if !acl.Check(r, session.Bucket, acl.Write) {
+		return api.Response{Error: errors.Err(acl.ErrForbidden), Status: http.StatusForbidden}
+	}
+
+	chunks, sizes, err := listChunks(sessionDir)
+	if err != nil {
+		return api.Response{Error: errors.Err(err)}
+	}
+	if len(chunks) == 0 {
+		return api.Response{Error: errors.Err("no chunks have been uploaded"), Status: http.StatusConflict}
+	}
+	var expected int64
+	for i, index := range chunks {
+		if i != index {
+			return api.Response{Error: errors.Err("chunk %d is missing", i), Status: http.StatusConflict}
+		}
+		expected += sizes[i]
+	}
+	if session.Size > 0 && expected != session.Size {
+		return api.Response{Error: errors.Err("received %d bytes but expected %d", expected, session.Size), Status: http.StatusConflict}
+	}
+
+	key, err := storage.JoinKey(session.Bucket, session.Filename)
+	if err != nil {
+		return api.Response{Error: err, Status: http.StatusBadRequest}
+	}
+	var replaced int64
+	if info, err := storage.Default.Stat(key); err == nil && !info.IsDir {
+		replaced = info.Size
+	}
+	remaining, err := quotaRemaining(r, session.Bucket, replaced)
+	if errors.Is(err, quota.ErrExceeded) {
+		return api.Response{Error: err, Status: http.StatusInsufficientStorage}
+	} else if err != nil {
+		return api.Response{Error: errors.Err(err)}
+	}
+	if remaining != quota.Unlimited && expected > remaining {
+		return api.Response{Error: errors.Err(quota.ErrTooLarge), Status: http.StatusRequestEntityTooLarge}
+	}
+
+	unlock := lockKey(key)
+	reader := &chunkReader{sessionDir: sessionDir, chunks: chunks}
+	size, err := putFile(key, reader)
+	util.CloseObject(reader)
+	if err == nil {
+		// The assembled file replaces any earlier one along with its metadata
+		err = storeMetadata(key, nil)
+	}
+	unlock()
+	if err != nil {
+		return api.Response{Error: errors.Err(err)}
+	}
+
+	err = os.RemoveAll(sessionDir)
+	if err != nil {
+		logrus.Error("Unable to clean up upload session ", session.ID, ": ", err)
+	}
+
+	err = claimBucket(r, session.Bucket)
+	if err != nil {
+		return api.Response{Error: errors.Err(err)}
+	}
+
+	logrus.Debug("Session ", session.ID, ": assembled ", size, " bytes into ", key)
+	audit(r, "upload", key, size)
+	return api.Response{Data: struct {
+		Bucket   string
+		Filename string
+		Size     int64
+	}{session.Bucket, session.Filename, size}}
+}
+
+// chunkBody limits the body of a chunk to MaxUploadSize, to what the declared size of the session leaves for it and
+// to the quota of the bucket, so a session cannot be used to fill the disk. Chunks going past the declared size are
+// detected once more than the returned number of bytes was read; without a declared size it is -1.
+func chunkBody(r *http.Request, session *uploadSession, sessionDir string, index int) (io.Reader, int64, error) {
+	if MaxUploadSize > 0 {
+		if r.ContentLength > MaxUploadSize {
+			return nil, 0, errors.Err(ErrBodyTooLarge)
+		}
+		r.Body = &bodyLimiter{ReadCloser: r.Body, remaining: MaxUploadSize}
+	}
+
+	// The chunks already received count, except an earlier copy of the chunk that is being replaced
+	chunks, sizes, err := listChunks(sessionDir)
+	if err != nil {
+		return nil, 0, errors.Err(err)
+	}
+	var received int64
+	for i, n := range chunks {
+		if n != index {
+			received += sizes[i]
+		}
+	}
+
+	var body io.Reader = r.Body
+	allowed := int64(-1)
+	if session.Size > 0 {
+		allowed = session.Size - received
+		if allowed < 0 {
+			allowed = 0
+		}
+		body = io.LimitReader(body, allowed+1)
+	}
+
+	key, err := storage.JoinKey(session.Bucket, session.Filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	var replaced int64
+	if info, err := storage.Default.Stat(key); err == nil && !info.IsDir {
+		replaced = info.Size
+	}
+	remaining, err := quotaRemaining(r, session.Bucket, replaced)
+	if err != nil {
+		return nil, 0, err
+	}
+	if remaining != quota.Unlimited {
+		body = quota.NewReader(body, remaining-received)
+	}
+	return body, allowed, nil
+}
+
+// ReapSessions removes the upload sessions no chunk arrived for in longer than SessionTTL, along with their chunks,
+// and returns how many were removed. Adding a chunk updates the modification time of the session directory.
+func ReapSessions(now time.Time) (int, error) {
+	if SessionTTL <= 0 {
+		return 0, nil
+	}
+
+	var removed int
+	err := filepath.Walk(DataDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() || p == DataDir {
+			return nil
+		}
+		if info.Name() != sessionDirName {
+			if strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		sessions, err := ioutil.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, session := range sessions {
+			if !session.IsDir() || now.Sub(session.ModTime()) <= SessionTTL {
+				continue
+			}
+			dir := filepath.Join(p, session.Name())
+			unlock := lockKey(dir)
+			err = os.RemoveAll(dir)
+			unlock()
+			if err != nil {
+				return err
+			}
+			removed++
+		}
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return removed, errors.Err(err)
+	}
+	return removed, nil
+}
+
+// SessionJanitor removes expired upload sessions every interval until stop is closed
+func SessionJanitor(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			removed, err := ReapSessions(now)
+			if err != nil {
+				logrus.Error("Sessions: ", err)
+			}
+			if removed > 0 {
+				logrus.Infof("Sessions: removed %d expired upload sessions", removed)
+			}
+		}
+	}
+}
+
+// chunkReader reads the chunks of a session one after another, keeping only one chunk file open at a time
+type chunkReader struct {
+	sessionDir string
+	chunks     []int
+	current    *os.File
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if len(c.chunks) == 0 {
+				return 0, io.EOF
+			}
+			chunk, err := os.Open(filepath.Join(c.sessionDir, strconv.Itoa(c.chunks[0])+chunkExtension))
+			if err != nil {
+				return 0, err
+			}
+			c.current = chunk
+			c.chunks = c.chunks[1:]
+		}
+
+		n, err := c.current.Read(p)
+		if err == io.EOF {
+			err = c.current.Close()
+			c.current = nil
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.current == nil {
+		return nil
+	}
+	return c.current.Close()
+}
+
+// sessionStatus builds the status response for a session from the chunks currently on disk
+func sessionStatus(session *uploadSession, sessionDir string) api.Response {
+	chunks, sizes, err := listChunks(sessionDir)
+	if err != nil {
+		return api.Response{Error: errors.Err(err)}
+	}
+
+	status := uploadSessionStatus{uploadSession: session, Chunks: chunks}
+	contiguous := true
+	for i, index := range chunks {
+		status.Received += sizes[i]
+		if contiguous && i == index {
+			status.Offset += sizes[i]
+		} else {
+			contiguous = false
+		}
+	}
+
+	return api.Response{Data: status}
+}
+
+// listChunks returns the sorted indexes of the completed chunks of a session along with their sizes
+func listChunks(sessionDir string) ([]int, []int64, error) {
+	infos, err := ioutil.ReadDir(sessionDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sizes := make(map[int]int64)
+	chunks := make([]int, 0)
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, chunkExtension) {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimSuffix(name, chunkExtension))
+		if err != nil {
+			continue
+		}
+		chunks = append(chunks, index)
+		sizes[index] = info.Size()
+	}
+	sort.Ints(chunks)
+
+	orderedSizes := make([]int64, len(chunks))
+	for i, index := range chunks {
+		orderedSizes[i] = sizes[index]
+	}
+
+	return chunks, orderedSizes, nil
+}
+
+// loadSession reads the session metadata for an id within a bucket
+func loadSession(bucket, id string) (*uploadSession, string, error) {
+	sessionDir, err := sessionPath(bucket, id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(sessionDir, sessionFileName))
+	if err != nil {
+		return nil, "", errors.Err("upload session %s not found", id)
+	}
+
+	session := &uploadSession{}
+	err = json.Unmarshal(contents, session)
+	if err != nil {
+		return nil, "", errors.Err(err)
+	}
+
+	return session, sessionDir, nil
+}
+
+// sessionPath returns the directory used to hold the chunks of a session
+func sessionPath(bucket, id string) (string, error) {
+	bucket, err := storage.CleanBucket(bucket)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(DataDir, filepath.FromSlash(bucket), sessionDirName, id), nil
+}
+
+// newSessionID generates a random identifier for an upload session
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
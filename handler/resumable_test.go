@@ -0,0 +1,190 @@
+package handler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tiger5226/filetransfer/quota"
+	"github.com/tiger5226/filetransfer/storage"
+
+	"github.com/lbryio/lbry.go/extras/api"
+)
+
+// useTestSessions stages upload sessions in the root of the test storage
+func useTestSessions(t *testing.T) func() {
+	cleanup := useTestStorage(t)
+	previous := DataDir
+	DataDir = storage.Default.(*storage.Local).Root
+	return func() {
+		DataDir = previous
+		cleanup()
+	}
+}
+
+func createSession(t *testing.T, size int) string {
+	request := httptest.NewRequest(http.MethodPost, "/upload/session?bucket=team&filename=big.bin&size="+strconv.Itoa(size), nil)
+	response := CreateUploadSession(request)
+	if response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	return response.Data.(*uploadSession).ID
+}
+
+func sendChunk(id string, index int, contents string) api.Response {
+	target := "/upload/chunk?bucket=team&session=" + id + "&index=" + strconv.Itoa(index)
+	return UploadChunk(httptest.NewRequest(http.MethodPut, target, strings.NewReader(contents)))
+}
+
+func finalizeSession(id string) api.Response {
+	return FinalizeUploadSession(httptest.NewRequest(http.MethodPost, "/upload/finalize?bucket=team&session="+id, nil))
+}
+
+func TestUploadSessionOutOfOrder(t *testing.T) {
+	defer useTestSessions(t)()
+
+	id := createSession(t, 9)
+	for _, index := range []int{2, 0, 1} {
+		if response := sendChunk(id, index, strings.Repeat(strconv.Itoa(index), 3)); response.Error != nil {
+			t.Fatalf("chunk %d: %v", index, response.Error)
+		}
+	}
+	if response := finalizeSession(id); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+
+	object, _, err := storage.Default.Get("team/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := ioutil.ReadAll(object)
+	_ = object.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "000111222" {
+		t.Errorf("the chunks were assembled into %q", contents)
+	}
+
+	// The session is gone, so finalizing it again finds nothing
+	if response := finalizeSession(id); response.Status != http.StatusNotFound {
+		t.Errorf("a second finalize returned %d, expected 404", response.Status)
+	}
+}
+
+func TestUploadSessionMissingChunk(t *testing.T) {
+	defer useTestSessions(t)()
+
+	id := createSession(t, 0)
+	for _, index := range []int{0, 2} {
+		if response := sendChunk(id, index, "abc"); response.Error != nil {
+			t.Fatalf("chunk %d: %v", index, response.Error)
+		}
+	}
+	if response := finalizeSession(id); response.Status != http.StatusConflict {
+		t.Errorf("finalizing without chunk 1 returned %d, expected 409", response.Status)
+	}
+	if _, err := storage.Default.Stat("team/big.bin"); err == nil {
+		t.Error("an incomplete upload was stored")
+	}
+}
+
+func TestUploadSessionChunkLimits(t *testing.T) {
+	defer useTestSessions(t)()
+
+	id := createSession(t, 6)
+	if response := sendChunk(id, 0, "abcd"); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	if response := sendChunk(id, 1, "efg"); response.Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("a chunk past the declared size returned %d, expected 413", response.Status)
+	}
+	// Replacing a chunk only counts the new copy
+	if response := sendChunk(id, 0, "abcdef"); response.Error != nil {
+		t.Errorf("replacing a chunk within the declared size failed: %v", response.Error)
+	}
+
+	previous := MaxUploadSize
+	defer func() { MaxUploadSize = previous }()
+	MaxUploadSize = 4
+	other := createSession(t, 0)
+	if response := sendChunk(other, 0, "abcdefgh"); response.Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("a chunk beyond max_upload_size returned %d, expected 413", response.Status)
+	}
+	chunks, _, err := listChunks(filepath.Join(DataDir, "team", sessionDirName, other))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 0 {
+		t.Errorf("a rejected chunk was kept: %v", chunks)
+	}
+}
+
+func TestUploadSessionQuota(t *testing.T) {
+	defer useTestSessions(t)()
+
+	dir, err := ioutil.TempDir("", "ft-handler-quota-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	previous := quota.Default
+	defer func() { quota.Default = previous }()
+	quota.Default, err = quota.Open(filepath.Join(dir, "quota.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := createSession(t, 0)
+	for index := 0; index < 2; index++ {
+		if response := sendChunk(id, index, "12345"); response.Error != nil {
+			t.Fatal(response.Error)
+		}
+	}
+
+	// The quota shrank after the chunks arrived
+	quota.Default.DefaultBucket = 8
+	if response := finalizeSession(id); response.Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("finalizing beyond the quota returned %d, expected 413", response.Status)
+	}
+	if _, err := storage.Default.Stat("team/big.bin"); err == nil {
+		t.Error("an upload beyond the quota was stored")
+	}
+	if response := sendChunk(id, 2, "1"); response.Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("a chunk beyond the quota returned %d, expected 413", response.Status)
+	}
+}
+
+func TestReapSessions(t *testing.T) {
+	defer useTestSessions(t)()
+
+	stale := createSession(t, 0)
+	fresh := createSession(t, 0)
+	if response := sendChunk(fresh, 0, "abc"); response.Error != nil {
+		t.Fatal(response.Error)
+	}
+	old := time.Now().Add(-2 * SessionTTL)
+	if err := os.Chtimes(filepath.Join(DataDir, "team", sessionDirName, stale), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := ReapSessions(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("removed %d sessions, expected 1", removed)
+	}
+	if response := sendChunk(stale, 0, "abc"); response.Status != http.StatusNotFound {
+		t.Errorf("a chunk for an expired session returned %d, expected 404", response.Status)
+	}
+	if response := finalizeSession(fresh); response.Error != nil {
+		t.Errorf("a fresh session was reaped: %v", response.Error)
+	}
+}
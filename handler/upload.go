@@ -1,22 +1,50 @@
 package handler
 
 import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
 	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/tiger5226/filetransfer/acl"
+	"github.com/tiger5226/filetransfer/auth"
+	"github.com/tiger5226/filetransfer/metadata"
+	"github.com/tiger5226/filetransfer/quota"
+	"github.com/tiger5226/filetransfer/storage"
 	"github.com/tiger5226/filetransfer/util"
+	"github.com/tiger5226/filetransfer/versions"
 
+	"github.com/lbryio/lbry.go/extras/errors"
 	"github.com/sirupsen/logrus"
 )
 
-// Upload Handles a server request to upload content to one of the project buckets
+// MaxUploadSize is the largest request body, in bytes, that Upload will accept. Zero disables the limit.
+var MaxUploadSize int64 = 10 << 30
+
+// metaField prefixes the query parameters and form fields holding metadata, e.g. meta.build=42
+const metaField = "meta."
+
+// maxFieldSize bounds the size of the non-file form fields read into memory
+const maxFieldSize = 1 << 20
+
+// ErrBodyTooLarge is returned once an upload request grows beyond MaxUploadSize
+var ErrBodyTooLarge = errors.Base("request body too large")
+
+// Upload Handles a server request to upload content to one of the project buckets. Any number of file parts may be
+// streamed into storage in one request; the fields and headers it takes are described in the README.
 func Upload(response http.ResponseWriter, request *http.Request) {
 	hs := map[string]string{
 		"Access-Control-Allow-Methods": "POST",
-		"Access-Control-Allow-Origin":  "*"}
+		"Access-Control-Allow-Origin":  "*",
+		"Access-Control-Allow-Headers": "Authorization, Content-Type, Content-MD5, Digest, If-Match, If-None-Match"}
 
 	for k, v := range hs {
 		response.Header().Set(k, v)
@@ -26,85 +54,523 @@ func Upload(response http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	var err error
-	file, fileHeader, err := request.FormFile("file")
+	if MaxUploadSize > 0 {
+		if request.ContentLength > MaxUploadSize {
+			logrus.Error("Upload of ", request.ContentLength, " bytes exceeds the limit of ", MaxUploadSize)
+			http.Error(response, "Request body too large.", http.StatusRequestEntityTooLarge)
+			return
+		}
+		request.Body = &bodyLimiter{ReadCloser: request.Body, remaining: MaxUploadSize}
+	}
+
+	reader, err := request.MultipartReader()
 	if err != nil {
 		logrus.Error("Was not able to access the uploaded file: ", err)
 		http.Error(response, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	bucket := request.FormValue("bucket")
+	bucket := request.URL.Query().Get("bucket")
+	// Files arriving before the bucket is known are held back in temporary files until it is
+	_, bucketKnown := request.URL.Query()["bucket"]
+	held := make([]*heldFile, 0)
+	defer func() {
+		for _, h := range held {
+			h.release()
+		}
+	}()
+	requestExpected := digests{}
+	err = requestExpected.parseDigestHeaders(textproto.MIMEHeader(request.Header))
+	if err != nil {
+		uploadError(response, request, http.StatusBadRequest, "ERROR:", err)
+		return
+	}
+	meta := metadata.Metadata{}
+	for name, values := range request.URL.Query() {
+		if strings.HasPrefix(name, metaField) {
+			err = meta.Add(strings.TrimPrefix(name, metaField), values[0])
+			if err != nil {
+				uploadError(response, request, http.StatusBadRequest, "ERROR:", err)
+				return
+			}
+		}
+	}
+	conflict := conflictOptions{}
+	err = conflict.setPolicy(request.URL.Query().Get("onConflict"))
+	if err != nil {
+		uploadError(response, request, http.StatusBadRequest, "ERROR:", err)
+		return
+	}
+	conflict.parsePreconditions(textproto.MIMEHeader(request.Header))
+	extract := false
+	if value := request.URL.Query().Get("extract"); value != "" {
+		extract, err = strconv.ParseBool(value)
+		if err != nil {
+			uploadError(response, request, http.StatusBadRequest, "Invalid extract flag: ", err)
+			return
+		}
+	}
+
+	// Digest and modified fields only apply to the file following them, and the request's digest headers to the first
+	// file
+	expected := digests{}
+	results := make([]*uploadResult, 0)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			uploadError(response, request, http.StatusBadRequest, "Error while reading upload from client: ", err)
+			return
+		}
 
-	// Close the file afterwards:
-	defer util.CloseMPFile(file)
+		switch {
+		case part.FormName() == "bucket":
+			value, err := readField(part)
+			if err != nil {
+				uploadError(response, request, http.StatusBadRequest, "Error while reading bucket from client: ", err)
+				return
+			}
+			bucket = value
+			if !bucketKnown {
+				bucketKnown = true
+				for _, h := range held {
+					results = append(results, h.receive(request, bucket))
+				}
+			}
+		case part.FormName() == "extract":
+			value, err := readField(part)
+			if err == nil {
+				extract, err = strconv.ParseBool(value)
+			}
+			if err != nil {
+				uploadError(response, request, http.StatusBadRequest, "Invalid extract flag: ", err)
+				return
+			}
+		case part.FormName() == "onConflict":
+			value, err := readField(part)
+			if err == nil {
+				err = conflict.setPolicy(value)
+			}
+			if err != nil {
+				uploadError(response, request, http.StatusBadRequest, "Invalid conflict policy: ", err)
+				return
+			}
+		case part.FormName() == "modified":
+			value, err := readField(part)
+			if err == nil {
+				conflict.Modified, err = parseModified(value)
+			}
+			if err != nil {
+				uploadError(response, request, http.StatusBadRequest, "Invalid modification time: ", err)
+				return
+			}
+		case part.FormName() == "sha256" || part.FormName() == "md5":
+			value, err := readField(part)
+			if err == nil {
+				err = expected.set(part.FormName(), value)
+			}
+			if err != nil {
+				uploadError(response, request, http.StatusBadRequest, "Error while reading digest from client: ", err)
+				return
+			}
+		case strings.HasPrefix(part.FormName(), metaField) && partPath(part) == "":
+			value, err := readField(part)
+			if err == nil {
+				err = meta.Add(strings.TrimPrefix(part.FormName(), metaField), value)
+			}
+			if err != nil {
+				uploadError(response, request, http.StatusBadRequest, "Error while reading metadata from client: ", err)
+				return
+			}
+		case partPath(part) != "" && !bucketKnown:
+			h, err := holdFile(part, extract, expected, requestExpected, meta, conflict)
+			if err != nil {
+				uploadError(response, request, http.StatusInternalServerError, "Error while reading upload from client: ", err)
+				return
+			}
+			held = append(held, h)
+			expected, requestExpected, conflict.Modified = digests{}, digests{}, time.Time{}
+		case partPath(part) != "":
+			f := uploadedFile{name: partPath(part), header: part.Header, body: part}
+			result := receivePart(request, f, bucket, extract, expected, requestExpected, meta, conflict)
+			if bodyExceeded(request) {
+				// The request body hit the size limit, so nothing that follows can be read either
+				uploadError(response, request, result.Status, "ERROR:", errors.Err(ErrBodyTooLarge))
+				return
+			}
+			results = append(results, result)
+			expected, requestExpected, conflict.Modified = digests{}, digests{}, time.Time{}
+		}
+		util.CloseMPPart(part)
+	}
+	if !bucketKnown {
+		// Without a bucket field the files go to the root bucket, as they would without holding them back
+		for _, h := range held {
+			results = append(results, h.receive(request, bucket))
+		}
+	}
 
-	// Read the entire file into memory:
-	data, err := ioutil.ReadAll(file)
-	if err != nil {
-		logrus.Error("Error while reading file from client: ", err)
-		http.Error(response, err.Error(), http.StatusInternalServerError)
+	if len(results) == 0 {
+		logrus.Error("Was not able to access the uploaded file: no file part in request")
+		http.Error(response, http.ErrMissingFile.Error(), http.StatusBadRequest)
 		return
 	}
 
-	currDir, err := os.Getwd()
+	status := http.StatusOK
+	for i, result := range results {
+		if i == 0 {
+			status = result.Status
+		} else if result.Status != status {
+			status = http.StatusMultiStatus
+		}
+	}
+
+	auditUpload(request, results)
+	logrus.Debug("Server: Files were read from client and written to disk.")
+	response.Header().Set("Content-Type", "application/json; charset=utf-8")
+	response.WriteHeader(status)
+	err = json.NewEncoder(response).Encode(struct{ Files []*uploadResult }{results})
 	if err != nil {
-		logrus.Fatal(err)
+		logrus.Error(err)
 	}
+}
+
+// uploadResult describes the outcome of a single uploaded file along with the digests computed while writing it.
+// Extracted archives carry the manifest of the files unpacked from them. Skipped files were kept as they were
+// because of onConflict=keep-newer, and File is the existing file.
+type uploadResult struct {
+	// Name is the file name as sent by the client
+	Name     string `json:",omitempty"`
+	Status   int
+	Error    string            `json:",omitempty"`
+	File     string            `json:",omitempty"`
+	Skipped  bool              `json:",omitempty"`
+	Size     int64             `json:",omitempty"`
+	ETag     string            `json:",omitempty"`
+	SHA256   string            `json:",omitempty"`
+	MD5      string            `json:",omitempty"`
+	Metadata metadata.Metadata `json:",omitempty"`
+	Manifest *extractManifest  `json:",omitempty"`
+}
 
-	// Check if the directory exists!  If not, then we need to create it now
-	fileName := fileHeader.Filename
-	if bucket != "" {
-		fileName = bucket + "/" + fileName
+// uploadedFile is a file sent in an upload, straight from the request or held back until its bucket was known
+type uploadedFile struct {
+	name   string
+	header textproto.MIMEHeader
+	body   io.Reader
+}
+
+// receivePart stores or extracts a single file and reports the outcome. The file's own digest and precondition
+// headers are combined with the preceding fields and those of the request.
+func receivePart(request *http.Request, f uploadedFile, bucket string, extract bool, expected, requestExpected digests, meta metadata.Metadata, conflict conflictOptions) *uploadResult {
+	name := f.name
+	conflict.parsePreconditions(f.header)
+	err := expected.parseDigestHeaders(f.header)
+	if err == nil && requestExpected.SHA256 != nil {
+		err = expected.set("sha256", hex.EncodeToString(requestExpected.SHA256))
+	}
+	if err == nil && requestExpected.MD5 != nil {
+		err = expected.set("md5", hex.EncodeToString(requestExpected.MD5))
 	}
-	directory := filepath.Join(currDir, "data")
-	pathElements := strings.Split(fileName, "/")
-	bucket = strings.Join(pathElements[:len(pathElements)-1], "/")
-	fileName = pathElements[len(pathElements)-1]
-	logrus.Debug("Bucket: ", bucket)
 
-	_, err = os.Stat(directory + "/" + bucket)
+	result := &uploadResult{Name: name}
 	if err != nil {
-		logrus.Error(err)
+		logrus.Error("Upload of '", name, "' has invalid digests: ", err)
+		result.Status, result.Error = http.StatusBadRequest, errors.Unwrap(err).Error()
+		return result
 	}
-	if os.IsNotExist(err) {
-		logrus.Debug("Server: Unable to find directory, '", directory, "'.  Creating now...")
-		bucketDir := directory + "/" + bucket
-		err := os.MkdirAll(bucketDir, 0755) // http://permissions-calculator.org/decode/0755/
-		if err != nil {
-			logrus.Error(err)
-			http.Error(response, err.Error(), http.StatusInternalServerError)
-			return
+
+	if extract {
+		result.Manifest, err = extractFile(request, f, bucket, expected, meta, conflict)
+		if err == nil {
+			result.File, result.Size = result.Manifest.Archive, result.Manifest.Size
+			result.SHA256, result.MD5 = result.Manifest.SHA256, result.Manifest.MD5
+		}
+	} else {
+		var stored *uploadResult
+		stored, err = receiveFile(request, name, f.body, bucket, expected, meta, conflict)
+		if err == nil {
+			result = stored
+			result.Name = name
 		}
+	}
 
-		err = os.Chown(bucketDir, 65534, 65534)
-		if err != nil {
-			logrus.Error("ERROR:", err)
-			http.Error(response, err.Error(), http.StatusInternalServerError)
-			return
+	result.Status = uploadStatus(err)
+	if err != nil {
+		logrus.Error("Upload of '", name, "' failed: ", err)
+		result.Error = errors.Unwrap(err).Error()
+	}
+	return result
+}
+
+// uploadStatus maps the error of a single upload to the status reported for it
+func uploadStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case storage.IsInvalidPath(err), errors.Is(err, ErrInvalidArchive), errors.Is(err, metadata.ErrInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, acl.ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrPreconditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, ErrDigestMismatch):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrUnsupportedArchive):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrExtractLimit), errors.Is(err, quota.ErrTooLarge), errors.Is(err, ErrBodyTooLarge),
+		errors.Is(err, ErrPastSessionSize):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, quota.ErrExceeded):
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+// partPath returns the file name of a part including any directories. Unlike multipart.Part.FileName, which only
+// keeps the last element, this preserves the relative paths browsers send for directory uploads. The path is
+// sanitised like every other client supplied name when it is joined with the bucket.
+func partPath(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	return params["filename"]
+}
+
+// receiveFile streams an uploaded file into its bucket in the configured storage, verifying it against the
+// expected digests on the way. An existing file is dealt with as the conflict options say. The caller needs write
+// access to the bucket, and becomes its owner if nobody has claimed it yet.
+func receiveFile(request *http.Request, name string, body io.Reader, bucket string, expected digests, meta metadata.Metadata, conflict conflictOptions) (*uploadResult, error) {
+	key, err := storage.JoinKey(bucket, name)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Debug("Key: ", key)
+
+	bucket = storage.BucketOf(key)
+	if !acl.Check(request, bucket, acl.Write) {
+		return nil, errors.Err(acl.ErrForbidden)
+	}
+
+	unlock := lockKey(key)
+	defer unlock()
+	target, err := resolveConflict(key, conflict)
+	if err != nil {
+		return nil, err
+	} else if target == "" {
+		logrus.Debug("Kept the newer file ", key)
+		return &uploadResult{File: key, Skipped: true}, nil
+	}
+	key = target
+
+	var replaced int64
+	if info, err := storage.Default.Stat(key); err == nil && !info.IsDir {
+		replaced = info.Size
+	}
+	remaining, err := quotaRemaining(request, bucket, replaced)
+	if err != nil {
+		return nil, err
+	}
+
+	v := newVerifier(quota.NewReader(body, remaining), expected)
+	size, err := putFile(key, v)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	err = storeMetadata(key, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each result gets its own copy, as metadata fields sent between files change the map of the request
+	var fileMeta metadata.Metadata
+	if len(meta) > 0 {
+		fileMeta = metadata.Metadata{}
+		for name, value := range meta {
+			fileMeta[name] = value
 		}
 	}
+	computed := v.Sum()
+	result := &uploadResult{File: key, Size: size, SHA256: hex.EncodeToString(computed.SHA256), MD5: hex.EncodeToString(computed.MD5), Metadata: fileMeta}
+	if info, err := storage.Default.Stat(key); err == nil {
+		result.ETag = info.ETag
+	}
+	return result, claimBucket(request, bucket)
+}
+
+// quotaRemaining returns how many bytes the caller may still store in the bucket, or quota.Unlimited. replaced is
+// the size of the file the upload overwrites.
+func quotaRemaining(request *http.Request, bucket string, replaced int64) (int64, error) {
+	if quota.Default == nil {
+		return quota.Unlimited, nil
+	}
+	return quota.Default.Remaining(storage.Default, bucket, auth.User(request), replaced)
+}
 
-	// Write the data into a new file on server's side:
-	logrus.Debug("Directory:", directory+"/"+bucket)
-	// Get the original filename:
-	sourceFilename := bucket + "/" + fileName
-	sourceFilePath := filepath.Join(directory, sourceFilename)
-	logrus.Debug("Filename: ", fileName)
-	err = ioutil.WriteFile(sourceFilePath, data, 0755)
+// putFile stores the contents under the key and accounts for them in the cached quota usage. In versioned buckets
+// the contents are received into a temporary file first, and the file they replace is only kept as a version once
+// they arrived complete and verified, so a failed upload leaves no version behind.
+func putFile(key string, r io.Reader) (int64, error) {
+	var replaced int64
+	if info, err := storage.Default.Stat(key); err == nil && !info.IsDir {
+		replaced = info.Size
+	}
+	size, err := stageFile(key, r)
+	if err == nil && quota.Default != nil {
+		quota.Default.Stored(key, size-replaced)
+	}
+	return size, err
+}
+
+// stageFile writes the contents for putFile, receiving them into a temporary file first in versioned buckets
+func stageFile(key string, r io.Reader) (int64, error) {
+	if versions.Default == nil || !versions.Default.Enabled(storage.BucketOf(key)) {
+		return storage.Default.Put(key, r)
+	}
+
+	tmp, err := storage.TempFile("ft-version-")
 	if err != nil {
-		logrus.Error("ERROR:", err)
-		http.Error(response, err.Error(), http.StatusInternalServerError)
-		return
+		return 0, errors.Err(err)
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+	size, err := io.Copy(tmp, r)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return size, errors.Err(err)
 	}
 
-	err = os.Chown(sourceFilePath, 65534, 65534)
+	kept, err := versions.Default.Keep(storage.Default, key)
+	if err != nil {
+		return 0, err
+	}
+	size, err = storage.Default.Put(key, tmp)
 	if err != nil {
-		logrus.Error("ERROR:", err)
-		http.Error(response, err.Error(), http.StatusInternalServerError)
+		_ = versions.Default.Discard(key, kept)
+	}
+	return size, err
+}
+
+// storeMetadata replaces the metadata of a stored file, so a file uploaded again does not keep the old metadata
+func storeMetadata(key string, meta metadata.Metadata) error {
+	if metadata.Default == nil {
+		return nil
+	}
+	return metadata.Default.Set(key, meta)
+}
+
+// claimBucket records the caller as the owner of a bucket that has no access list yet
+func claimBucket(request *http.Request, bucket string) error {
+	if acl.Default == nil {
+		return nil
+	}
+	return acl.Default.Claim(auth.User(request), bucket)
+}
+
+// readField reads a small non-file form value
+func readField(part *multipart.Part) (string, error) {
+	value, err := ioutil.ReadAll(io.LimitReader(part, maxFieldSize))
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// uploadError logs a failed upload and replies with the given status, or 413 when the size limit was hit
+func uploadError(response http.ResponseWriter, request *http.Request, status int, message string, err error) {
+	logrus.Error(message, err)
+	if bodyExceeded(request) {
+		http.Error(response, "Request body too large.", http.StatusRequestEntityTooLarge)
 		return
 	}
+	http.Error(response, err.Error(), status)
+}
+
+// heldFile is a file part that arrived before the bucket field, kept in a temporary file along with the fields that
+// applied to it
+type heldFile struct {
+	file            *os.File
+	name            string
+	header          textproto.MIMEHeader
+	extract         bool
+	expected        digests
+	requestExpected digests
+	meta            metadata.Metadata
+	conflict        conflictOptions
+}
+
+// holdFile copies a file part to a temporary file so it can be stored once its bucket is known
+func holdFile(part *multipart.Part, extract bool, expected, requestExpected digests, meta metadata.Metadata, conflict conflictOptions) (*heldFile, error) {
+	tmp, err := storage.TempFile("ft-held-")
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	h := &heldFile{file: tmp, name: partPath(part), header: part.Header, extract: extract, expected: expected, requestExpected: requestExpected, meta: metadata.Metadata{}, conflict: conflict}
+	for name, value := range meta {
+		h.meta[name] = value
+	}
+
+	_, err = io.Copy(tmp, part)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		h.release()
+		return nil, errors.Err(err)
+	}
+	return h, nil
+}
+
+// receive stores the held file in the bucket
+func (h *heldFile) receive(request *http.Request, bucket string) *uploadResult {
+	f := uploadedFile{name: h.name, header: h.header, body: h.file}
+	return receivePart(request, f, bucket, h.extract, h.expected, h.requestExpected, h.meta, h.conflict)
+}
+
+// release removes the temporary file
+func (h *heldFile) release() {
+	_ = h.file.Close()
+	_ = os.Remove(h.file.Name())
+}
+
+// bodyLimiter fails with ErrBodyTooLarge once more than the remaining bytes are read from the request body. The
+// multipart reader does not keep the errors it passes on matchable, so exceeded records that the limit was hit.
+type bodyLimiter struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+// Read reads from the request body until the limit is exceeded
+func (b *bodyLimiter) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errors.Err(ErrBodyTooLarge)
+	}
+	// Read one byte past the limit to tell a body that fits exactly from one that does not
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		b.exceeded = true
+		return 0, errors.Err(ErrBodyTooLarge)
+	}
+	return n, err
+}
 
-	logrus.Debug("Server: File was read from client and written to disk.")
-	response.WriteHeader(http.StatusOK)
+// bodyExceeded reports whether the body of the upload request grew beyond MaxUploadSize
+func bodyExceeded(request *http.Request) bool {
+	limiter, ok := request.Body.(*bodyLimiter)
+	return ok && limiter.exceeded
 }
@@ -0,0 +1,477 @@
+package handler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tiger5226/filetransfer/metadata"
+	"github.com/tiger5226/filetransfer/quota"
+	"github.com/tiger5226/filetransfer/storage"
+	"github.com/tiger5226/filetransfer/versions"
+)
+
+func TestUploadBucketField(t *testing.T) {
+	defer useTestStorage(t)()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("files", "early.txt")
+	_, _ = part.Write([]byte("sent before the bucket"))
+	_ = writer.WriteField("bucket", "late")
+	part, _ = writer.CreateFormFile("files", "after.txt")
+	_, _ = part.Write([]byte("sent after the bucket"))
+	_ = writer.Close()
+
+	request := httptest.NewRequest(http.MethodPost, "/upload", body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	response := httptest.NewRecorder()
+	Upload(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("upload returned %d: %s", response.Code, response.Body.String())
+	}
+	for key, contents := range map[string]string{"late/early.txt": "sent before the bucket", "late/after.txt": "sent after the bucket"} {
+		object, _, err := storage.Default.Get(key)
+		if err != nil {
+			t.Errorf("%s was not stored: %v", key, err)
+			continue
+		}
+		stored, _ := ioutil.ReadAll(object)
+		_ = object.Close()
+		if string(stored) != contents {
+			t.Errorf("%s holds %q", key, stored)
+		}
+	}
+	if _, err := storage.Default.Stat("early.txt"); err == nil {
+		t.Error("the file sent before the bucket was stored in the root bucket")
+	}
+}
+
+func TestUploadBodyLimit(t *testing.T) {
+	defer useTestStorage(t)()
+	previous := MaxUploadSize
+	MaxUploadSize = 1 << 10
+	defer func() { MaxUploadSize = previous }()
+
+	for name, bucket := range map[string]string{"known bucket": "?bucket=big", "held back": ""} {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("files", "big.bin")
+		_, _ = part.Write(bytes.Repeat([]byte("x"), 4<<10))
+		_ = writer.Close()
+
+		request := httptest.NewRequest(http.MethodPost, "/upload"+bucket, body)
+		request.Header.Set("Content-Type", writer.FormDataContentType())
+		// Without a length the limit is only noticed while the body is read
+		request.ContentLength = -1
+		response := httptest.NewRecorder()
+		Upload(response, request)
+		if response.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: an oversized body returned %d: %s", name, response.Code, response.Body.String())
+		}
+	}
+	if _, err := storage.Default.Stat("big/big.bin"); err == nil {
+		t.Error("an oversized file was stored")
+	}
+}
+
+func TestUploadRejectsTraversal(t *testing.T) {
+	defer useTestStorage(t)()
+
+	for _, bucket := range []string{"..", "../..", "a/../../b", "/../etc"} {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		_ = writer.WriteField("bucket", bucket)
+		part, _ := writer.CreateFormFile("file", "evil.txt")
+		_, _ = part.Write([]byte("evil"))
+		_ = writer.Close()
+
+		request := httptest.NewRequest(http.MethodPost, "/upload", body)
+		request.Header.Set("Content-Type", writer.FormDataContentType())
+		response := httptest.NewRecorder()
+		Upload(response, request)
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("Upload into %q returned %d, expected 400", bucket, response.Code)
+		}
+	}
+}
+
+func TestUploadVerifiesDigest(t *testing.T) {
+	defer useTestStorage(t)()
+
+	const contents = "The quick brown fox jumps over the lazy dog"
+	const sha = "d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592"
+	cases := []struct {
+		name    string
+		field   string
+		value   string
+		header  string
+		hValue  string
+		status  int
+		written bool
+	}{
+		{"none", "", "", "", "", http.StatusOK, true},
+		{"sha256 field", "sha256", sha, "", "", http.StatusOK, true},
+		{"Content-MD5", "", "", "Content-MD5", "nhB9nTcrtoJr2B01QqQZ1g==", http.StatusOK, true},
+		{"Digest", "", "", "Digest", "SHA-256=16j7swfXgJRpypq8sAguT41WUeRtPNt2LQLQvzfJ5ZI=, UNIXsum=30637", http.StatusOK, true},
+		{"wrong sha256", "sha256", strings.Repeat("0", 64), "", "", http.StatusUnprocessableEntity, false},
+		{"wrong md5", "", "", "Content-MD5", "AAAAAAAAAAAAAAAAAAAAAA==", http.StatusUnprocessableEntity, false},
+		{"malformed", "md5", "abc", "", "", http.StatusBadRequest, false},
+		{"conflicting", "sha256", sha, "Digest", "sha-256=" + strings.Repeat("1", 64), http.StatusBadRequest, false},
+	}
+
+	for _, c := range cases {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		if c.field != "" {
+			_ = writer.WriteField(c.field, c.value)
+		}
+		part, _ := writer.CreateFormFile("file", "fox.txt")
+		_, _ = part.Write([]byte(contents))
+		_ = writer.Close()
+
+		request := httptest.NewRequest(http.MethodPost, "/upload?bucket="+strings.Replace(c.name, " ", "-", -1), body)
+		request.Header.Set("Content-Type", writer.FormDataContentType())
+		if c.header != "" {
+			request.Header.Set(c.header, c.hValue)
+		}
+		response := httptest.NewRecorder()
+		Upload(response, request)
+
+		if response.Code != c.status {
+			t.Errorf("%s: returned %d, expected %d: %s", c.name, response.Code, c.status, response.Body.String())
+		}
+		_, err := storage.Default.Stat(strings.Replace(c.name, " ", "-", -1) + "/fox.txt")
+		if c.written != (err == nil) {
+			t.Errorf("%s: expected the file to be stored: %v, got %v", c.name, c.written, err)
+		}
+		if c.status == http.StatusOK && !strings.Contains(response.Body.String(), `"SHA256":"`+sha+`"`) {
+			t.Errorf("%s: the computed digest is missing from %s", c.name, response.Body.String())
+		}
+	}
+}
+
+func TestUploadMultipleFiles(t *testing.T) {
+	defer useTestStorage(t)()
+
+	upload := func(files map[string]string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for name, contents := range files {
+			part, _ := writer.CreateFormFile("files", name)
+			_, _ = part.Write([]byte(contents))
+		}
+		_ = writer.Close()
+
+		request := httptest.NewRequest(http.MethodPost, "/upload?bucket=site", body)
+		request.Header.Set("Content-Type", writer.FormDataContentType())
+		response := httptest.NewRecorder()
+		Upload(response, request)
+		return response
+	}
+
+	response := upload(map[string]string{"index.html": "<html>", "css/main.css": "body {}", "img/logo.svg": "<svg>"})
+	if response.Code != http.StatusOK {
+		t.Fatalf("upload returned %d: %s", response.Code, response.Body.String())
+	}
+	for _, key := range []string{"site/index.html", "site/css/main.css", "site/img/logo.svg"} {
+		if _, err := storage.Default.Stat(key); err != nil {
+			t.Errorf("%s was not stored: %v", key, err)
+		}
+	}
+
+	response = upload(map[string]string{"ok.txt": "fine", "../evil.txt": "evil"})
+	if response.Code != http.StatusMultiStatus {
+		t.Errorf("a partly failed upload returned %d: %s", response.Code, response.Body.String())
+	}
+	if !strings.Contains(response.Body.String(), `"Name":"../evil.txt","Status":400`) ||
+		!strings.Contains(response.Body.String(), `"Name":"ok.txt","Status":200`) {
+		t.Errorf("unexpected results %s", response.Body.String())
+	}
+	if _, err := storage.Default.Stat("site/ok.txt"); err != nil {
+		t.Errorf("the valid file was not stored: %v", err)
+	}
+}
+
+func TestUploadQuota(t *testing.T) {
+	defer useTestStorage(t)()
+
+	dir, err := ioutil.TempDir("", "ft-handler-quota-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	previous := quota.Default
+	defer func() { quota.Default = previous }()
+	quota.Default, err = quota.Open(filepath.Join(dir, "quota.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	quota.Default.DefaultBucket = 10
+
+	upload := func(name, contents string) int {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("file", name)
+		_, _ = part.Write([]byte(contents))
+		_ = writer.Close()
+
+		request := httptest.NewRequest(http.MethodPost, "/upload?bucket=team", body)
+		request.Header.Set("Content-Type", writer.FormDataContentType())
+		response := httptest.NewRecorder()
+		Upload(response, request)
+		return response.Code
+	}
+
+	if status := upload("a", "123456"); status != http.StatusOK {
+		t.Errorf("an upload within the quota returned %d", status)
+	}
+	if status := upload("b", "123456"); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("an upload beyond the quota returned %d", status)
+	}
+	if _, err := storage.Default.Stat("team/b"); err == nil {
+		t.Error("an upload beyond the quota was stored")
+	}
+	if status := upload("a", "1234567890"); status != http.StatusOK {
+		t.Errorf("replacing a file within the quota returned %d", status)
+	}
+	if status := upload("c", "1"); status != http.StatusInsufficientStorage {
+		t.Errorf("an upload to a full bucket returned %d", status)
+	}
+}
+
+func TestUploadMetadata(t *testing.T) {
+	defer useTestStorage(t)()
+
+	dir, err := ioutil.TempDir("", "ft-handler-metadata-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	previous := metadata.Default
+	defer func() { metadata.Default = previous }()
+	metadata.Default, err = metadata.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(query string, fields map[string]string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for name, value := range fields {
+			_ = writer.WriteField(name, value)
+		}
+		part, _ := writer.CreateFormFile("file", "app.json")
+		_, _ = part.Write([]byte("{}"))
+		_ = writer.Close()
+
+		request := httptest.NewRequest(http.MethodPost, "/upload?bucket=builds&"+query, body)
+		request.Header.Set("Content-Type", writer.FormDataContentType())
+		response := httptest.NewRecorder()
+		Upload(response, request)
+		return response
+	}
+
+	response := upload("meta.build=42", map[string]string{"meta.Git-SHA": "deadbeef", "meta.content-type": "application/json"})
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"git-sha":"deadbeef"`) {
+		t.Fatalf("upload returned %d: %s", response.Code, response.Body.String())
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/download?file=builds/app.json", nil)
+	download := httptest.NewRecorder()
+	Download(download, request)
+	if download.Header().Get("X-Meta-Build") != "42" || download.Header().Get("X-Meta-Git-Sha") != "deadbeef" ||
+		download.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected headers %v", download.Header())
+	}
+
+	if response := upload("", map[string]string{"meta.bad name": "x"}); response.Code != http.StatusBadRequest {
+		t.Errorf("an invalid metadata name returned %d", response.Code)
+	}
+
+	// Uploading the file again replaces its metadata
+	if response := upload("", nil); response.Code != http.StatusOK {
+		t.Fatalf("upload returned %d", response.Code)
+	}
+	if m, _ := metadata.Default.Get("builds/app.json"); m != nil {
+		t.Errorf("the old metadata was kept: %v", m)
+	}
+
+	// Metadata fields only apply to the files after them, in the results as well
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("meta.stage", "1")
+	part, _ := writer.CreateFormFile("file", "first.txt")
+	_, _ = part.Write([]byte("1"))
+	_ = writer.WriteField("meta.stage", "2")
+	part, _ = writer.CreateFormFile("file", "second.txt")
+	_, _ = part.Write([]byte("2"))
+	_ = writer.Close()
+	request = httptest.NewRequest(http.MethodPost, "/upload?bucket=builds", body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	response = httptest.NewRecorder()
+	Upload(response, request)
+	if !strings.Contains(response.Body.String(), `"File":"builds/first.txt","Size":1,`) ||
+		!strings.Contains(response.Body.String(), `"Metadata":{"stage":"1"}`) ||
+		!strings.Contains(response.Body.String(), `"Metadata":{"stage":"2"}`) {
+		t.Errorf("unexpected results %s", response.Body.String())
+	}
+	if m, _ := metadata.Default.Get("builds/first.txt"); m["stage"] != "1" {
+		t.Errorf("the first file was stored with %v", m)
+	}
+}
+
+func TestUploadKeepsVersions(t *testing.T) {
+	defer useTestStorage(t)()
+	dir, err := ioutil.TempDir("", "ft-handler-versions-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	kept := storage.NewLocal(filepath.Join(dir, "versions"))
+	kept.UID, kept.GID = os.Getuid(), os.Getgid()
+	store, err := versions.Open(filepath.Join(dir, "versioning.json"), kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := versions.Default
+	versions.Default = store
+	defer func() { versions.Default = previous }()
+	if err := store.Enable("release", true); err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(contents, sha string) int {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		_ = writer.WriteField("sha256", sha)
+		part, _ := writer.CreateFormFile("file", "app")
+		_, _ = part.Write([]byte(contents))
+		_ = writer.Close()
+		request := httptest.NewRequest(http.MethodPost, "/upload?bucket=release", body)
+		request.Header.Set("Content-Type", writer.FormDataContentType())
+		response := httptest.NewRecorder()
+		Upload(response, request)
+		return response.Code
+	}
+	const sha1 = "d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592"
+	if status := upload("The quick brown fox jumps over the lazy dog", sha1); status != http.StatusOK {
+		t.Fatalf("the first upload returned %d", status)
+	}
+
+	// A replacement that fails verification must neither replace the file nor leave a version behind
+	if status := upload("corrupted", sha1); status != http.StatusUnprocessableEntity {
+		t.Fatalf("the corrupted upload returned %d", status)
+	}
+	history, err := store.List(storage.Default, "release/app")
+	if err != nil || len(history) != 1 || history[0].Checksum != sha1 {
+		t.Errorf("a failed upload changed the history: %+v %v", history, err)
+	}
+	if infos, _ := kept.List(""); len(infos) != 0 {
+		t.Errorf("a failed upload kept %d versions", len(infos))
+	}
+}
+
+func TestUploadConflict(t *testing.T) {
+	defer useTestStorage(t)()
+
+	upload := func(query string, header http.Header, fields map[string]string, contents string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for name, value := range fields {
+			_ = writer.WriteField(name, value)
+		}
+		part, _ := writer.CreateFormFile("file", "app.tar.gz")
+		_, _ = part.Write([]byte(contents))
+		_ = writer.Close()
+
+		request := httptest.NewRequest(http.MethodPost, "/upload?bucket=release&"+query, body)
+		for name := range header {
+			request.Header.Set(name, header.Get(name))
+		}
+		request.Header.Set("Content-Type", writer.FormDataContentType())
+		response := httptest.NewRecorder()
+		Upload(response, request)
+		return response
+	}
+	stored := func(key string) string {
+		object, _, err := storage.Default.Get(key)
+		if err != nil {
+			return ""
+		}
+		defer func() { _ = object.Close() }()
+		contents, _ := ioutil.ReadAll(object)
+		return string(contents)
+	}
+
+	createOnly := http.Header{"If-None-Match": {"*"}}
+	if response := upload("", createOnly, nil, "v1"); response.Code != http.StatusOK {
+		t.Fatalf("creating the file returned %d: %s", response.Code, response.Body.String())
+	}
+	if response := upload("", createOnly, nil, "v2"); response.Code != http.StatusPreconditionFailed {
+		t.Errorf("If-None-Match: * on an existing file returned %d", response.Code)
+	}
+	if response := upload("onConflict=fail", nil, nil, "v2"); response.Code != http.StatusConflict {
+		t.Errorf("onConflict=fail returned %d", response.Code)
+	}
+	if response := upload("onConflict=sometimes", nil, nil, "v2"); response.Code != http.StatusBadRequest {
+		t.Errorf("an unknown policy returned %d", response.Code)
+	}
+	if stored("release/app.tar.gz") != "v1" {
+		t.Fatal("a refused upload replaced the file")
+	}
+
+	if response := upload("", nil, map[string]string{"onConflict": "rename"}, "v2"); !strings.Contains(response.Body.String(), `"File":"release/app-1.tar.gz"`) {
+		t.Errorf("the renamed upload returned %s", response.Body.String())
+	}
+	if stored("release/app-1.tar.gz") != "v2" || stored("release/app.tar.gz") != "v1" {
+		t.Error("renaming did not keep both files")
+	}
+
+	info, err := storage.Default.Stat("release/app.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	older := map[string]string{"onConflict": "keep-newer", "modified": "2001-02-03T04:05:06Z"}
+	if response := upload("", nil, older, "v0"); response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `"Skipped":true`) {
+		t.Errorf("an older upload returned %d: %s", response.Code, response.Body.String())
+	}
+	if stored("release/app.tar.gz") != "v1" {
+		t.Error("keep-newer replaced a newer file")
+	}
+
+	if response := upload("", http.Header{"If-Match": {`"stale"`}}, nil, "v3"); response.Code != http.StatusPreconditionFailed {
+		t.Errorf("a stale If-Match returned %d", response.Code)
+	}
+	if response := upload("onConflict=keep-newer", http.Header{"If-Match": {info.ETag}}, nil, "v3"); response.Code != http.StatusOK {
+		t.Errorf("a matching If-Match returned %d: %s", response.Code, response.Body.String())
+	}
+	if stored("release/app.tar.gz") != "v3" {
+		t.Error("a newer upload did not replace the file")
+	}
+
+	// Storing the same contents elsewhere must not make the existing file look newer than it is
+	stale := time.Now().Add(-2 * time.Hour)
+	local := storage.Default.(*storage.Local)
+	if err := os.Chtimes(filepath.Join(local.Root, "release", "app.tar.gz"), stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Default.Put("mirror/app.tar.gz", strings.NewReader("v3")); err != nil {
+		t.Fatal(err)
+	}
+	older["modified"] = time.Now().Add(-3 * time.Hour).Format(time.RFC3339)
+	if response := upload("", nil, older, "v2"); !strings.Contains(response.Body.String(), `"Skipped":true`) {
+		t.Errorf("an upload older than the existing file returned %s", response.Body.String())
+	}
+	newer := map[string]string{"onConflict": "keep-newer", "modified": time.Now().Add(-time.Hour).Format(time.RFC3339)}
+	if response := upload("", nil, newer, "v4"); response.Code != http.StatusOK || stored("release/app.tar.gz") != "v4" {
+		t.Errorf("an upload newer than the existing file returned %d: %s", response.Code, response.Body.String())
+	}
+}
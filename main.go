@@ -2,72 +2,221 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
+	"github.com/tiger5226/filetransfer/acl"
 	"github.com/tiger5226/filetransfer/actions"
+	"github.com/tiger5226/filetransfer/actions/jenkinsfile"
+	"github.com/tiger5226/filetransfer/auth"
+	"github.com/tiger5226/filetransfer/certs"
+	"github.com/tiger5226/filetransfer/config"
 	"github.com/tiger5226/filetransfer/handler"
+	"github.com/tiger5226/filetransfer/metadata"
+	"github.com/tiger5226/filetransfer/quota"
+	"github.com/tiger5226/filetransfer/retention"
+	"github.com/tiger5226/filetransfer/storage"
+	"github.com/tiger5226/filetransfer/util"
+	"github.com/tiger5226/filetransfer/versions"
 
 	"github.com/kabukky/httpscerts"
+	"github.com/lbryio/lbry.go/extras/errors"
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
-	err := findCreateCerts()
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	logrus.Infof("Data Directory: %s", cfg.DataDir)
+
+	storage.StagingDir = filepath.Join(cfg.DataDir, storage.StagingDirName)
+	storage.Default, err = newStorage(cfg)
+	if err != nil {
+		logrus.Panic(err)
+	}
+	err = recoverFiles(cfg)
+	if err != nil {
+		logrus.Panic(err)
+	}
+	handler.DataDir = cfg.DataDir
+	handler.SessionTTL = cfg.SessionTTL
+	handler.MaxUploadSize = cfg.MaxUploadSize
+	handler.MaxExtractSize = cfg.Extract.MaxSize
+	handler.MaxExtractEntries = cfg.Extract.MaxEntries
+	jenkinsfile.Dir = cfg.JenkinsfilesDir
+
+	err = openTokenStore(cfg.TokenFile)
+	if err != nil {
+		logrus.Panic(err)
+	}
+
+	auth.Links, err = auth.OpenLinks(cfg.Links.File, cfg.Links.KeyFile)
+	if err != nil {
+		logrus.Panic(err)
+	}
+	actions.LinkMaxExpiry = cfg.Links.MaxExpiry
+
+	acl.Default, err = acl.Open(cfg.ACLFile)
+	if err != nil {
+		logrus.Panic(err)
+	}
+
+	metadata.Default, err = metadata.Open(cfg.MetadataDir)
 	if err != nil {
 		logrus.Panic(err)
 	}
+	removed, err := metadata.Default.Recover()
+	if err != nil {
+		logrus.Panic(err)
+	}
+	if removed > 0 {
+		logrus.Infof("Removed %d incomplete metadata writes from %s", removed, cfg.MetadataDir)
+	}
+
+	if cfg.Storage.Backend == "s3" && cfg.Versioning.S3Bucket == "" {
+		logrus.Info("Versioning is disabled, no s3_bucket is configured for previous versions")
+	} else {
+		versionStorage, err := newVersionStorage(cfg)
+		if err != nil {
+			logrus.Panic(err)
+		}
+		versions.Default, err = versions.Open(cfg.Versioning.File, versionStorage)
+		if err != nil {
+			logrus.Panic(err)
+		}
+	}
 
-	currDir, err := os.Getwd()
+	quota.Default, err = quota.Open(cfg.Quota.File)
 	if err != nil {
 		logrus.Panic(err)
 	}
+	quota.Default.DefaultBucket = cfg.Quota.Bucket
+	quota.Default.DefaultUser = cfg.Quota.User
 
-	logrus.Infof("Current Working Directory: %s", currDir)
+	retention.Default, err = retention.Open(cfg.Retention.File)
+	if err != nil {
+		logrus.Panic(err)
+	}
+	stopJanitor := make(chan struct{})
+	if cfg.Retention.Interval > 0 {
+		go retention.Janitor(retention.Default, storage.Default, cfg.Retention.Interval, stopJanitor)
+	}
+	if cfg.SessionTTL > 0 {
+		reaped, err := handler.ReapSessions(time.Now())
+		if err != nil {
+			logrus.Panic(err)
+		}
+		if reaped > 0 {
+			logrus.Infof("Removed %d expired upload sessions", reaped)
+		}
+		interval := cfg.SessionTTL
+		if interval > time.Hour {
+			interval = time.Hour
+		}
+		go handler.SessionJanitor(interval, stopJanitor)
+	}
 
 	// Set up routes -
 	serverMUX := http.NewServeMux()
 	routes := actions.GetRoutes()
+	//Every route requires an API token
+	routes.Walk(func(pattern string, h http.Handler) http.Handler {
+		return auth.Require(h)
+	})
 	//Specialty Handlers for Data Upload/Download
-	serverMUX.HandleFunc("/upload", handler.Upload)
-	serverMUX.HandleFunc("/download", handler.Download)
+	//Pre-signed links stand in for a token on uploads and downloads
+	serverMUX.Handle("/upload", auth.Signed(auth.LinkUpload, auth.Require(http.HandlerFunc(handler.Upload))))
+	serverMUX.Handle("/download", auth.Signed(auth.LinkDownload, auth.Require(http.HandlerFunc(handler.Download))))
+	serverMUX.Handle("/bucket/archive", auth.Require(http.HandlerFunc(handler.Archive)))
 	routes.Each(func(pattern string, handler http.Handler) {
 		serverMUX.Handle(pattern, handler)
 	})
 
 	// Set up the HTTP server:
 	server := &http.Server{}
-	server.Addr = "0.0.0.0:9999"
+	server.Addr = cfg.Listen
 	server.Handler = serverMUX
 	server.SetKeepAlivesEnabled(true)
-	server.ReadTimeout = 15 * time.Minute
-	server.WriteTimeout = 15 * time.Minute
+	server.ReadTimeout = cfg.ReadTimeout
+	server.WriteTimeout = cfg.WriteTimeout
 
 	actions.ConfigureAPIServer()
 
+	var reloader *certs.Reloader
+	var redirectServer *http.Server
+	if cfg.TLS.Enabled {
+		err = findCreateCerts(cfg)
+		if err != nil {
+			logrus.Panic(err)
+		}
+		reloader, err = certs.NewReloader(cfg.TLS.Cert, cfg.TLS.Key)
+		if err != nil {
+			logrus.Panic(err)
+		}
+		server.TLSConfig = reloader.TLSConfig()
+		err = configureClientCerts(cfg, server.TLSConfig)
+		if err != nil {
+			logrus.Panic(err)
+		}
+
+		if cfg.TLS.RedirectListen != "" {
+			redirectServer = &http.Server{Addr: cfg.TLS.RedirectListen, Handler: certs.RedirectHandler(cfg.Listen)}
+			redirectServer.ReadTimeout = time.Minute
+			redirectServer.WriteTimeout = time.Minute
+		}
+	}
+
 	// Start the server:
-	logrus.Printf("Listening on port %v", 9999)
+	logrus.Printf("Listening on %v", cfg.Listen)
 	go func() {
-		err := server.ListenAndServe()
-		//err := server.ListenAndServeTLS("cert.pem", "key.pem")
-		if err != nil {
-			//Normal graceful shutdown error
-			if err.Error() == "http: Server closed" {
-				logrus.Info(err)
-			} else {
-				log.Fatal(err)
-			}
+		var err error
+		if cfg.TLS.Enabled {
+			// The certificate comes from the reloader, so no files are passed here
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
 		}
+		serveError(err)
 	}()
+	if redirectServer != nil {
+		logrus.Printf("Redirecting HTTP on %v to HTTPS", cfg.TLS.RedirectListen)
+		go func() {
+			serveError(redirectServer.ListenAndServe())
+		}()
+	}
+
 	//Wait for shutdown signal, then shutdown api server. This will wait for all connections to finish.
+	//SIGHUP reloads the certificate without dropping any connections.
 	interruptChan := make(chan os.Signal, 1)
-	signal.Notify(interruptChan, os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
-	<-interruptChan
+	signal.Notify(interruptChan, os.Interrupt, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for sig := <-interruptChan; sig == syscall.SIGHUP; sig = <-interruptChan {
+		if reloader == nil {
+			continue
+		}
+		err = reloader.Reload()
+		if err != nil {
+			logrus.Error("Keeping the current certificate: ", err)
+		} else {
+			logrus.Info("Reloaded the TLS certificate")
+		}
+	}
 	logrus.Debug("Shutting down API server...")
+	close(stopJanitor)
+	if redirectServer != nil {
+		err = redirectServer.Shutdown(context.Background())
+		if err != nil {
+			logrus.Error("Error shutting down redirect server: ", err)
+		}
+	}
 	err = server.Shutdown(context.Background())
 	if err != nil {
 		logrus.Error("Error shutting down server: ", err)
@@ -76,11 +225,27 @@ func main() {
 
 }
 
-func findCreateCerts() error {
-	err := httpscerts.Check("cert.pem", "key.pem")
+// serveError reports why a listener stopped
+func serveError(err error) {
+	if err != nil {
+		//Normal graceful shutdown error
+		if err == http.ErrServerClosed {
+			logrus.Info(err)
+		} else {
+			log.Fatal(err)
+		}
+	}
+}
+
+// findCreateCerts makes sure the configured certificate exists, generating a self-signed one only when allowed
+func findCreateCerts(cfg *config.Config) error {
+	err := httpscerts.Check(cfg.TLS.Cert, cfg.TLS.Key)
 
 	if err != nil {
-		err = httpscerts.Generate("cert.pem", "key.pem", "127.0.0.1:9999")
+		if !cfg.TLS.SelfSigned {
+			return errors.Prefix("no usable certificate and self_signed is disabled: ", err)
+		}
+		err = httpscerts.Generate(cfg.TLS.Cert, cfg.TLS.Key, certs.SelfSignedHosts(cfg.TLS.Hostnames, cfg.Listen))
 		if err != nil {
 			logrus.Fatal("Couldn't create https certs.", err)
 			return err
@@ -89,3 +254,103 @@ func findCreateCerts() error {
 
 	return nil
 }
+
+// configureClientCerts enables verification of client certificates and maps their subjects to users
+func configureClientCerts(cfg *config.Config, tlsConfig *tls.Config) error {
+	mode, err := certs.ClientAuth(cfg.TLS.Client.Auth)
+	if err != nil || mode == tls.NoClientCert {
+		return err
+	}
+
+	tlsConfig.ClientAuth = mode
+	tlsConfig.ClientCAs, err = certs.ClientCAs(cfg.TLS.Client.CA)
+	if err != nil {
+		return err
+	}
+	auth.ClientCerts, err = auth.NewCertMapper(cfg.TLS.Client.Identity, cfg.TLS.Client.Admins)
+	return err
+}
+
+// newStorage creates the storage backend selected in the configuration
+func newStorage(cfg *config.Config) (storage.Storage, error) {
+	if cfg.Storage.Backend == "s3" {
+		s3, err := storage.NewS3(cfg.Storage.S3)
+		if err != nil {
+			return nil, err
+		}
+		// The local backend clears the staging directory in Recover, with S3 it is the only thing kept on disk
+		removed, err := storage.ClearStaging(storage.StagingDir)
+		if removed > 0 {
+			logrus.Infof("Removed %d incomplete writes from %s", removed, storage.StagingDir)
+		}
+		return s3, err
+	}
+
+	local := storage.NewLocal(cfg.DataDir)
+	local.UID = cfg.Owner.UID
+	local.GID = cfg.Owner.GID
+	return local, recoverLocal(local)
+}
+
+// newVersionStorage creates the storage keeping previous versions of files, next to the one holding the buckets
+func newVersionStorage(cfg *config.Config) (storage.Storage, error) {
+	if cfg.Storage.Backend == "s3" {
+		s3 := cfg.Storage.S3
+		s3.Bucket = cfg.Versioning.S3Bucket
+		return storage.NewS3(s3)
+	}
+
+	local := storage.NewLocal(cfg.Versioning.Dir)
+	local.UID = cfg.Owner.UID
+	local.GID = cfg.Owner.GID
+	return local, recoverLocal(local)
+}
+
+// recoverLocal removes what writes interrupted by a crash or restart left behind, before anything is served
+func recoverLocal(local *storage.Local) error {
+	removed, err := local.Recover()
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		logrus.Infof("Removed %d incomplete writes from %s", removed, local.Root)
+	}
+	return nil
+}
+
+// recoverFiles removes the temporary files interrupted writes left next to the files of the stores. They are written
+// next to their files to be renamed into place, so they are not in the staging directory.
+func recoverFiles(cfg *config.Config) error {
+	var removed int
+	for _, path := range []string{cfg.TokenFile, cfg.ACLFile, cfg.Links.File, cfg.Links.KeyFile, cfg.Retention.File, cfg.Quota.File, cfg.Versioning.File} {
+		n, err := util.RemoveAtomicTemps(path)
+		removed += n
+		if err != nil {
+			return err
+		}
+	}
+	if removed > 0 {
+		logrus.Infof("Removed %d incomplete writes of the stores", removed)
+	}
+	return nil
+}
+
+// openTokenStore loads the API tokens. When no token has been issued yet, an admin token is created so the
+// server can be administered at all.
+func openTokenStore(path string) error {
+	store, err := auth.Open(path)
+	if err != nil {
+		return err
+	}
+	auth.Default = store
+
+	if store.Len() == 0 {
+		secret, _, err := store.Issue("bootstrap", true)
+		if err != nil {
+			return err
+		}
+		logrus.Warnf("No API tokens found in %s. Issued admin token: %s", path, secret)
+	}
+
+	return nil
+}
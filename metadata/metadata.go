@@ -0,0 +1,277 @@
+package metadata
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/tiger5226/filetransfer/util"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+// The limits on the metadata of a single file
+const (
+	MaxEntries     = 64
+	MaxNameLength  = 128
+	MaxValueLength = 1024
+)
+
+// ErrInvalid is returned for metadata names and values that cannot be stored or sent as a header
+var ErrInvalid = errors.Base("invalid metadata")
+
+// Default is the metadata store used by the handlers
+var Default *Store
+
+// versionDir holds the metadata of the previous versions of files. Keys cannot start with a dot, so it never meets
+// the metadata of a bucket.
+const versionDir = ".versions"
+
+// Metadata are the key/value pairs attached to a file. Names are lower case.
+type Metadata map[string]string
+
+// Add validates a pair and adds it. Names are case insensitive and may consist of letters, digits, '-', '_' and '.'.
+func (m Metadata) Add(name, value string) error {
+	name = strings.ToLower(name)
+	if name == "" || len(name) > MaxNameLength || strings.IndexFunc(name, invalidNameRune) >= 0 {
+		return errors.Prefix("'"+name+"'", ErrInvalid)
+	}
+	if len(value) > MaxValueLength || strings.IndexFunc(value, unicode.IsControl) >= 0 {
+		return errors.Prefix("the value of '"+name+"'", ErrInvalid)
+	}
+	if _, ok := m[name]; !ok && len(m) >= MaxEntries {
+		return errors.Prefix("more than "+strconv.Itoa(MaxEntries)+" entries", ErrInvalid)
+	}
+	m[name] = value
+	return nil
+}
+
+// Filter selects files by a metadata entry. Without a pattern the entry only has to be present.
+type Filter struct {
+	Name    string
+	Pattern string
+}
+
+// ParseFilters parses a comma separated list of name=pattern or name filters. Patterns are globs as accepted by
+// path.Match.
+func ParseFilters(s string) ([]Filter, error) {
+	filters := make([]Filter, 0)
+	for _, f := range strings.Split(s, ",") {
+		if strings.TrimSpace(f) == "" {
+			continue
+		}
+		parts := strings.SplitN(f, "=", 2)
+		filter := Filter{Name: strings.ToLower(strings.TrimSpace(parts[0]))}
+		if len(parts) == 2 {
+			filter.Pattern = parts[1]
+			if _, err := path.Match(filter.Pattern, ""); err != nil {
+				return nil, errors.Err("meta: %s", err)
+			}
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// Matches reports whether the metadata passes every filter
+func (m Metadata) Matches(filters []Filter) bool {
+	for _, f := range filters {
+		value, ok := m[f.Name]
+		if !ok {
+			return false
+		}
+		if matched, _ := path.Match(f.Pattern, value); f.Pattern != "" && !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Store keeps the metadata of every file as a sidecar JSON file in a directory mirroring the buckets. The sidecar
+// of a/b/file is a/b/.file, so it can neither collide with a bucket nor with another file.
+type Store struct {
+	dir string
+}
+
+// Open creates the store in the directory, which is created if needed
+func Open(dir string) (*Store, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Recover removes the temporary files of sidecars whose writes were interrupted and returns how many there were.
+// Sidecars are named after a key, which cannot start with a dot, so only these temporary files start with two.
+func (s *Store) Recover() (int, error) {
+	var removed int
+	err := filepath.Walk(s.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasPrefix(info.Name(), "..") {
+			return err
+		}
+		removed++
+		return os.Remove(p)
+	})
+	return removed, errors.Err(err)
+}
+
+// Get returns the metadata of the file stored under the key, or nil if it has none
+func (s *Store) Get(key string) (Metadata, error) {
+	contents, err := ioutil.ReadFile(s.sidecar(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	m := Metadata{}
+	err = json.Unmarshal(contents, &m)
+	if err != nil {
+		return nil, errors.Prefix("unable to read the metadata of '"+key+"'", err)
+	}
+	return m, nil
+}
+
+// Set replaces the metadata of the file stored under the key. Empty metadata removes it.
+func (s *Store) Set(key string, m Metadata) error {
+	if len(m) == 0 {
+		return s.Remove(key)
+	}
+
+	contents, err := json.Marshal(m)
+	if err != nil {
+		return errors.Err(err)
+	}
+	p := s.sidecar(key)
+	err = os.MkdirAll(filepath.Dir(p), 0700)
+	if err != nil {
+		return errors.Err(err)
+	}
+	return util.WriteFileAtomic(p, contents, 0600)
+}
+
+// Remove deletes the metadata of the file stored under the key
+func (s *Store) Remove(key string) error {
+	err := os.Remove(s.sidecar(key))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Err(err)
+	}
+	return nil
+}
+
+// RemoveBucket deletes the metadata of every file below the bucket, along with that of their previous versions
+func (s *Store) RemoveBucket(bucket string) error {
+	if bucket == "" {
+		return errors.Err("the metadata of the root bucket cannot be removed")
+	}
+	err := os.RemoveAll(filepath.Join(s.dir, filepath.FromSlash(bucket)))
+	if err != nil {
+		return errors.Err(err)
+	}
+	return errors.Err(os.RemoveAll(filepath.Join(s.dir, versionDir, filepath.FromSlash(bucket))))
+}
+
+// KeepVersion stores the metadata the file has now as that of its version with the id
+func (s *Store) KeepVersion(key, id string) error {
+	m, err := s.Get(key)
+	if err != nil || len(m) == 0 {
+		return err
+	}
+	contents, err := json.Marshal(m)
+	if err != nil {
+		return errors.Err(err)
+	}
+	p := s.versionSidecar(key, id)
+	err = os.MkdirAll(filepath.Dir(p), 0700)
+	if err != nil {
+		return errors.Err(err)
+	}
+	return util.WriteFileAtomic(p, contents, 0600)
+}
+
+// RestoreVersion gives the file the metadata of its version with the id, replacing whatever it had
+func (s *Store) RestoreVersion(key, id string) error {
+	m := Metadata{}
+	contents, err := ioutil.ReadFile(s.versionSidecar(key, id))
+	if err == nil {
+		err = json.Unmarshal(contents, &m)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return errors.Prefix("unable to read the metadata of a version of '"+key+"'", err)
+	}
+	return s.Set(key, m)
+}
+
+// RemoveVersion deletes the metadata of the version of the file with the id
+func (s *Store) RemoveVersion(key, id string) error {
+	err := os.Remove(s.versionSidecar(key, id))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Err(err)
+	}
+	return nil
+}
+
+// RemoveVersions deletes the metadata of every previous version of the file
+func (s *Store) RemoveVersions(key string) error {
+	dir := filepath.Join(s.dir, versionDir, filepath.FromSlash(key))
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Err(err)
+	}
+	for _, info := range infos {
+		// Directories hold the versions of files in a bucket that has since taken the name of the file
+		if info.IsDir() {
+			continue
+		}
+		err = os.Remove(filepath.Join(dir, info.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Err(err)
+		}
+	}
+	return nil
+}
+
+// Copy gives dst the metadata of src, replacing whatever dst had
+func (s *Store) Copy(src, dst string) error {
+	m, err := s.Get(src)
+	if err != nil {
+		return err
+	}
+	return s.Set(dst, m)
+}
+
+// Move hands the metadata of src over to dst
+func (s *Store) Move(src, dst string) error {
+	err := s.Copy(src, dst)
+	if err != nil {
+		return err
+	}
+	return s.Remove(src)
+}
+
+// sidecar returns the path of the metadata file of a key. Keys are clean, so they cannot leave the directory.
+func (s *Store) sidecar(key string) string {
+	dir, name := path.Split(key)
+	return filepath.Join(s.dir, filepath.FromSlash(dir), "."+name)
+}
+
+// versionSidecar returns the path of the metadata file of a version of a key. Like sidecars they are hidden, so the
+// temporary files of their writes stand out the same way.
+func (s *Store) versionSidecar(key, id string) string {
+	return filepath.Join(s.dir, versionDir, filepath.FromSlash(key), "."+id)
+}
+
+// invalidNameRune reports whether the rune may not be used in a metadata name
+func invalidNameRune(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.')
+}
@@ -0,0 +1,138 @@
+package metadata
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+func TestAdd(t *testing.T) {
+	m := Metadata{}
+	if err := m.Add("Build-Number", "42"); err != nil || m["build-number"] != "42" {
+		t.Errorf("a valid entry was not added: %v %v", err, m)
+	}
+	for name, value := range map[string]string{
+		"":             "empty name",
+		"with space":   "x",
+		"new\nline":    "x",
+		"ok":           "line\nbreak",
+		"long":         strings.Repeat("x", MaxValueLength+1),
+		"unicode-ñame": "x",
+	} {
+		if err := m.Add(name, value); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%q=%q returned %v", name, value, err)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	m := Metadata{"build": "1234", "git-sha": "deadbeef"}
+	cases := map[string]bool{
+		"":                        true,
+		"build":                   true,
+		"build=1234":              true,
+		"build=12*,git-sha=dead*": true,
+		"BUILD=1234":              true,
+		"build=1235":              false,
+		"branch":                  false,
+		"build=1234,branch":       false,
+	}
+	for filter, expected := range cases {
+		filters, err := ParseFilters(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Matches(filters) != expected {
+			t.Errorf("%q matched %v, expected %v", filter, !expected, expected)
+		}
+	}
+	if _, err := ParseFilters("build=[1"); err == nil {
+		t.Error("a malformed pattern was accepted")
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ft-metadata-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file and a bucket of the same name keep their metadata apart
+	if err := store.Set("a/b", Metadata{"build": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("a/b/c", Metadata{"build": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := store.Get("a/b"); err != nil || m["build"] != "1" {
+		t.Errorf("unexpected metadata %v: %v", m, err)
+	}
+	if m, err := store.Get("a/missing"); err != nil || m != nil {
+		t.Errorf("a file without metadata returned %v: %v", m, err)
+	}
+
+	if err := store.Move("a/b/c", "x/c"); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := store.Get("a/b/c"); m != nil {
+		t.Error("the metadata stayed with the moved file")
+	}
+	if m, _ := store.Get("x/c"); m["build"] != "2" {
+		t.Error("the metadata did not move with the file")
+	}
+
+	if err := store.Copy("a/missing", "x/c"); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := store.Get("x/c"); m != nil {
+		t.Error("copying a file without metadata kept the old metadata")
+	}
+
+	if err := store.RemoveBucket("a"); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := store.Get("a/b"); m != nil {
+		t.Error("removing the bucket kept the metadata")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ft-metadata-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	store, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Set("a/b.1", Metadata{"build": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	// What an interrupted Set leaves next to the sidecar
+	leftover := filepath.Join(dir, "a", "..b.1.4711")
+	if err := ioutil.WriteFile(leftover, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := store.Recover()
+	if err != nil || removed != 1 {
+		t.Errorf("Recover removed %d temporary files: %v", removed, err)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Error("the temporary file was not removed")
+	}
+	if m, err := store.Get("a/b.1"); err != nil || m["build"] != "1" {
+		t.Errorf("the metadata did not survive: %v %v", m, err)
+	}
+}
@@ -0,0 +1,344 @@
+package quota
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tiger5226/filetransfer/acl"
+	"github.com/tiger5226/filetransfer/storage"
+	"github.com/tiger5226/filetransfer/util"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+// ErrExceeded is returned when a quota is used up before anything is stored
+var ErrExceeded = errors.Base("the storage quota is used up")
+
+// ErrTooLarge is returned when an upload grows beyond the space left in a quota
+var ErrTooLarge = errors.Base("the upload exceeds the remaining storage quota")
+
+// Unlimited is returned by Remaining when no quota applies
+const Unlimited = -1
+
+// Default is the quota store consulted by the handlers
+var Default *Store
+
+// limits are the quotas set through the API, in bytes
+type limits struct {
+	Buckets map[string]int64
+	Users   map[string]int64
+}
+
+// UsageTTL is how long the usage of a bucket is cached before the bucket is walked again
+var UsageTTL = time.Minute
+
+// Store keeps the quotas of buckets and users in a JSON file on disk. A bucket quota covers the bucket and every
+// bucket nested below it, and all quotas on the way to the top level bucket have to hold. A user's usage is the
+// total of the top level buckets they own. Zero means unlimited. Quotas are checked when an upload starts and while
+// it is streamed, so concurrent uploads may overshoot a quota by what they have in flight.
+// Every file counts with its full size, even where the storage keeps identical files only once, and previous
+// versions of files do not count at all. The usage of each bucket is cached for UsageTTL and updated as uploads
+// are stored, so changes made through other means may take that long to show.
+type Store struct {
+	// DefaultBucket applies to every top level bucket without a quota of its own
+	DefaultBucket int64
+	// DefaultUser applies to every user without a quota of their own
+	DefaultUser int64
+
+	l      sync.RWMutex
+	path   string
+	limits limits
+
+	cacheL sync.Mutex
+	cache  map[string]*cachedUsage
+}
+
+// cachedUsage is the usage of a bucket as of a point in time, adjusted by the uploads stored since
+type cachedUsage struct {
+	used int64
+	at   time.Time
+}
+
+// Open loads the quotas from the file at path. A missing file results in an empty store.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, limits: limits{Buckets: map[string]int64{}, Users: map[string]int64{}}, cache: map[string]*cachedUsage{}}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	err = json.Unmarshal(contents, &s.limits)
+	if err != nil {
+		return nil, errors.Prefix("unable to read quotas: ", err)
+	}
+	if s.limits.Buckets == nil {
+		s.limits.Buckets = map[string]int64{}
+	}
+	if s.limits.Users == nil {
+		s.limits.Users = map[string]int64{}
+	}
+
+	return s, nil
+}
+
+// SetBucket replaces the quota of a bucket. A nil quota removes it, so the default applies again.
+func (s *Store) SetBucket(bucket string, quota *int64) error {
+	return s.set(s.limits.Buckets, bucket, quota)
+}
+
+// SetUser replaces the quota of a user. A nil quota removes it, so the default applies again.
+func (s *Store) SetUser(user string, quota *int64) error {
+	return s.set(s.limits.Users, user, quota)
+}
+
+// set updates one of the quota maps and saves the store
+func (s *Store) set(m map[string]int64, name string, quota *int64) error {
+	if quota != nil && *quota < 0 {
+		return errors.Err("quotas may not be negative")
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	previous, existed := m[name]
+	if quota == nil {
+		delete(m, name)
+	} else {
+		m[name] = *quota
+	}
+
+	err := s.save()
+	if err != nil {
+		if existed {
+			m[name] = previous
+		} else {
+			delete(m, name)
+		}
+	}
+	return err
+}
+
+// RemoveBucket removes the quotas of a deleted bucket and every bucket nested below it, and forgets the cached usage
+func (s *Store) RemoveBucket(bucket string) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	// The usage of the buckets containing it changed as well
+	s.cacheL.Lock()
+	s.cache = map[string]*cachedUsage{}
+	s.cacheL.Unlock()
+
+	removed := map[string]int64{}
+	for b, quota := range s.limits.Buckets {
+		if b == bucket || strings.HasPrefix(b, bucket+"/") {
+			removed[b] = quota
+			delete(s.limits.Buckets, b)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	err := s.save()
+	if err != nil {
+		for b, quota := range removed {
+			s.limits.Buckets[b] = quota
+		}
+	}
+	return err
+}
+
+// Bucket returns the quotas governing a bucket, keyed by the bucket they are set on. Top level buckets without a
+// quota of their own fall back to the default.
+func (s *Store) Bucket(bucket string) map[string]int64 {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	quotas := make(map[string]int64)
+	for b := bucket; b != ""; b = storage.BucketOf(b) {
+		if quota, ok := s.limits.Buckets[b]; ok {
+			quotas[b] = quota
+		} else if !strings.Contains(b, "/") && s.DefaultBucket > 0 {
+			quotas[b] = s.DefaultBucket
+		}
+	}
+	return quotas
+}
+
+// User returns the quota of a user
+func (s *Store) User(user string) int64 {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	if quota, ok := s.limits.Users[user]; ok {
+		return quota
+	}
+	return s.DefaultUser
+}
+
+// Usage sums up the size of every file below the bucket
+func Usage(st storage.Storage, bucket string) (used int64, files int, err error) {
+	infos, err := st.List(bucket)
+	if errors.Is(err, storage.ErrNotFound) {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+
+	for _, info := range infos {
+		if !info.IsDir {
+			used += info.Size
+			files++
+		}
+	}
+	return used, files, nil
+}
+
+// UserUsage sums up the size of every file in the top level buckets the user owns
+func UserUsage(st storage.Storage, user string) (int64, error) {
+	if acl.Default == nil {
+		return 0, nil
+	}
+
+	var total int64
+	for _, bucket := range acl.Default.Owned(user) {
+		used, _, err := Usage(st, bucket)
+		if err != nil {
+			return 0, err
+		}
+		total += used
+	}
+	return total, nil
+}
+
+// Remaining returns how many bytes the user may still store in the bucket, or Unlimited. The quotas of the bucket
+// and of the owners of its top level bucket apply, or the uploader's when nobody owns it yet. freed is the size of
+// a file the upload replaces. ErrExceeded is returned when nothing may be stored.
+func (s *Store) Remaining(st storage.Storage, bucket, user string, freed int64) (int64, error) {
+	remaining := int64(Unlimited)
+	limit := func(quota, used int64) {
+		if quota > 0 && (remaining == Unlimited || quota-used+freed < remaining) {
+			remaining = quota - used + freed
+		}
+	}
+
+	for b, quota := range s.Bucket(bucket) {
+		used, err := s.usage(st, b)
+		if err != nil {
+			return 0, err
+		}
+		limit(quota, used)
+	}
+
+	owners := []string{user}
+	if acl.Default != nil {
+		if claimed := acl.Default.Owners(bucket); len(claimed) > 0 {
+			owners = claimed
+		}
+	}
+	for _, owner := range owners {
+		quota := s.User(owner)
+		if quota <= 0 || owner == "" {
+			continue
+		}
+		var used int64
+		if acl.Default != nil {
+			for _, owned := range acl.Default.Owned(owner) {
+				u, err := s.usage(st, owned)
+				if err != nil {
+					return 0, err
+				}
+				used += u
+			}
+		}
+		limit(quota, used)
+	}
+
+	if remaining != Unlimited && remaining <= 0 {
+		return 0, errors.Err(ErrExceeded)
+	}
+	return remaining, nil
+}
+
+// Stored updates the cached usage of every bucket containing the key after a file was stored there. delta is the
+// size of the file less the size of the file it replaced.
+func (s *Store) Stored(key string, delta int64) {
+	s.cacheL.Lock()
+	defer s.cacheL.Unlock()
+	for b := storage.BucketOf(key); ; b = storage.BucketOf(b) {
+		if c, ok := s.cache[b]; ok {
+			c.used += delta
+		}
+		if b == "" {
+			return
+		}
+	}
+}
+
+// usage returns the usage of the bucket from the cache, walking the bucket when it is not cached or too old
+func (s *Store) usage(st storage.Storage, bucket string) (int64, error) {
+	s.cacheL.Lock()
+	c, ok := s.cache[bucket]
+	if ok && time.Since(c.at) < UsageTTL {
+		s.cacheL.Unlock()
+		return c.used, nil
+	}
+	s.cacheL.Unlock()
+
+	used, _, err := Usage(st, bucket)
+	if err != nil {
+		return 0, err
+	}
+	s.cacheL.Lock()
+	s.cache[bucket] = &cachedUsage{used: used, at: time.Now()}
+	s.cacheL.Unlock()
+	return used, nil
+}
+
+// save writes the quotas to disk. The caller must hold the lock.
+func (s *Store) save() error {
+	contents, err := json.MarshalIndent(s.limits, "", "  ")
+	if err != nil {
+		return errors.Err(err)
+	}
+
+	return util.WriteFileAtomic(s.path, contents, 0600)
+}
+
+// Reader fails with ErrTooLarge once more than the remaining bytes are read, so the storage discards the upload
+type Reader struct {
+	r         io.Reader
+	remaining int64
+}
+
+// NewReader limits r to the remaining bytes of a quota. Unlimited returns r itself.
+func NewReader(r io.Reader, remaining int64) io.Reader {
+	if remaining == Unlimited {
+		return r
+	}
+	return &Reader{r: r, remaining: remaining}
+}
+
+// Read reads from the underlying reader until the quota is exhausted
+func (q *Reader) Read(p []byte) (int, error) {
+	if q.remaining < 0 {
+		return 0, errors.Err(ErrTooLarge)
+	}
+	// Read one byte past the quota to tell an upload that fits exactly from one that does not
+	if int64(len(p)) > q.remaining+1 {
+		p = p[:q.remaining+1]
+	}
+	n, err := q.r.Read(p)
+	q.remaining -= int64(n)
+	if q.remaining < 0 {
+		return 0, errors.Err(ErrTooLarge)
+	}
+	return n, err
+}
@@ -0,0 +1,145 @@
+package quota
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tiger5226/filetransfer/acl"
+	"github.com/tiger5226/filetransfer/storage"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+func newTestStore(t *testing.T) (*Store, *storage.Local, func()) {
+	dir, err := ioutil.TempDir("", "ft-quota-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := storage.NewLocal(filepath.Join(dir, "data"))
+	local.UID, local.GID = os.Getuid(), os.Getgid()
+
+	store, err := Open(filepath.Join(dir, "quota.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := acl.Default
+	acl.Default, err = acl.Open(filepath.Join(dir, "acl.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, local, func() {
+		acl.Default = previous
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func limit(n int64) *int64 {
+	return &n
+}
+
+func TestRemaining(t *testing.T) {
+	store, local, cleanup := newTestStore(t)
+	defer cleanup()
+
+	for key, size := range map[string]int{"team/ci/a": 30, "team/b": 20, "other/c": 50} {
+		if _, err := local.Put(key, strings.NewReader(strings.Repeat("x", size))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if remaining, err := store.Remaining(local, "team/ci", "dev", 0); err != nil || remaining != Unlimited {
+		t.Errorf("without quotas %d bytes remained: %v", remaining, err)
+	}
+
+	store.DefaultBucket = 100
+	if err := store.SetBucket("team/ci", limit(40)); err != nil {
+		t.Fatal(err)
+	}
+	if remaining, _ := store.Remaining(local, "team/ci", "dev", 0); remaining != 10 {
+		t.Errorf("the nested quota left %d bytes, expected 10", remaining)
+	}
+	if remaining, _ := store.Remaining(local, "team", "dev", 0); remaining != 50 {
+		t.Errorf("the default quota left %d bytes, expected 50", remaining)
+	}
+	if remaining, _ := store.Remaining(local, "team/ci", "dev", 30); remaining != 40 {
+		t.Errorf("replacing a file left %d bytes, expected 40", remaining)
+	}
+	if err := store.SetBucket("team/ci", limit(30)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Remaining(local, "team/ci", "dev", 0); !errors.Is(err, ErrExceeded) {
+		t.Errorf("a used up quota returned %v", err)
+	}
+
+	if err := acl.Default.Claim("dev", "team"); err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.Default.Claim("dev", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetUser("dev", limit(120)); err != nil {
+		t.Fatal(err)
+	}
+	// The owner's quota applies, whoever uploads
+	if remaining, _ := store.Remaining(local, "team", "qa", 0); remaining != 20 {
+		t.Errorf("the owner's quota left %d bytes, expected 20", remaining)
+	}
+
+	reopened, err := Open(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Bucket("team/ci")["team/ci"] != 30 || reopened.User("dev") != 120 {
+		t.Error("the quotas were not persisted")
+	}
+}
+
+func TestUsageCache(t *testing.T) {
+	store, local, cleanup := newTestStore(t)
+	defer cleanup()
+	previous := UsageTTL
+	defer func() { UsageTTL = previous }()
+
+	if _, err := local.Put("team/ci/a", strings.NewReader(strings.Repeat("x", 30))); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetBucket("team", limit(100)); err != nil {
+		t.Fatal(err)
+	}
+	if remaining, _ := store.Remaining(local, "team/ci", "dev", 0); remaining != 70 {
+		t.Fatalf("%d bytes remained, expected 70", remaining)
+	}
+
+	// Uploads update the cached usage without walking the bucket again
+	if _, err := local.Put("team/ci/b", strings.NewReader(strings.Repeat("x", 20))); err != nil {
+		t.Fatal(err)
+	}
+	if remaining, _ := store.Remaining(local, "team/ci", "dev", 0); remaining != 70 {
+		t.Errorf("the usage was walked again, %d bytes remained", remaining)
+	}
+	store.Stored("team/ci/b", 20)
+	if remaining, _ := store.Remaining(local, "team/ci", "dev", 0); remaining != 50 {
+		t.Errorf("a stored upload left %d bytes, expected 50", remaining)
+	}
+
+	// Changes made elsewhere show once the cache expires
+	if err := local.Delete("team/ci/a"); err != nil {
+		t.Fatal(err)
+	}
+	UsageTTL = 0
+	if remaining, _ := store.Remaining(local, "team/ci", "dev", 0); remaining != 80 {
+		t.Errorf("an expired cache left %d bytes, expected 80", remaining)
+	}
+}
+
+func TestReader(t *testing.T) {
+	if _, err := ioutil.ReadAll(NewReader(strings.NewReader("12345"), 5)); err != nil {
+		t.Errorf("an upload filling the quota exactly failed: %v", err)
+	}
+	if _, err := ioutil.ReadAll(NewReader(strings.NewReader("123456"), 5)); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("an upload over the quota returned %v", err)
+	}
+}
@@ -0,0 +1,425 @@
+package retention
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tiger5226/filetransfer/acl"
+	"github.com/tiger5226/filetransfer/metadata"
+	"github.com/tiger5226/filetransfer/quota"
+	"github.com/tiger5226/filetransfer/storage"
+	"github.com/tiger5226/filetransfer/util"
+	"github.com/tiger5226/filetransfer/versions"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The units a policy can expire. Files expires the individual files below the bucket, Buckets expires each bucket
+// directly below it as a whole, which suits buckets holding one sub bucket per build.
+const (
+	Files   = "file"
+	Buckets = "bucket"
+)
+
+// Default is the retention policy store enforced by the janitor
+var Default *Store
+
+// Duration is a time.Duration stored in its textual form, e.g. "168h"
+type Duration time.Duration
+
+// MarshalText encodes the duration like time.Duration.String
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText parses a duration in the format accepted by time.ParseDuration
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return errors.Err(err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Policy limits what a bucket may hold. Items, the files or sub buckets depending on the unit, are considered
+// newest first: the KeepLast newest are always kept, and every item that is older than MaxAge, or beyond MaxFiles
+// items or MaxSize bytes kept before it, expires. Zero disables a limit.
+type Policy struct {
+	Unit     string
+	MaxAge   Duration
+	MaxFiles int
+	MaxSize  int64
+	KeepLast int
+}
+
+// Validate checks that the policy limits anything at all
+func (p Policy) Validate() error {
+	if p.Unit != Files && p.Unit != Buckets {
+		return errors.Err("unknown retention unit '%s'", p.Unit)
+	}
+	if p.MaxAge < 0 || p.MaxFiles < 0 || p.MaxSize < 0 || p.KeepLast < 0 {
+		return errors.Err("retention limits may not be negative")
+	}
+	if p.MaxAge == 0 && p.MaxFiles == 0 && p.MaxSize == 0 {
+		return errors.Err("a retention policy needs a max age, max files or max size")
+	}
+	return nil
+}
+
+// Store keeps the retention policies of the buckets in a JSON file on disk. A policy only applies to the bucket it
+// is set on; buckets nested below it are covered as part of its contents.
+type Store struct {
+	l        sync.RWMutex
+	path     string
+	policies map[string]Policy
+}
+
+// Open loads the retention policies from the file at path. A missing file results in an empty store.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, policies: map[string]Policy{}}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	err = json.Unmarshal(contents, &s.policies)
+	if err != nil {
+		return nil, errors.Prefix("unable to read retention policies: ", err)
+	}
+
+	return s, nil
+}
+
+// Get returns the policy set on the bucket
+func (s *Store) Get(bucket string) (Policy, bool) {
+	s.l.RLock()
+	defer s.l.RUnlock()
+	p, ok := s.policies[bucket]
+	return p, ok
+}
+
+// Set replaces the policy of the bucket. A nil policy removes it.
+func (s *Store) Set(bucket string, p *Policy) error {
+	if p != nil {
+		err := p.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	previous, existed := s.policies[bucket]
+	if p == nil {
+		delete(s.policies, bucket)
+	} else {
+		s.policies[bucket] = *p
+	}
+
+	err := s.save()
+	if err != nil {
+		if existed {
+			s.policies[bucket] = previous
+		} else {
+			delete(s.policies, bucket)
+		}
+	}
+	return err
+}
+
+// RemoveBucket removes the policies of a deleted bucket and every bucket nested below it
+func (s *Store) RemoveBucket(bucket string) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	removed := map[string]Policy{}
+	for b, p := range s.policies {
+		if b == bucket || strings.HasPrefix(b, bucket+"/") {
+			removed[b] = p
+			delete(s.policies, b)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	err := s.save()
+	if err != nil {
+		for b, p := range removed {
+			s.policies[b] = p
+		}
+	}
+	return err
+}
+
+// Buckets returns the buckets that have a policy, sorted by name
+func (s *Store) Buckets() []string {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	buckets := make([]string, 0, len(s.policies))
+	for bucket := range s.policies {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	return buckets
+}
+
+// save writes the policies to disk. The caller must hold the lock.
+func (s *Store) save() error {
+	contents, err := json.MarshalIndent(s.policies, "", "  ")
+	if err != nil {
+		return errors.Err(err)
+	}
+
+	return util.WriteFileAtomic(s.path, contents, 0600)
+}
+
+// Expired is an item that a policy removes
+type Expired struct {
+	Key        string
+	Bucket     bool
+	Size       int64
+	ModifiedAt time.Time
+	Reason     string
+}
+
+// Report lists what a policy expires in a bucket. Errors holds the items that could not be removed.
+type Report struct {
+	Bucket  string
+	Policy  Policy
+	Expired []Expired
+	Kept    int
+	Freed   int64
+	Errors  []string `json:",omitempty"`
+}
+
+// Plan works out which items of the bucket the policy expires at the given time without removing anything
+func Plan(s storage.Storage, bucket string, p Policy, now time.Time) (*Report, error) {
+	infos, err := s.List(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]Expired, 0)
+	if p.Unit == Buckets {
+		// Each bucket directly below is one item, as old as its newest file and as large as all of them together
+		index := make(map[string]int)
+		empty := make(map[int]time.Time)
+		for _, info := range infos {
+			rel := info.Key
+			if bucket != "" {
+				rel = strings.TrimPrefix(rel, bucket+"/")
+			}
+			i := strings.Index(rel, "/")
+			if i < 0 && !info.IsDir {
+				continue
+			}
+			key := info.Key
+			if i >= 0 {
+				key = strings.TrimSuffix(info.Key, rel[i:])
+			}
+
+			n, ok := index[key]
+			if !ok {
+				n = len(items)
+				index[key] = n
+				items = append(items, Expired{Key: key, Bucket: true})
+			}
+			if info.IsDir {
+				if key == info.Key {
+					empty[n] = info.ModifiedAt
+				}
+				continue
+			}
+			items[n].Size += info.Size
+			if info.ModifiedAt.After(items[n].ModifiedAt) {
+				items[n].ModifiedAt = info.ModifiedAt
+			}
+		}
+		// Directories change whenever something below them does, so only buckets without files go by their own age
+		for n, modified := range empty {
+			if items[n].ModifiedAt.IsZero() {
+				items[n].ModifiedAt = modified
+			}
+		}
+	} else {
+		for _, info := range infos {
+			if !info.IsDir {
+				items = append(items, Expired{Key: info.Key, Size: info.Size, ModifiedAt: info.ModifiedAt})
+			}
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].ModifiedAt.Equal(items[j].ModifiedAt) {
+			return items[i].ModifiedAt.After(items[j].ModifiedAt)
+		}
+		return items[i].Key < items[j].Key
+	})
+
+	report := &Report{Bucket: bucket, Policy: p, Expired: make([]Expired, 0)}
+	var kept int64
+	full := false
+	for i, item := range items {
+		switch {
+		case i < p.KeepLast:
+		case p.MaxAge > 0 && now.Sub(item.ModifiedAt) > time.Duration(p.MaxAge):
+			item.Reason = "older than " + time.Duration(p.MaxAge).String()
+		case p.MaxFiles > 0 && report.Kept >= p.MaxFiles:
+			item.Reason = "beyond the newest " + plural(p.MaxFiles, p.Unit)
+		case p.MaxSize > 0 && (full || kept+item.Size > p.MaxSize):
+			// Once the size is exceeded every older item goes too, rather than keeping old items that happen to fit
+			full = true
+			item.Reason = "over the size limit"
+		}
+
+		if item.Reason == "" {
+			report.Kept++
+			kept += item.Size
+		} else {
+			report.Expired = append(report.Expired, item)
+			report.Freed += item.Size
+		}
+	}
+
+	return report, nil
+}
+
+// Apply removes the expired items of the report along with what is kept about them outside of the storage. Items that
+// fail to be removed are recorded in its Errors.
+func Apply(s storage.Storage, report *Report) {
+	for _, item := range report.Expired {
+		var err error
+		if item.Bucket {
+			err = s.DeleteBucket(item.Key, true)
+			if err == nil {
+				err = ForgetBucket(item.Key)
+			}
+		} else {
+			err = s.Delete(item.Key)
+			if err == nil {
+				err = forgetFile(item.Key, item.Size)
+			}
+		}
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			report.Errors = append(report.Errors, item.Key+": "+err.Error())
+		}
+	}
+}
+
+// ForgetBucket removes what is kept about a deleted bucket and the buckets nested below it outside of the storage:
+// metadata, previous versions, access lists, quotas and retention policies
+func ForgetBucket(bucket string) error {
+	if metadata.Default != nil {
+		err := metadata.Default.RemoveBucket(bucket)
+		if err != nil {
+			return err
+		}
+	}
+	if versions.Default != nil {
+		err := versions.Default.RemoveBucket(bucket)
+		if err != nil {
+			return err
+		}
+	}
+	if acl.Default != nil {
+		err := acl.Default.RemoveBucket(bucket)
+		if err != nil {
+			return err
+		}
+	}
+	if quota.Default != nil {
+		err := quota.Default.RemoveBucket(bucket)
+		if err != nil {
+			return err
+		}
+	}
+	if Default != nil {
+		return Default.RemoveBucket(bucket)
+	}
+	return nil
+}
+
+// forgetFile removes the metadata and previous versions of an expired file and gives its size back to the quotas
+func forgetFile(key string, size int64) error {
+	if metadata.Default != nil {
+		err := metadata.Default.Remove(key)
+		if err != nil {
+			return err
+		}
+	}
+	if versions.Default != nil {
+		err := versions.Default.Remove(key)
+		if err != nil {
+			return err
+		}
+	}
+	if quota.Default != nil {
+		quota.Default.Stored(key, -size)
+	}
+	return nil
+}
+
+// Sweep plans, and unless dryRun is set enforces, the policy of every bucket in the store
+func (s *Store) Sweep(st storage.Storage, dryRun bool, now time.Time) []*Report {
+	reports := make([]*Report, 0)
+	for _, bucket := range s.Buckets() {
+		p, ok := s.Get(bucket)
+		if !ok {
+			continue
+		}
+
+		report, err := Plan(st, bucket, p, now)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		} else if err != nil {
+			report = &Report{Bucket: bucket, Policy: p, Expired: make([]Expired, 0), Errors: []string{err.Error()}}
+		} else if !dryRun {
+			Apply(st, report)
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// Janitor enforces the policies of the store every interval until stop is closed
+func Janitor(s *Store, st storage.Storage, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			for _, report := range s.Sweep(st, false, now) {
+				if len(report.Expired) > 0 {
+					logrus.Infof("Retention: expired %d items (%d bytes) in bucket '%s'", len(report.Expired), report.Freed, report.Bucket)
+				}
+				for _, problem := range report.Errors {
+					logrus.Error("Retention: ", problem)
+				}
+			}
+		}
+	}
+}
+
+// plural formats a count of items
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return strconv.Itoa(n) + " " + unit + "s"
+}
@@ -0,0 +1,246 @@
+package retention
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tiger5226/filetransfer/acl"
+	"github.com/tiger5226/filetransfer/quota"
+	"github.com/tiger5226/filetransfer/storage"
+)
+
+var now = time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// testStorage stores files of the given size, each modified the given number of days before now
+func testStorage(t *testing.T, files map[string][2]int) (*storage.Local, func()) {
+	dir, err := ioutil.TempDir("", "ft-retention-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := storage.NewLocal(dir)
+	local.UID, local.GID = os.Getuid(), os.Getgid()
+
+	for key, f := range files {
+		_, err := local.Put(key, strings.NewReader(strings.Repeat("x", f[0])+key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		modified := now.Add(-time.Duration(f[1]) * 24 * time.Hour)
+		err = os.Chtimes(filepath.Join(dir, filepath.FromSlash(key)), modified, modified)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return local, func() { _ = os.RemoveAll(dir) }
+}
+
+func expired(r *Report) string {
+	keys := make([]string, 0)
+	for _, item := range r.Expired {
+		keys = append(keys, item.Key)
+	}
+	return strings.Join(keys, ",")
+}
+
+func TestPlanFiles(t *testing.T) {
+	local, cleanup := testStorage(t, map[string][2]int{
+		"logs/a": {0, 1},
+		"logs/b": {0, 5},
+		"logs/c": {0, 10},
+		"logs/d": {0, 20},
+		"other":  {0, 30},
+	})
+	defer cleanup()
+
+	day := Duration(24 * time.Hour)
+	cases := []struct {
+		policy   Policy
+		expected string
+	}{
+		{Policy{Unit: Files, MaxAge: 7 * day}, "logs/c,logs/d"},
+		{Policy{Unit: Files, MaxAge: 7 * day, KeepLast: 3}, "logs/d"},
+		{Policy{Unit: Files, MaxFiles: 1}, "logs/b,logs/c,logs/d"},
+		{Policy{Unit: Files, MaxSize: 13}, "logs/c,logs/d"},
+		{Policy{Unit: Files, MaxSize: 1, KeepLast: 1}, "logs/b,logs/c,logs/d"},
+		{Policy{Unit: Files, MaxAge: 30 * day}, ""},
+	}
+
+	for _, c := range cases {
+		report, err := Plan(local, "logs", c.policy, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expired(report) != c.expected {
+			t.Errorf("%+v expired %s, expected %s", c.policy, expired(report), c.expected)
+		}
+		if report.Kept+len(report.Expired) != 4 {
+			t.Errorf("%+v counted %d kept and %d expired files", c.policy, report.Kept, len(report.Expired))
+		}
+	}
+}
+
+func TestPlanBuckets(t *testing.T) {
+	local, cleanup := testStorage(t, map[string][2]int{
+		"nightly/1/app":     {10, 9},
+		"nightly/1/lib/x":   {10, 9},
+		"nightly/2/app":     {10, 6},
+		"nightly/2/lib/x":   {10, 2},
+		"nightly/3/app":     {10, 1},
+		"nightly/readme.md": {10, 30},
+	})
+	defer cleanup()
+
+	report, err := Plan(local, "nightly", Policy{Unit: Buckets, MaxAge: Duration(5 * 24 * time.Hour)}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired(report) != "nightly/1" || !report.Expired[0].Bucket || report.Freed != int64(2*10+len("nightly/1/app")+len("nightly/1/lib/x")) {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	Apply(local, report)
+	if len(report.Errors) > 0 {
+		t.Fatal(report.Errors)
+	}
+	if _, err := local.Stat("nightly/1"); err == nil {
+		t.Error("the expired bucket still exists")
+	}
+	if _, err := local.Stat("nightly/readme.md"); err != nil {
+		t.Error("a file next to the buckets was removed")
+	}
+}
+
+func TestStoreSweep(t *testing.T) {
+	local, cleanup := testStorage(t, map[string][2]int{"a/old": {0, 10}, "a/new": {0, 1}, "b/old": {0, 10}})
+	defer cleanup()
+
+	path := filepath.Join(local.Root, "retention.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("a", &Policy{Unit: Files}); err == nil {
+		t.Error("a policy without limits was accepted")
+	}
+	if err := store.Set("a", &Policy{Unit: Files, MaxAge: Duration(7 * 24 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := reopened.Get("a"); !ok || time.Duration(p.MaxAge) != 7*24*time.Hour {
+		t.Errorf("the policy was not persisted: %+v", p)
+	}
+
+	reports := reopened.Sweep(local, true, now)
+	if len(reports) != 1 || expired(reports[0]) != "a/old" {
+		t.Fatalf("unexpected dry run %+v", reports)
+	}
+	if _, err := local.Stat("a/old"); err != nil {
+		t.Error("a dry run removed a file")
+	}
+
+	reopened.Sweep(local, false, now)
+	if _, err := local.Stat("a/old"); err == nil {
+		t.Error("the expired file was kept")
+	}
+	if _, err := local.Stat("b/old"); err != nil {
+		t.Error("a bucket without policy was swept")
+	}
+}
+
+func TestSweepDuplicateContents(t *testing.T) {
+	local, cleanup := testStorage(t, map[string][2]int{"a/old": {0, 10}, "a/new": {0, 1}})
+	defer cleanup()
+
+	// The same contents stored again elsewhere share the blob of the old file, but not its age
+	if _, err := local.Put("mirror/old", strings.NewReader("a/old")); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := local.Stat("a/old"); err != nil || !info.ModifiedAt.Equal(now.Add(-10*24*time.Hour)) {
+		t.Fatalf("storing the contents again changed the old file: %+v, %v", info, err)
+	}
+
+	store, err := Open(filepath.Join(local.Root, "retention.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("a", &Policy{Unit: Files, MaxAge: Duration(7 * 24 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	reports := store.Sweep(local, false, now)
+	if len(reports) != 1 || expired(reports[0]) != "a/old" {
+		t.Fatalf("unexpected sweep %+v", reports)
+	}
+	if _, err := local.Stat("a/old"); err == nil {
+		t.Error("the expired file was kept")
+	}
+	if _, err := local.Stat("mirror/old"); err != nil {
+		t.Errorf("the copy in another bucket was removed: %v", err)
+	}
+}
+
+func TestApplyForgetsBuckets(t *testing.T) {
+	local, cleanup := testStorage(t, map[string][2]int{"builds/1/app": {0, 10}, "builds/2/app": {0, 1}})
+	defer cleanup()
+
+	var err error
+	previous, previousACL, previousQuota := Default, acl.Default, quota.Default
+	defer func() { Default, acl.Default, quota.Default = previous, previousACL, previousQuota }()
+	Default, err = Open(filepath.Join(local.Root, "retention.json"))
+	if err == nil {
+		acl.Default, err = acl.Open(filepath.Join(local.Root, "acl.json"))
+	}
+	if err == nil {
+		quota.Default, err = quota.Open(filepath.Join(local.Root, "quota.json"))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limit := int64(100)
+	for _, bucket := range []string{"builds/1", "builds/2"} {
+		if err := acl.Default.Grant(bucket, "ci", []acl.Permission{acl.Admin}); err != nil {
+			t.Fatal(err)
+		}
+		if err := quota.Default.SetBucket(bucket, &limit); err != nil {
+			t.Fatal(err)
+		}
+		if err := Default.Set(bucket, &Policy{Unit: Files, MaxFiles: 5}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Default.Set("builds", &Policy{Unit: Buckets, MaxAge: Duration(7 * 24 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Plan(local, "builds", Policy{Unit: Buckets, MaxAge: Duration(7 * 24 * time.Hour)}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Apply(local, report)
+	if len(report.Errors) > 0 || expired(report) != "builds/1" {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if governing, _ := acl.Default.Rules("builds/1"); governing != "" {
+		t.Errorf("the access list of the expired bucket was kept: %s", governing)
+	}
+	if quotas := quota.Default.Bucket("builds/1"); len(quotas) != 0 {
+		t.Errorf("the quota of the expired bucket was kept: %v", quotas)
+	}
+	if _, ok := Default.Get("builds/1"); ok {
+		t.Error("the retention policy of the expired bucket was kept")
+	}
+	if governing, _ := acl.Default.Rules("builds/2"); governing != "builds/2" || len(quota.Default.Bucket("builds/2")) == 0 {
+		t.Error("the side entries of the kept bucket were removed")
+	}
+	if _, ok := Default.Get("builds/2"); !ok {
+		t.Error("the side entries of the kept bucket were removed")
+	}
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tiger5226/filetransfer/util"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+// blobDir holds the contents of every file stored by the local backend exactly once, named after their SHA-256
+// checksum. Files in the buckets are hard links to these blobs, so identical uploads share their disk space and a
+// blob is removed once no bucket links to it anymore.
+const blobDir = ".blobs"
+
+// tmpPrefix starts the names of the files in the blob store that are still being written
+const tmpPrefix = "tmp-"
+
+// fileID identifies a file on disk independent of the names linking to it
+type fileID struct {
+	dev, ino uint64
+}
+
+// statID returns the identity of the file and the number of names linking to it
+func statID(stat os.FileInfo) (fileID, uint64, bool) {
+	sys, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, 0, false
+	}
+	return fileID{uint64(sys.Dev), uint64(sys.Ino)}, uint64(sys.Nlink), true
+}
+
+// blobPath returns where the blob with the given checksum is stored
+func (l *Local) blobPath(sum string) string {
+	return filepath.Join(l.Root, blobDir, sum[:2], sum)
+}
+
+// storeBlob moves a fully written temporary file into the blob store, unless a blob with the same checksum exists
+// already, and links the blob to the target. The caller must hold l.blobs.
+func (l *Local) storeBlob(tmpPath, sum, target string, overwrite bool) error {
+	blob := l.blobPath(sum)
+	var modified time.Time
+	_, err := os.Stat(blob)
+	if err == nil {
+		_ = os.Remove(tmpPath)
+		// The blob is shared, so the time of this file is kept apart rather than changing it for every other file
+		modified = time.Now()
+	} else if os.IsNotExist(err) {
+		err = l.makeBucket(filepath.Dir(blob))
+		if err != nil {
+			return err
+		}
+		err = os.Rename(tmpPath, blob)
+		if err != nil {
+			return errors.Err(err)
+		}
+		err = util.SyncDir(filepath.Dir(blob))
+		if err != nil {
+			return err
+		}
+	} else {
+		return errors.Err(err)
+	}
+
+	stat, err := os.Stat(blob)
+	if err != nil {
+		return errors.Err(err)
+	}
+	if id, _, ok := statID(stat); ok && l.index != nil {
+		l.index[id] = sum
+	}
+
+	return l.linkBlob(blob, target, overwrite, modified)
+}
+
+// linkBlob makes the target a link to the blob, modified at the given time or, for a zero time, when the blob was
+// written. Replacing an existing target goes through a hidden link that is renamed into place, so readers see either
+// the old or the new contents. The caller must hold l.blobs.
+func (l *Local) linkBlob(blob, target string, overwrite bool, modified time.Time) error {
+	if !overwrite {
+		err := os.Link(blob, target)
+		if os.IsExist(err) {
+			_ = l.releaseBlob(blob)
+			return errors.Err(ErrExists)
+		} else if err != nil {
+			return errors.Err(err)
+		}
+		err = util.SyncDir(filepath.Dir(target))
+		if err != nil {
+			return err
+		}
+		return l.setModified(target, modified)
+	}
+
+	tmpLink := filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+"."+strconv.FormatInt(time.Now().UnixNano(), 36))
+	err := os.Link(blob, tmpLink)
+	if err != nil {
+		return errors.Err(err)
+	}
+
+	previous, err := os.Stat(target)
+	if err != nil && !os.IsNotExist(err) {
+		_ = os.Remove(tmpLink)
+		return errors.Err(err)
+	}
+	err = os.Rename(tmpLink, target)
+	if err != nil {
+		_ = os.Remove(tmpLink)
+		return errors.Err(err)
+	}
+	err = util.SyncDir(filepath.Dir(target))
+	if err == nil {
+		err = l.setModified(target, modified)
+	}
+	if err != nil {
+		return err
+	}
+	if previous != nil {
+		return l.release(previous)
+	}
+	return nil
+}
+
+// checksum returns the SHA-256 checksum of a file in a bucket, or an empty string for files stored before
+// deduplication was introduced
+func (l *Local) checksum(stat os.FileInfo) string {
+	id, _, ok := statID(stat)
+	if !ok || stat.IsDir() {
+		return ""
+	}
+
+	l.blobs.Lock()
+	defer l.blobs.Unlock()
+	err := l.loadIndex()
+	if err != nil {
+		return ""
+	}
+	return l.index[id]
+}
+
+// release removes the blob of a file that was unlinked from its bucket if nothing links to it anymore. The caller
+// must hold l.blobs.
+func (l *Local) release(stat os.FileInfo) error {
+	id, _, ok := statID(stat)
+	if !ok {
+		return nil
+	}
+	err := l.loadIndex()
+	if err != nil {
+		return err
+	}
+	sum, ok := l.index[id]
+	if !ok {
+		return nil
+	}
+	return l.releaseBlob(l.blobPath(sum))
+}
+
+// releaseBlob removes the blob if the blob store holds the only link to it. The caller must hold l.blobs.
+func (l *Local) releaseBlob(blob string) error {
+	stat, err := os.Stat(blob)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Err(err)
+	}
+
+	id, links, ok := statID(stat)
+	if !ok || links > 1 {
+		return nil
+	}
+	if l.index != nil {
+		delete(l.index, id)
+	}
+	return errors.Err(os.Remove(blob))
+}
+
+// collect removes every blob no bucket links to anymore, after whole buckets were deleted. The caller must hold
+// l.blobs.
+func (l *Local) collect() error {
+	err := l.loadIndex()
+	if err != nil {
+		return err
+	}
+	for _, sum := range l.index {
+		err = l.releaseBlob(l.blobPath(sum))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Recover cleans up after a crash and should run before the storage is used. It removes the temporary files of
+// writes that never completed, including those in the staging directory, the hidden links of replacements that were
+// not renamed into place, the blobs nothing links to as a result and the modification times of files that are gone.
+// It returns the number of temporary files removed.
+func (l *Local) Recover() (int, error) {
+	l.blobs.Lock()
+	defer l.blobs.Unlock()
+
+	removed, err := ClearStaging(filepath.Join(l.Root, StagingDirName))
+	if err != nil {
+		return removed, err
+	}
+	root := filepath.Join(l.Root, blobDir)
+	err = filepath.Walk(l.Root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == l.Root {
+				return nil
+			}
+			return err
+		}
+		dir, name := filepath.Split(p)
+		switch {
+		case info.IsDir() && p != l.Root && p != root && strings.HasPrefix(name, "."):
+			// Other hidden directories, such as those of resumable uploads, are not the storage's business
+			return filepath.SkipDir
+		case info.IsDir():
+			return nil
+		case filepath.Clean(dir) == root && strings.HasPrefix(name, tmpPrefix), isTempLink(name):
+			removed++
+			return os.Remove(p)
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, errors.Err(err)
+	}
+	err = l.dropModified(l.Root, true)
+	if err != nil {
+		return removed, err
+	}
+	return removed, l.collect()
+}
+
+// isTempLink reports whether the name is one of the hidden links linkBlob renames into place. Clients cannot store
+// hidden files, so nothing else in a bucket looks like this.
+func isTempLink(name string) bool {
+	i := strings.LastIndex(name, ".")
+	if !strings.HasPrefix(name, ".") || i <= 1 {
+		return false
+	}
+	_, err := strconv.ParseInt(name[i+1:], 36, 64)
+	return err == nil
+}
+
+// loadIndex maps the identity of every blob to its checksum, so the checksum of a file in a bucket can be found
+// from its own identity. The index is built once and kept up to date afterwards. The caller must hold l.blobs.
+func (l *Local) loadIndex() error {
+	if l.index != nil {
+		return nil
+	}
+
+	index := map[fileID]string{}
+	dirs, err := ioutil.ReadDir(filepath.Join(l.Root, blobDir))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Err(err)
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		blobs, err := ioutil.ReadDir(filepath.Join(l.Root, blobDir, dir.Name()))
+		if err != nil {
+			return errors.Err(err)
+		}
+		for _, blob := range blobs {
+			if id, _, ok := statID(blob); ok {
+				index[id] = blob.Name()
+			}
+		}
+	}
+
+	l.index = index
+	return nil
+}
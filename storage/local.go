@@ -0,0 +1,486 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Local stores buckets as directories on the local filesystem. File contents are deduplicated through a content
+// addressed blob store below the root.
+type Local struct {
+	Root string
+	UID  int
+	GID  int
+
+	blobs    sync.Mutex
+	index    map[fileID]string
+	modified map[string]time.Time
+}
+
+// NewLocal creates a local disk backend rooted at the given directory. Files are owned by nobody:nogroup.
+func NewLocal(root string) *Local {
+	return &Local{Root: root, UID: 65534, GID: 65534}
+}
+
+// Put streams the reader into the blob store while hashing it and links the blob into the bucket once complete
+func (l *Local) Put(key string, r io.Reader) (int64, error) {
+	_, target, err := l.resolve(key, false)
+	if err != nil {
+		return 0, err
+	}
+	return l.write(target, r, true)
+}
+
+// Get opens the file stored under the key
+func (l *Local) Get(key string) (Object, *ObjectInfo, error) {
+	key, p, err := l.resolve(key, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, nil, errors.Err(ErrNotFound)
+	} else if err != nil {
+		return nil, nil, errors.Err(err)
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, errors.Err(err)
+	}
+	if stat.IsDir() {
+		_ = file.Close()
+		return nil, nil, errors.Err(ErrNotFound)
+	}
+
+	return file, l.info(key, stat), nil
+}
+
+// Stat returns the information about the file or directory stored under the key
+func (l *Local) Stat(key string) (*ObjectInfo, error) {
+	key, p, err := l.resolve(key, true)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return nil, errors.Err(ErrNotFound)
+	} else if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	return l.info(key, stat), nil
+}
+
+// List walks the directory tree below the prefix. Hidden entries hold in-flight uploads and are skipped.
+func (l *Local) List(prefix string) ([]*ObjectInfo, error) {
+	_, root, err := l.resolve(prefix, true)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]*ObjectInfo, 0)
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == root {
+				return nil
+			}
+			return err
+		}
+		if p == root {
+			return nil
+		}
+
+		if strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.Root, p)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, l.info(filepath.ToSlash(rel), info))
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+// Walk visits the directory tree below the prefix in bucket order. Hidden entries hold in-flight uploads and are
+// skipped.
+func (l *Local) Walk(prefix string, visit func(*ObjectInfo) error) error {
+	_, root, err := l.resolve(prefix, true)
+	if err != nil {
+		return err
+	}
+
+	err = l.walkDir(root, visit)
+	if errors.Is(err, StopWalk) {
+		return nil
+	}
+	return err
+}
+
+// walkDir visits the files of the directory, then each directory in it followed by its contents
+func (l *Local) walkDir(dir string, visit func(*ObjectInfo) error) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		// Nothing has been stored there yet, or it was removed while walking
+		return nil
+	} else if err != nil {
+		return errors.Err(err)
+	}
+
+	for _, dirs := range []bool{false, true} {
+		for _, entry := range entries {
+			if entry.IsDir() != dirs || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			p := filepath.Join(dir, entry.Name())
+			rel, err := filepath.Rel(l.Root, p)
+			if err != nil {
+				return errors.Err(err)
+			}
+
+			err = visit(l.info(filepath.ToSlash(rel), entry))
+			if errors.Is(err, SkipBucket) {
+				if dirs {
+					continue
+				}
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if dirs {
+				err = l.walkDir(p, visit)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Delete removes the file stored under the key. Directories are removed with DeleteBucket.
+func (l *Local) Delete(key string) error {
+	_, p, err := l.resolve(key, false)
+	if err != nil {
+		return err
+	}
+
+	stat, err := os.Stat(p)
+	if os.IsNotExist(err) || err == nil && stat.IsDir() {
+		return errors.Err(ErrNotFound)
+	} else if err != nil {
+		return errors.Err(err)
+	}
+
+	l.blobs.Lock()
+	defer l.blobs.Unlock()
+	err = os.Remove(p)
+	if err != nil {
+		return errors.Err(err)
+	}
+	err = l.setModified(p, time.Time{})
+	if err != nil {
+		return err
+	}
+	return l.release(stat)
+}
+
+// DeleteBucket removes the directory of a bucket. Hidden entries such as unfinished uploads do not count as files.
+func (l *Local) DeleteBucket(bucket string, recursive bool) error {
+	bucket, p, err := l.resolve(bucket, true)
+	if err != nil {
+		return err
+	}
+	if bucket == "" {
+		return errors.Err(PathError{bucket, "the root bucket cannot be deleted"})
+	}
+
+	stat, err := os.Stat(p)
+	if os.IsNotExist(err) || err == nil && !stat.IsDir() {
+		return errors.Err(ErrNotFound)
+	} else if err != nil {
+		return errors.Err(err)
+	}
+
+	if !recursive {
+		infos, err := l.List(bucket)
+		if err != nil {
+			return err
+		}
+		if len(infos) > 0 {
+			return errors.Err(ErrNotEmpty)
+		}
+	}
+
+	l.blobs.Lock()
+	defer l.blobs.Unlock()
+	err = os.RemoveAll(p)
+	if err != nil {
+		return errors.Err(err)
+	}
+	err = l.dropModified(p, false)
+	if err != nil {
+		return err
+	}
+	return l.collect()
+}
+
+// Move renames the file within the storage root, so the object is never seen half written
+func (l *Local) Move(src, dst string, overwrite bool) error {
+	from, to, err := l.resolvePair(src, dst, overwrite)
+	if err != nil {
+		return err
+	}
+
+	err = l.makeBucket(filepath.Dir(to))
+	if err != nil {
+		return err
+	}
+	if overwrite {
+		l.blobs.Lock()
+		defer l.blobs.Unlock()
+		previous, err := os.Stat(to)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Err(err)
+		}
+		err = os.Rename(from, to)
+		if err != nil {
+			return errors.Err(err)
+		}
+		err = l.moveModified(from, to)
+		if err != nil || previous == nil {
+			return err
+		}
+		return l.release(previous)
+	}
+
+	// A hard link fails if the destination appeared in the meantime, where a rename would silently replace it
+	err = os.Link(from, to)
+	if os.IsExist(err) {
+		return errors.Err(ErrExists)
+	} else if err != nil {
+		return errors.Err(err)
+	}
+	err = os.Remove(from)
+	if err != nil {
+		return errors.Err(err)
+	}
+	l.blobs.Lock()
+	defer l.blobs.Unlock()
+	return l.moveModified(from, to)
+}
+
+// Copy links the blob of the file into the destination, so no contents are duplicated. Files stored before
+// deduplication are written to the blob store first, the same way Put does.
+func (l *Local) Copy(src, dst string, overwrite bool) error {
+	from, to, err := l.resolvePair(src, dst, overwrite)
+	if err != nil {
+		return err
+	}
+
+	stat, err := os.Stat(from)
+	if err != nil {
+		return errors.Err(err)
+	}
+	if sum := l.checksum(stat); sum != "" {
+		err = l.makeBucket(filepath.Dir(to))
+		if err != nil {
+			return err
+		}
+		l.blobs.Lock()
+		defer l.blobs.Unlock()
+		return l.linkBlob(l.blobPath(sum), to, overwrite, time.Now())
+	}
+
+	file, err := os.Open(from)
+	if err != nil {
+		return errors.Err(err)
+	}
+	defer func() { _ = file.Close() }()
+
+	_, err = l.write(to, file, overwrite)
+	return err
+}
+
+// write streams the reader into a temporary file in the blob store while hashing it, then stores it as a blob and
+// links it to the target. The contents are synced to disk before they are linked, so a crash never leaves a
+// truncated file in a bucket.
+func (l *Local) write(target string, r io.Reader, overwrite bool) (int64, error) {
+	err := l.makeBucket(filepath.Dir(target))
+	if err != nil {
+		return 0, err
+	}
+	blobs := filepath.Join(l.Root, blobDir)
+	err = l.makeBucket(blobs)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp, err := ioutil.TempFile(blobs, tmpPrefix)
+	if err != nil {
+		return 0, errors.Err(err)
+	}
+	tmpPath := tmp.Name()
+
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err == nil {
+		err = tmp.Chmod(0755)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chown(tmpPath, l.UID, l.GID)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return written, errors.Err(err)
+	}
+
+	l.blobs.Lock()
+	defer l.blobs.Unlock()
+	err = l.storeBlob(tmpPath, hex.EncodeToString(hash.Sum(nil)), target, overwrite)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return written, err
+	}
+
+	return written, nil
+}
+
+// makeBucket creates the directory of a bucket if it does not exist yet
+func (l *Local) makeBucket(bucketDir string) error {
+	// Check if the directory exists!  If not, then we need to create it now
+	_, err := os.Stat(bucketDir)
+	if os.IsNotExist(err) {
+		logrus.Debug("Server: Unable to find directory, '", bucketDir, "'.  Creating now...")
+		err := os.MkdirAll(bucketDir, 0755) // http://permissions-calculator.org/decode/0755/
+		if err != nil {
+			return errors.Err(err)
+		}
+
+		err = os.Chown(bucketDir, l.UID, l.GID)
+		if err != nil {
+			return errors.Err(err)
+		}
+	} else if err != nil {
+		return errors.Err(err)
+	}
+	return nil
+}
+
+// resolvePair resolves the source and destination of a move or copy. The source has to be a file and the
+// destination must not be a directory, or an existing file unless overwrite is set.
+func (l *Local) resolvePair(src, dst string, overwrite bool) (string, string, error) {
+	src, from, err := l.resolve(src, false)
+	if err != nil {
+		return "", "", err
+	}
+	dst, to, err := l.resolve(dst, false)
+	if err != nil {
+		return "", "", err
+	}
+	if src == dst {
+		return "", "", errors.Err(PathError{dst, "the source and destination are the same"})
+	}
+
+	stat, err := os.Stat(from)
+	if os.IsNotExist(err) || err == nil && stat.IsDir() {
+		return "", "", errors.Err(ErrNotFound)
+	} else if err != nil {
+		return "", "", errors.Err(err)
+	}
+
+	stat, err = os.Stat(to)
+	if err == nil && (stat.IsDir() || !overwrite) {
+		return "", "", errors.Err(ErrExists)
+	} else if err != nil && !os.IsNotExist(err) {
+		return "", "", errors.Err(err)
+	}
+
+	return from, to, nil
+}
+
+// resolve converts a key into its canonical form and its path on disk. The deepest existing part of the path is
+// checked after following symlinks, so neither "../" nor a link can lead outside of the root.
+func (l *Local) resolve(key string, allowRoot bool) (string, string, error) {
+	clean, err := CleanBucket(key)
+	if err == nil && clean == "" && !allowRoot {
+		clean, err = CleanKey(key)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	p := filepath.Join(l.Root, filepath.FromSlash(clean))
+	root, err := filepath.EvalSymlinks(l.Root)
+	if os.IsNotExist(err) {
+		// Nothing has been stored yet, so there is no link to follow either
+		return clean, p, nil
+	} else if err != nil {
+		return "", "", errors.Err(err)
+	}
+
+	for existing := p; existing != filepath.Clean(l.Root); existing = filepath.Dir(existing) {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", "", errors.Err(err)
+		}
+		if !strings.HasPrefix(resolved, root+string(os.PathSeparator)) {
+			return "", "", errors.Err(PathError{key, "the path leaves the storage root"})
+		}
+		break
+	}
+
+	return clean, p, nil
+}
+
+// info converts the file information into an ObjectInfo. Files with a known checksum use it as their ETag.
+func (l *Local) info(key string, stat os.FileInfo) *ObjectInfo {
+	modified := l.modifiedAt(key, stat)
+	info := &ObjectInfo{
+		Key:        key,
+		Size:       stat.Size(),
+		ModifiedAt: modified,
+		ETag:       `"` + strconv.FormatInt(modified.UnixNano(), 16) + "-" + strconv.FormatInt(stat.Size(), 16) + `"`,
+		IsDir:      stat.IsDir(),
+		Checksum:   l.checksum(stat),
+	}
+	if info.Checksum != "" {
+		info.ETag = `"` + info.Checksum + `"`
+	}
+	return info
+}
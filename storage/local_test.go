@@ -0,0 +1,446 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+func newTestLocal(t *testing.T) (*Local, func()) {
+	dir, err := ioutil.TempDir("", "ft-local-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := NewLocal(dir)
+	l.UID, l.GID = os.Getuid(), os.Getgid()
+	return l, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestLocalPutGet(t *testing.T) {
+	l, cleanup := newTestLocal(t)
+	defer cleanup()
+
+	n, err := l.Put("builds/nightly/app.tar", strings.NewReader("contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 8 {
+		t.Errorf("Put wrote %d bytes, expected 8", n)
+	}
+
+	obj, info, err := l.Get("builds/nightly/app.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	data, _ := ioutil.ReadAll(obj)
+	if string(data) != "contents" {
+		t.Errorf("Get returned %q", data)
+	}
+	if info.Name() != "app.tar" || info.Bucket() != "builds/nightly" {
+		t.Errorf("unexpected info %+v", info)
+	}
+
+	// No temporary files may be left behind
+	entries, _ := ioutil.ReadDir(filepath.Join(l.Root, "builds", "nightly"))
+	if len(entries) != 1 {
+		t.Errorf("expected a single file in the bucket, found %d", len(entries))
+	}
+}
+
+func TestLocalListSkipsHidden(t *testing.T) {
+	l, cleanup := newTestLocal(t)
+	defer cleanup()
+
+	for _, key := range []string{"a/one", "a/b/two", "c/three"} {
+		if _, err := l.Put(key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(l.Root, "a", ".uploads", "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := l.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, info := range infos {
+		keys = append(keys, info.Key)
+	}
+	expected := "a,a/b,a/b/two,a/one,c,c/three"
+	if strings.Join(keys, ",") != expected {
+		t.Errorf("List returned %v, expected %s", keys, expected)
+	}
+
+	infos, err = l.List("a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Key != "a/b/two" {
+		t.Errorf("List with prefix returned %v", infos)
+	}
+}
+
+func TestLocalWalk(t *testing.T) {
+	l, cleanup := newTestLocal(t)
+	defer cleanup()
+
+	for _, key := range []string{"a/one", "a/b/two", "a/b/c/four", "a-z/five", "c/three", "root"} {
+		if _, err := l.Put(key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(l.Root, "a", ".uploads", "x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	walk := func(prefix string, visit func(*ObjectInfo) error) string {
+		var keys []string
+		err := l.Walk(prefix, func(info *ObjectInfo) error {
+			keys = append(keys, info.Key)
+			return visit(info)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(keys, ",")
+	}
+	all := func(*ObjectInfo) error { return nil }
+
+	if keys := walk("", all); keys != "root,a,a/one,a/b,a/b/two,a/b/c,a/b/c/four,a-z,a-z/five,c,c/three" {
+		t.Errorf("Walk visited %s", keys)
+	}
+	if keys := walk("a/b", all); keys != "a/b/two,a/b/c,a/b/c/four" {
+		t.Errorf("Walk with prefix visited %s", keys)
+	}
+	if keys := walk("missing", all); keys != "" {
+		t.Errorf("Walk of a missing bucket visited %s", keys)
+	}
+
+	skip := func(info *ObjectInfo) error {
+		switch info.Key {
+		case "a/b", "a-z/five":
+			return SkipBucket
+		case "c":
+			return StopWalk
+		}
+		return nil
+	}
+	if keys := walk("", skip); keys != "root,a,a/one,a/b,a-z,a-z/five,c" {
+		t.Errorf("Walk skipping buckets visited %s", keys)
+	}
+}
+
+func TestLocalNotFound(t *testing.T) {
+	l, cleanup := newTestLocal(t)
+	defer cleanup()
+
+	if _, _, err := l.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get: expected ErrNotFound, got %v", err)
+	}
+	if _, err := l.Stat("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat: expected ErrNotFound, got %v", err)
+	}
+	if err := l.Delete("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestLocalRejectsSymlinkEscape(t *testing.T) {
+	l, cleanup := newTestLocal(t)
+	defer cleanup()
+
+	outside, err := ioutil.TempDir("", "ft-outside-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(outside, filepath.Join(l.Root, "linked")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(l.Root, "secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := l.Get("linked/secret"); !IsInvalidPath(err) {
+		t.Errorf("Get through a linked directory: expected a PathError, got %v", err)
+	}
+	if _, _, err := l.Get("secret"); !IsInvalidPath(err) {
+		t.Errorf("Get of a linked file: expected a PathError, got %v", err)
+	}
+	if _, err := l.Put("linked/new/file", strings.NewReader("x")); !IsInvalidPath(err) {
+		t.Errorf("Put through a linked directory: expected a PathError, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new")); !os.IsNotExist(err) {
+		t.Errorf("Put created a directory outside of the root")
+	}
+	if _, err := l.List("linked"); !IsInvalidPath(err) {
+		t.Errorf("List of a linked directory: expected a PathError, got %v", err)
+	}
+}
+
+// testMoveCopyDelete exercises the semantics every backend has to share for moving, copying and deleting
+func testMoveCopyDelete(t *testing.T, s Storage) {
+	for _, key := range []string{"a/one", "a/two", "a/sub/three", "b/four"} {
+		if _, err := s.Put(key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(key string) string {
+		obj, _, err := s.Get(key)
+		if err != nil {
+			return err.Error()
+		}
+		defer obj.Close()
+		data, _ := ioutil.ReadAll(obj)
+		return string(data)
+	}
+
+	if err := s.Copy("a/one", "c/one", false); err != nil {
+		t.Fatal(err)
+	}
+	if read("a/one") != "a/one" || read("c/one") != "a/one" {
+		t.Errorf("copy left %q and %q", read("a/one"), read("c/one"))
+	}
+	if err := s.Copy("a/two", "c/one", false); !errors.Is(err, ErrExists) {
+		t.Errorf("copy over an existing file: expected ErrExists, got %v", err)
+	}
+	if err := s.Copy("a/two", "c/one", true); err != nil || read("c/one") != "a/two" {
+		t.Errorf("copy with overwrite: %v, contents %q", err, read("c/one"))
+	}
+
+	if err := s.Move("a/one", "b/one", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("a/one"); !errors.Is(err, ErrNotFound) || read("b/one") != "a/one" {
+		t.Errorf("move left the source behind or lost the contents: %v, %q", err, read("b/one"))
+	}
+	if err := s.Move("a/two", "b/four", false); !errors.Is(err, ErrExists) {
+		t.Errorf("move over an existing file: expected ErrExists, got %v", err)
+	}
+	if err := s.Move("a/missing", "b/missing", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("move of a missing file: expected ErrNotFound, got %v", err)
+	}
+	if err := s.Move("a/two", "a//two", true); !IsInvalidPath(err) {
+		t.Errorf("move onto itself: expected an invalid path, got %v", err)
+	}
+	if err := s.Move("a/two", "../two", true); !IsInvalidPath(err) {
+		t.Errorf("move outside of the root: expected an invalid path, got %v", err)
+	}
+
+	if err := s.DeleteBucket("a", false); !errors.Is(err, ErrNotEmpty) {
+		t.Errorf("delete of a full bucket: expected ErrNotEmpty, got %v", err)
+	}
+	if err := s.DeleteBucket("a", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("a/sub/three"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("recursive delete left files behind: %v", err)
+	}
+	if err := s.DeleteBucket("a", true); !errors.Is(err, ErrNotFound) {
+		t.Errorf("delete of a missing bucket: expected ErrNotFound, got %v", err)
+	}
+	if err := s.DeleteBucket("/", true); !IsInvalidPath(err) {
+		t.Errorf("delete of the root: expected an invalid path, got %v", err)
+	}
+}
+
+func TestLocalMoveCopyDelete(t *testing.T) {
+	l, cleanup := newTestLocal(t)
+	defer cleanup()
+	testMoveCopyDelete(t, l)
+
+	// Emptied buckets can be removed without deleting recursively
+	if err := l.Delete("b/one"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Delete("b/four"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.DeleteBucket("b", false); err != nil {
+		t.Errorf("delete of an empty bucket: %v", err)
+	}
+	if err := l.Delete("c"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete of a directory: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestLocalDeduplicates(t *testing.T) {
+	l, cleanup := newTestLocal(t)
+	defer cleanup()
+
+	blobs := func() int {
+		count := 0
+		_ = filepath.Walk(filepath.Join(l.Root, blobDir), func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() && info.Name() != modifiedFile {
+				count++
+			}
+			return nil
+		})
+		return count
+	}
+	const sum = "d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592"
+
+	for _, key := range []string{"a/deps.tar", "b/deps.tar", "b/sub/copy.tar"} {
+		if _, err := l.Put(key, strings.NewReader("The quick brown fox jumps over the lazy dog")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if blobs() != 1 {
+		t.Fatalf("expected identical uploads to share one blob, found %d", blobs())
+	}
+	info, err := l.Stat("b/deps.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Checksum != sum || info.ETag != `"`+sum+`"` {
+		t.Errorf("unexpected checksum %q and ETag %s", info.Checksum, info.ETag)
+	}
+
+	// A fresh store has to find the checksums of existing blobs again
+	reopened := NewLocal(l.Root)
+	if info, err := reopened.Stat("a/deps.tar"); err != nil || info.Checksum != sum {
+		t.Errorf("reopened store returned %+v, %v", info, err)
+	}
+
+	if err := l.Copy("a/deps.tar", "c/deps.tar", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Put("a/deps.tar", strings.NewReader("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if blobs() != 2 {
+		t.Errorf("expected a second blob after changing a file, found %d", blobs())
+	}
+
+	for _, key := range []string{"b/deps.tar", "c/deps.tar"} {
+		if err := l.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if blobs() != 2 {
+		t.Errorf("a blob still linked from b/sub was removed, found %d", blobs())
+	}
+	if err := l.DeleteBucket("b", true); err != nil {
+		t.Fatal(err)
+	}
+	if blobs() != 1 {
+		t.Errorf("expected the unreferenced blob to be removed, found %d", blobs())
+	}
+	if _, err := l.Put("a/deps.tar", strings.NewReader("replaced")); err != nil {
+		t.Fatal(err)
+	}
+	if blobs() != 1 {
+		t.Errorf("expected the replaced blob to be removed, found %d", blobs())
+	}
+}
+
+func TestLocalModifiedTimes(t *testing.T) {
+	l, cleanup := newTestLocal(t)
+	defer cleanup()
+
+	contents := "The quick brown fox jumps over the lazy dog"
+	if _, err := l.Put("a/deps.tar", strings.NewReader(contents)); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(filepath.Join(l.Root, "a", "deps.tar"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	// Storing the same contents elsewhere shares the blob but must not touch the existing file
+	before := time.Now()
+	if _, err := l.Put("b/deps.tar", strings.NewReader(contents)); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := l.Stat("a/deps.tar"); err != nil || !info.ModifiedAt.Equal(old) {
+		t.Errorf("the existing file was modified at %v, expected %v (%v)", info.ModifiedAt, old, err)
+	}
+	if info, err := NewLocal(l.Root).Stat("b/deps.tar"); err != nil || info.ModifiedAt.Before(before) {
+		t.Errorf("the new file was modified at %v, expected after %v (%v)", info.ModifiedAt, before, err)
+	}
+
+	if err := l.Move("b/deps.tar", "c/deps.tar", false); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := l.Stat("c/deps.tar"); err != nil || info.ModifiedAt.Before(before) {
+		t.Errorf("the moved file was modified at %v (%v)", info.ModifiedAt, err)
+	}
+	if err := os.Remove(filepath.Join(l.Root, "c", "deps.tar")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.modified) != 0 {
+		t.Errorf("the times of removed files were kept: %v", l.modified)
+	}
+}
+
+func TestLocalRecover(t *testing.T) {
+	l, cleanup := newTestLocal(t)
+	defer cleanup()
+
+	if _, err := l.Put("builds/app.tar", strings.NewReader("complete")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := l.Stat("builds/app.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// What a crash leaves behind: a blob being written, a blob linked nowhere yet, a staged upload and a replacement
+	// not renamed into place. Hidden directories of other users of the storage are left alone.
+	leftovers := []string{
+		filepath.Join(l.Root, blobDir, tmpPrefix+"123"),
+		filepath.Join(l.Root, blobDir, "ab", "ab"+strings.Repeat("0", 62)),
+		filepath.Join(l.Root, StagingDirName, "ft-held-123"),
+		filepath.Join(l.Root, "builds", ".app.tar.k2x8r1"),
+	}
+	for _, p := range leftovers[:3] {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte("trunc"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(l.blobPath(info.Checksum), leftovers[3]); err != nil {
+		t.Fatal(err)
+	}
+	session := filepath.Join(l.Root, "builds", ".uploads", "1", "0.part")
+	if err := os.MkdirAll(filepath.Dir(session), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(session, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := NewLocal(l.Root).Recover()
+	if err != nil || removed != 3 {
+		t.Errorf("Recover removed %d temporary files: %v", removed, err)
+	}
+	for _, p := range leftovers {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", p)
+		}
+	}
+	if _, err := os.Stat(session); err != nil {
+		t.Errorf("the upload session was touched: %v", err)
+	}
+	if infos, err := l.List("builds"); err != nil || len(infos) != 1 || infos[0].Checksum != info.Checksum {
+		t.Errorf("the complete file did not survive: %+v %v", infos, err)
+	}
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tiger5226/filetransfer/util"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+// modifiedFile keeps the modification times of files that were linked to a blob stored earlier. Hard links share a
+// single modification time, so the blob keeps the time it was first written and every later link has its own here.
+const modifiedFile = "modified.json"
+
+// modifiedPath returns where the modification times are kept
+func (l *Local) modifiedPath() string {
+	return filepath.Join(l.Root, blobDir, modifiedFile)
+}
+
+// loadModified reads the modification times once. The caller must hold l.blobs.
+func (l *Local) loadModified() error {
+	if l.modified != nil {
+		return nil
+	}
+
+	modified := map[string]time.Time{}
+	contents, err := ioutil.ReadFile(l.modifiedPath())
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Err(err)
+	}
+	if err == nil {
+		err = json.Unmarshal(contents, &modified)
+		if err != nil {
+			return errors.Prefix("unable to read modification times: ", err)
+		}
+	}
+
+	l.modified = modified
+	return nil
+}
+
+// saveModified writes the modification times to disk. The caller must hold l.blobs.
+func (l *Local) saveModified() error {
+	contents, err := json.MarshalIndent(l.modified, "", "  ")
+	if err != nil {
+		return errors.Err(err)
+	}
+	return util.WriteFileAtomic(l.modifiedPath(), contents, 0644)
+}
+
+// setModified records the modification time of the file at the path on disk, or forgets it for a zero time so the
+// time of the file itself applies. The caller must hold l.blobs.
+func (l *Local) setModified(p string, t time.Time) error {
+	err := l.loadModified()
+	if err != nil {
+		return err
+	}
+	key, ok := l.relative(p)
+	if !ok {
+		return nil
+	}
+
+	if t.IsZero() {
+		if _, ok := l.modified[key]; !ok {
+			return nil
+		}
+		delete(l.modified, key)
+	} else {
+		l.modified[key] = t
+	}
+	return l.saveModified()
+}
+
+// moveModified moves the modification time of a file along with it. The caller must hold l.blobs.
+func (l *Local) moveModified(from, to string) error {
+	err := l.loadModified()
+	if err != nil {
+		return err
+	}
+	src, ok := l.relative(from)
+	dst, ok2 := l.relative(to)
+	if !ok || !ok2 {
+		return nil
+	}
+
+	t, moved := l.modified[src]
+	_, replaced := l.modified[dst]
+	if !moved && !replaced {
+		return nil
+	}
+	delete(l.modified, src)
+	delete(l.modified, dst)
+	if moved {
+		l.modified[dst] = t
+	}
+	return l.saveModified()
+}
+
+// dropModified forgets the modification times of every file below the directory, after it was removed. With check
+// set only the times of files that no longer exist are forgotten. The caller must hold l.blobs.
+func (l *Local) dropModified(dir string, check bool) error {
+	err := l.loadModified()
+	if err != nil {
+		return err
+	}
+	prefix, ok := l.relative(dir)
+	if !ok {
+		return nil
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var dropped bool
+	for key := range l.modified {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if check {
+			if _, err := os.Lstat(filepath.Join(l.Root, filepath.FromSlash(key))); !os.IsNotExist(err) {
+				continue
+			}
+		}
+		delete(l.modified, key)
+		dropped = true
+	}
+	if !dropped {
+		return nil
+	}
+	return l.saveModified()
+}
+
+// modifiedAt returns the modification time of the file stored under the key
+func (l *Local) modifiedAt(key string, stat os.FileInfo) time.Time {
+	if stat.IsDir() {
+		return stat.ModTime()
+	}
+
+	l.blobs.Lock()
+	defer l.blobs.Unlock()
+	if l.loadModified() == nil {
+		if t, ok := l.modified[key]; ok {
+			return t
+		}
+	}
+	return stat.ModTime()
+}
+
+// relative returns the key of a path on disk, or false for paths outside of the root
+func (l *Local) relative(p string) (string, bool) {
+	rel, err := filepath.Rel(l.Root, p)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	if rel == "." {
+		return "", true
+	}
+	return filepath.ToSlash(rel), true
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"strings"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+// PathError is returned when a bucket or file name supplied by a client cannot be used as a storage key
+type PathError struct {
+	Path   string
+	Reason string
+}
+
+func (e PathError) Error() string {
+	return "invalid path '" + e.Path + "': " + e.Reason
+}
+
+// IsInvalidPath reports whether the error was caused by an unusable bucket or file name
+func IsInvalidPath(err error) bool {
+	_, ok := errors.Unwrap(err).(PathError)
+	return ok
+}
+
+// CleanKey canonicalises a client supplied key. Empty segments are dropped, while anything that could address
+// something outside of the storage root or one of the hidden entries used internally is rejected.
+func CleanKey(key string) (string, error) {
+	cleaned, err := CleanBucket(key)
+	if err != nil {
+		return "", err
+	}
+	if cleaned == "" {
+		return "", errors.Err(PathError{key, "a file name is required"})
+	}
+	return cleaned, nil
+}
+
+// CleanBucket canonicalises a client supplied bucket name the same way as CleanKey, but allows the root bucket
+func CleanBucket(bucket string) (string, error) {
+	segments := make([]string, 0)
+	for _, segment := range strings.Split(bucket, "/") {
+		switch {
+		case segment == "":
+			continue
+		case segment == "." || segment == "..":
+			return "", errors.Err(PathError{bucket, "relative segments are not allowed"})
+		case strings.HasPrefix(segment, "."):
+			return "", errors.Err(PathError{bucket, "names may not start with '.'"})
+		case strings.ContainsAny(segment, "\\:"):
+			return "", errors.Err(PathError{bucket, "names may not contain '\\' or ':'"})
+		case strings.IndexFunc(segment, isControl) >= 0:
+			return "", errors.Err(PathError{bucket, "names may not contain control characters"})
+		}
+		segments = append(segments, segment)
+	}
+
+	return strings.Join(segments, "/"), nil
+}
+
+// JoinKey builds a clean key from a bucket and a file name, which may itself contain directories
+func JoinKey(bucket, fileName string) (string, error) {
+	if bucket != "" {
+		fileName = bucket + "/" + fileName
+	}
+	return CleanKey(fileName)
+}
+
+// BucketOf returns the bucket portion of a key, or an empty string for keys at the root
+func BucketOf(key string) string {
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+// CompareBuckets orders buckets the way they appear in a tree: segment by segment, so a bucket is directly followed
+// by the buckets nested below it
+func CompareBuckets(a, b string) int {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if c := strings.Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
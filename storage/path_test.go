@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"testing"
+)
+
+func TestCleanKeyRejectsMaliciousInput(t *testing.T) {
+	inputs := []string{
+		"",
+		"/",
+		"..",
+		"../etc/passwd",
+		"../../../../etc/shadow",
+		"bucket/../../outside",
+		"bucket/..",
+		"./bucket/file",
+		"bucket/./file",
+		"..\\..\\windows\\win.ini",
+		"bucket\\..\\file",
+		"C:\\windows\\system32",
+		"c:file",
+		"bucket/.uploads/0123/session.json",
+		".hidden",
+		"bucket/.file.tmp",
+		"bucket/..file",
+		"bucket/fi\x00le",
+		"bucket/file\nname",
+		"bucket/\x7f",
+	}
+
+	for _, input := range inputs {
+		key, err := CleanKey(input)
+		if err == nil {
+			t.Errorf("CleanKey(%q) = %q, expected an error", input, key)
+			continue
+		}
+		if !IsInvalidPath(err) {
+			t.Errorf("CleanKey(%q) returned %v, expected a PathError", input, err)
+		}
+	}
+}
+
+func TestCleanKeyCanonicalises(t *testing.T) {
+	inputs := map[string]string{
+		"file":                   "file",
+		"bucket/file":            "bucket/file",
+		"/bucket/file":           "bucket/file",
+		"bucket//nested///file":  "bucket/nested/file",
+		"bucket/file/":           "bucket/file",
+		"bucket/file..":          "bucket/file..",
+		"bucket/%2e%2e/file":     "bucket/%2e%2e/file",
+		"release 1.0/app v2.tar": "release 1.0/app v2.tar",
+	}
+
+	for input, expected := range inputs {
+		key, err := CleanKey(input)
+		if err != nil {
+			t.Errorf("CleanKey(%q) returned %v", input, err)
+			continue
+		}
+		if key != expected {
+			t.Errorf("CleanKey(%q) = %q, expected %q", input, key, expected)
+		}
+	}
+}
+
+func TestCleanBucketAllowsRoot(t *testing.T) {
+	for _, input := range []string{"", "/", "//"} {
+		bucket, err := CleanBucket(input)
+		if err != nil || bucket != "" {
+			t.Errorf("CleanBucket(%q) = %q, %v", input, bucket, err)
+		}
+	}
+	if _, err := CleanBucket("a/../b"); !IsInvalidPath(err) {
+		t.Errorf("CleanBucket accepted a relative segment")
+	}
+}
+
+func TestJoinKey(t *testing.T) {
+	key, err := JoinKey("builds/nightly", "app.tar")
+	if err != nil || key != "builds/nightly/app.tar" {
+		t.Errorf("JoinKey = %q, %v", key, err)
+	}
+	if _, err := JoinKey("builds", "../../app.tar"); !IsInvalidPath(err) {
+		t.Errorf("JoinKey accepted an escaping file name")
+	}
+	if _, err := JoinKey("..", "app.tar"); !IsInvalidPath(err) {
+		t.Errorf("JoinKey accepted an escaping bucket")
+	}
+}
@@ -0,0 +1,575 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+// checksumHeader stores the SHA-256 checksum of an object in its user metadata. Server side copies keep it.
+const checksumHeader = "X-Amz-Meta-Sha256"
+
+// unsignedPayload tells the server the request body is not part of the signature
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// S3Config describes how to reach an S3 compatible object store
+type S3Config struct {
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+}
+
+// S3 stores buckets as key prefixes within a single bucket of an S3 compatible object store. Requests use
+// path-style addressing so self-hosted stores such as MinIO work without DNS configuration. Unlike the local backend
+// it does not deduplicate contents: identical uploads are stored once per key and only their checksum is recorded.
+type S3 struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+// NewS3 creates an S3 backend after validating the configuration
+func NewS3(config S3Config) (*S3, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, errors.Err("an endpoint and bucket are required for s3 storage")
+	}
+	if config.AccessKey == "" || config.SecretKey == "" {
+		return nil, errors.Err("unable to find credentials for s3 storage")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+
+	endpoint, err := url.Parse(strings.TrimSuffix(config.Endpoint, "/"))
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	return &S3{config: config, endpoint: endpoint, client: &http.Client{}, now: time.Now}, nil
+}
+
+// Put uploads the reader as an object. S3 needs the length up front, so the contents are spooled to a
+// temporary file first unless the reader is already a file. The SHA-256 checksum is stored in the object metadata.
+func (s *S3) Put(key string, r io.Reader) (int64, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return 0, err
+	}
+
+	hash := sha256.New()
+	file, ok := r.(*os.File)
+	if !ok {
+		tmp, err := TempFile("ft-s3-")
+		if err != nil {
+			return 0, errors.Err(err)
+		}
+		defer func() {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}()
+		_, err = io.Copy(io.MultiWriter(tmp, hash), r)
+		if err != nil {
+			return 0, errors.Err(err)
+		}
+		_, err = tmp.Seek(0, io.SeekStart)
+		if err != nil {
+			return 0, errors.Err(err)
+		}
+		file = tmp
+	} else {
+		_, err = io.Copy(hash, file)
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			return 0, errors.Err(err)
+		}
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, errors.Err(err)
+	}
+
+	request, err := s.newRequest(http.MethodPut, key, nil, ioutil.NopCloser(file))
+	if err != nil {
+		return 0, err
+	}
+	request.ContentLength = stat.Size()
+	request.Header.Set(checksumHeader, hex.EncodeToString(hash.Sum(nil)))
+	// Sign again now that the checksum is part of the request
+	s.sign(request)
+
+	resp, err := s.do(request)
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+
+	return stat.Size(), nil
+}
+
+// Get returns a lazily opened object which fetches byte ranges as it is read and seeked
+func (s *S3) Get(key string) (Object, *ObjectInfo, error) {
+	info, err := s.Stat(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &s3Object{store: s, key: info.Key, size: info.Size}, info, nil
+}
+
+// Stat issues a HEAD request for the object
+func (s *S3) Stat(key string) (*ObjectInfo, error) {
+	key, err := CleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := s.newRequest(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(request)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &ObjectInfo{
+		Key:        key,
+		Size:       resp.ContentLength,
+		ModifiedAt: modified,
+		ETag:       resp.Header.Get("ETag"),
+		Checksum:   resp.Header.Get(checksumHeader),
+	}, nil
+}
+
+// List pages through every object below the prefix. Listings do not include metadata, so checksums are left empty.
+func (s *S3) List(prefix string) ([]*ObjectInfo, error) {
+	prefix, err := CleanBucket(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	infos := make([]*ObjectInfo, 0)
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		request, err := s.newRequest(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.do(request)
+		if err != nil {
+			return nil, err
+		}
+
+		result := listBucketResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+
+		for _, c := range result.Contents {
+			infos = append(infos, &ObjectInfo{Key: c.Key, Size: c.Size, ModifiedAt: c.LastModified, ETag: c.ETag})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
+
+// Walk lists the objects below the prefix and visits them in bucket order. Buckets only exist as part of the keys, so
+// every visited entry is a file.
+func (s *S3) Walk(prefix string, visit func(*ObjectInfo) error) error {
+	infos, err := s.List(prefix)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		if c := CompareBuckets(infos[i].Bucket(), infos[j].Bucket()); c != 0 {
+			return c < 0
+		}
+		return infos[i].Key < infos[j].Key
+	})
+
+	skipping, skipped := false, ""
+	for _, info := range infos {
+		bucket := info.Bucket()
+		if skipping && (skipped == "" || bucket == skipped || strings.HasPrefix(bucket, skipped+"/")) {
+			continue
+		}
+		err = visit(info)
+		if errors.Is(err, SkipBucket) {
+			skipping, skipped = true, bucket
+		} else if errors.Is(err, StopWalk) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the object
+func (s *S3) Delete(key string) error {
+	key, err := CleanKey(key)
+	if err != nil {
+		return err
+	}
+	if _, err := s.Stat(key); err != nil {
+		return err
+	}
+
+	request, err := s.newRequest(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(request)
+	if err != nil {
+		return err
+	}
+
+	return errors.Err(resp.Body.Close())
+}
+
+// DeleteBucket removes every object below the bucket prefix. Buckets only exist through their objects, so a bucket
+// without any is reported as not found.
+func (s *S3) DeleteBucket(bucket string, recursive bool) error {
+	bucket, err := CleanBucket(bucket)
+	if err != nil {
+		return err
+	}
+	if bucket == "" {
+		return errors.Err(PathError{bucket, "the root bucket cannot be deleted"})
+	}
+
+	infos, err := s.List(bucket)
+	if err != nil {
+		return err
+	}
+	if len(infos) == 0 {
+		return errors.Err(ErrNotFound)
+	}
+	if !recursive {
+		return errors.Err(ErrNotEmpty)
+	}
+
+	for _, info := range infos {
+		err = s.Delete(info.Key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move copies the object on the server and deletes the source afterwards. S3 has no rename, so the existence
+// check of the destination and the copy are not atomic.
+func (s *S3) Move(src, dst string, overwrite bool) error {
+	err := s.Copy(src, dst, overwrite)
+	if err != nil {
+		return err
+	}
+	return s.Delete(src)
+}
+
+// Copy duplicates the object on the server without transferring its contents
+func (s *S3) Copy(src, dst string, overwrite bool) error {
+	src, err := CleanKey(src)
+	if err != nil {
+		return err
+	}
+	dst, err = CleanKey(dst)
+	if err != nil {
+		return err
+	}
+	if src == dst {
+		return errors.Err(PathError{dst, "the source and destination are the same"})
+	}
+
+	if _, err := s.Stat(src); err != nil {
+		return err
+	}
+	if !overwrite {
+		_, err := s.Stat(dst)
+		if err == nil {
+			return errors.Err(ErrExists)
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+
+	request, err := s.newRequest(http.MethodPut, dst, nil, nil)
+	if err != nil {
+		return err
+	}
+	source := s.objectURL(src)
+	request.Header.Set("X-Amz-Copy-Source", source.EscapedPath()[len(s.endpoint.EscapedPath()):])
+	// Sign again now that the copy source is part of the request
+	s.sign(request)
+
+	resp, err := s.do(request)
+	if err != nil {
+		return err
+	}
+	return errors.Err(resp.Body.Close())
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+		ETag         string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// newRequest builds a signed request for a key within the configured bucket
+func (s *S3) newRequest(method, key string, query url.Values, body io.ReadCloser) (*http.Request, error) {
+	u := s.objectURL(key)
+	if query != nil {
+		u.RawQuery = canonicalQuery(query)
+	}
+
+	request, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	if body != nil {
+		request.Body = body
+	}
+
+	s.sign(request)
+	return request, nil
+}
+
+// newRequestWithRange builds a signed GET for the object starting at the offset
+func (s *S3) newRequestWithRange(key string, offset int64) (*http.Request, error) {
+	u := s.objectURL(key)
+	request, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	request.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+
+	s.sign(request)
+	return request, nil
+}
+
+// objectURL returns the path-style URL of a key, escaped the way the signature expects
+func (s *S3) objectURL(key string) url.URL {
+	u := *s.endpoint
+	p := "/" + s.config.Bucket
+	if key != "" {
+		p += "/" + strings.TrimPrefix(key, "/")
+	}
+	u.Path = s.endpoint.Path + p
+	u.RawPath = s.endpoint.EscapedPath() + uriEncode(p)
+	return u
+}
+
+// do executes a request and converts error statuses into errors
+func (s *S3) do(request *http.Request) (*http.Response, error) {
+	resp, err := s.client.Do(request)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		_ = resp.Body.Close()
+		return nil, errors.Err(ErrNotFound)
+	}
+	if resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		_ = resp.Body.Close()
+		return nil, errors.Err("s3 %s %s failed with status %d: %s", request.Method, request.URL.Path, resp.StatusCode, string(message))
+	}
+
+	return resp, nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to the request
+func (s *S3) sign(request *http.Request) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	headers := map[string]string{
+		"host":                 request.URL.Host,
+		"x-amz-content-sha256": unsignedPayload,
+		"x-amz-date":           amzDate,
+	}
+	if r := request.Header.Get("Range"); r != "" {
+		headers["range"] = r
+	}
+	// Every other x-amz- header, such as the copy source or metadata, has to be signed as well
+	for name := range request.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") && headers[lower] == "" {
+			headers[lower] = request.Header.Get(name)
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + strings.TrimSpace(headers[name]) + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		canonicalQuery(request.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+
+	scope := day + "/" + s.config.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashHex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), day)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.config.AccessKey, scope, signedHeaders, signature))
+}
+
+// canonicalQuery encodes the query string as required by the signature, sorted and with %20 for spaces
+func canonicalQuery(query url.Values) string {
+	return strings.Replace(query.Encode(), "+", "%20", -1)
+}
+
+// uriEncode escapes everything but unreserved characters and slashes
+func uriEncode(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3Object reads an object with ranged GET requests, reopening the stream whenever the offset moves
+type s3Object struct {
+	store  *S3
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+
+	if o.body == nil {
+		request, err := o.store.newRequestWithRange(o.key, o.offset)
+		if err != nil {
+			return 0, err
+		}
+		resp, err := o.store.do(request)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var next int64
+	switch whence {
+	case io.SeekStart:
+		next = offset
+	case io.SeekCurrent:
+		next = o.offset + offset
+	case io.SeekEnd:
+		next = o.size + offset
+	default:
+		return 0, errors.Err("invalid whence %d", whence)
+	}
+	if next < 0 {
+		return 0, errors.Err("negative position %d", next)
+	}
+
+	if next != o.offset && o.body != nil {
+		_ = o.body.Close()
+		o.body = nil
+	}
+	o.offset = next
+	return next, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	return o.body.Close()
+}
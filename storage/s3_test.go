@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+// fakeS3 is a minimal in-memory stand-in for an S3 compatible server such as MinIO
+type fakeS3 struct {
+	t       *testing.T
+	l       sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	sums    map[string]string
+	pageLen int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=access/") || !strings.Contains(auth, "Signature=") {
+		f.t.Errorf("request is not signed: %q", auth)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, "/"+f.bucket)
+	if p == "" && r.Method == http.MethodGet {
+		f.list(w, r)
+		return
+	}
+	key := strings.TrimPrefix(p, "/")
+
+	switch r.Method {
+	case http.MethodPut:
+		if r.ContentLength < 0 {
+			w.WriteHeader(http.StatusLengthRequired)
+			return
+		}
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			if !strings.Contains(r.Header.Get("Authorization"), "x-amz-copy-source") {
+				f.t.Error("the copy source is not signed")
+			}
+			data, ok := f.objects[strings.TrimPrefix(source, "/"+f.bucket+"/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			f.objects[key] = data
+			f.sums[key] = f.sums[strings.TrimPrefix(source, "/"+f.bucket+"/")]
+			return
+		}
+		if !strings.Contains(r.Header.Get("Authorization"), "x-amz-meta-sha256") {
+			f.t.Error("the checksum is not signed")
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = data
+		f.sums[key] = r.Header.Get("X-Amz-Meta-Sha256")
+	case http.MethodHead, http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", `"etag-`+key+`"`)
+		w.Header().Set("X-Amz-Meta-Sha256", f.sums[key])
+		w.Header().Set("Last-Modified", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			data = data[start:]
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		delete(f.sums, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	after := r.URL.Query().Get("continuation-token")
+
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string
+	}{}
+	if len(keys) > f.pageLen {
+		keys = keys[:f.pageLen]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		result.Contents = append(result.Contents, content{key, int64(len(f.objects[key])), time.Unix(0, 0).UTC()})
+	}
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func newTestS3(t *testing.T) (*S3, *fakeS3, func()) {
+	fake := &fakeS3{t: t, bucket: "artifacts", objects: map[string][]byte{}, sums: map[string]string{}, pageLen: 2}
+	server := httptest.NewServer(fake)
+
+	s, err := NewS3(S3Config{Endpoint: server.URL, Bucket: "artifacts", AccessKey: "access", SecretKey: "secret"})
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return s, fake, server.Close
+}
+
+func TestS3PutGet(t *testing.T) {
+	s, fake, cleanup := newTestS3(t)
+	defer cleanup()
+
+	n, err := s.Put("builds/app with space.tar", strings.NewReader("0123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 || string(fake.objects["builds/app with space.tar"]) != "0123456789" {
+		t.Fatalf("Put stored %q (%d bytes)", fake.objects["builds/app with space.tar"], n)
+	}
+
+	obj, info, err := s.Get("builds/app with space.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	if info.Size != 10 || info.ETag == "" || info.Checksum != "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882" {
+		t.Errorf("unexpected info %+v", info)
+	}
+
+	if _, err := obj.Seek(4, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "456789" {
+		t.Errorf("ranged read returned %q", data)
+	}
+}
+
+func TestS3ListPages(t *testing.T) {
+	s, _, cleanup := newTestS3(t)
+	defer cleanup()
+
+	for _, key := range []string{"a/1", "a/2", "a/3", "b/1", "a/sub/4"} {
+		if _, err := s.Put(key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	infos, err := s.List("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, info := range infos {
+		keys = append(keys, info.Key)
+	}
+	if strings.Join(keys, ",") != "a/1,a/2,a/3,a/sub/4" {
+		t.Errorf("List returned %v", keys)
+	}
+
+	keys = nil
+	err = s.Walk("", func(info *ObjectInfo) error {
+		keys = append(keys, info.Key)
+		if info.Key == "a/sub/4" {
+			return SkipBucket
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "a/1,a/2,a/3,a/sub/4,b/1" {
+		t.Errorf("Walk visited %v", keys)
+	}
+}
+
+func TestS3NotFound(t *testing.T) {
+	s, _, cleanup := newTestS3(t)
+	defer cleanup()
+
+	if _, _, err := s.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get: expected ErrNotFound, got %v", err)
+	}
+	if err := s.Delete("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestS3MoveCopyDelete(t *testing.T) {
+	s, _, cleanup := newTestS3(t)
+	defer cleanup()
+	testMoveCopyDelete(t, s)
+}
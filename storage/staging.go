@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+// StagingDirName is the hidden directory below the data directory holding the temporary files of requests in
+// progress, such as held uploads, archives being extracted, chunks being received and files spooled for S3.
+const StagingDirName = ".staging"
+
+// StagingDir is where TempFile creates its files. It is emptied at startup, since nothing in it outlives the request
+// that created it. Empty uses the temporary directory of the system.
+var StagingDir = ""
+
+// TempFile creates a new temporary file in StagingDir, with a name starting with the prefix. The caller removes it.
+func TempFile(prefix string) (*os.File, error) {
+	if StagingDir != "" {
+		err := os.MkdirAll(StagingDir, 0700)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+	}
+	tmp, err := ioutil.TempFile(StagingDir, prefix)
+	return tmp, errors.Err(err)
+}
+
+// ClearStaging removes the files that requests interrupted by a crash or restart left in the staging directory and
+// returns how many there were. It must run before any request is served.
+func ClearStaging(dir string) (int, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Err(err)
+	}
+
+	for i, info := range infos {
+		err = os.RemoveAll(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return i, errors.Err(err)
+		}
+	}
+	return len(infos), nil
+}
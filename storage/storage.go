@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"io"
+	"path"
+	"time"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+// ErrNotFound is returned when a key does not exist in the storage backend
+var ErrNotFound = errors.Base("object not found")
+
+// ErrExists is returned when a move or copy would replace an existing object without being asked to
+var ErrExists = errors.Base("object already exists")
+
+// ErrNotEmpty is returned when deleting a bucket that still holds files without deleting recursively
+var ErrNotEmpty = errors.Base("bucket is not empty")
+
+// SkipBucket is returned by a Walk visitor to leave out the rest of a bucket and every bucket nested below it
+var SkipBucket = errors.Base("skip this bucket")
+
+// StopWalk is returned by a Walk visitor to end the walk early
+var StopWalk = errors.Base("stop the walk")
+
+// Default is the backend used by the upload, download and bucket handlers
+var Default Storage
+
+// Storage is the backend holding the contents of every bucket. Keys are slash separated paths relative to the
+// root of the storage, where everything up to the last slash is the bucket.
+type Storage interface {
+	// Put stores the contents of the reader under the key, replacing any existing object once fully written
+	Put(key string, r io.Reader) (int64, error)
+	// Get opens an object for reading. The returned object supports seeking so it can serve range requests.
+	Get(key string) (Object, *ObjectInfo, error)
+	// Stat returns the information about a single object or directory
+	Stat(key string) (*ObjectInfo, error)
+	// List returns every entry below the prefix, recursively, sorted by key
+	List(prefix string) ([]*ObjectInfo, error)
+	// Walk visits every entry below the prefix in bucket order, as defined by CompareBuckets: the files of a bucket
+	// sorted by name, each bucket before the files and buckets it holds. The visitor may return SkipBucket or StopWalk.
+	Walk(prefix string, visit func(*ObjectInfo) error) error
+	// Delete removes an object
+	Delete(key string) error
+	// DeleteBucket removes a bucket. Buckets that still hold files are only removed when recursive is set.
+	DeleteBucket(bucket string, recursive bool) error
+	// Move renames an object. An existing destination is only replaced when overwrite is set.
+	Move(src, dst string, overwrite bool) error
+	// Copy duplicates an object. An existing destination is only replaced when overwrite is set.
+	Copy(src, dst string, overwrite bool) error
+}
+
+// Object is an open, seekable object returned by Storage.Get
+type Object interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// ObjectInfo describes an entry in the storage backend
+type ObjectInfo struct {
+	Key        string
+	Size       int64
+	ModifiedAt time.Time
+	ETag       string
+	IsDir      bool
+	// Checksum is the hex encoded SHA-256 of the contents, empty if the backend does not know it
+	Checksum string
+}
+
+// Name returns the last element of the key
+func (o *ObjectInfo) Name() string {
+	return path.Base(o.Key)
+}
+
+// Bucket returns the bucket portion of the key, or an empty string for entries at the root
+func (o *ObjectInfo) Bucket() string {
+	return BucketOf(o.Key)
+}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"io"
 	"mime/multipart"
 	"os"
 
@@ -23,3 +24,19 @@ func CloseMPFile(f multipart.File) {
 		logrus.Error(errors.Err(err))
 	}
 }
+
+//CloseMPPart closes the multipart part safely while still reporting the error to the logs
+func CloseMPPart(p *multipart.Part) {
+	err := p.Close()
+	if err != nil {
+		logrus.Error(errors.Err(err))
+	}
+}
+
+//CloseObject closes the storage object safely while still reporting the error to the logs
+func CloseObject(c io.Closer) {
+	err := c.Close()
+	if err != nil {
+		logrus.Error(errors.Err(err))
+	}
+}
@@ -0,0 +1,82 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+//WriteFileAtomic writes the contents to a hidden temporary file next to path, syncs it and renames it into place
+func WriteFileAtomic(path string, contents []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return errors.Err(err)
+	}
+	_, err = tmp.Write(contents)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return errors.Err(err)
+	}
+
+	return SyncDir(filepath.Dir(path))
+}
+
+// RemoveAtomicTemps removes the temporary files WriteFileAtomic left next to path when it was interrupted, and returns
+// how many there were. They have to stay in the same directory to be renamed into place, so they are found by name.
+func RemoveAtomicTemps(path string) (int, error) {
+	dir, prefix := filepath.Dir(path), "."+filepath.Base(path)+"."
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Err(err)
+	}
+
+	var removed int
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, err := strconv.ParseUint(name[len(prefix):], 10, 64); err != nil {
+			continue
+		}
+		err = os.Remove(filepath.Join(dir, name))
+		if err != nil {
+			return removed, errors.Err(err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// SyncDir flushes a directory to disk, so the files created, renamed or removed in it survive a crash
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Err(err)
+	}
+	err = d.Sync()
+	closeErr := d.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return errors.Err(err)
+}
@@ -0,0 +1,318 @@
+package versions
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tiger5226/filetransfer/metadata"
+	"github.com/tiger5226/filetransfer/storage"
+	"github.com/tiger5226/filetransfer/util"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+// ErrNotFound is returned when a file has no version with the requested id
+var ErrNotFound = errors.Base("version not found")
+
+// idFormat turns the modification time of a version into the start of its id, so ids sort in time order
+const idFormat = "20060102T150405.000000000Z"
+
+// Default is the version store used by the handlers
+var Default *Store
+
+// Version describes one version of a file. The current version is the file itself.
+type Version struct {
+	ID         string
+	Size       int64
+	ModifiedAt time.Time
+	Checksum   string
+	Current    bool
+}
+
+// Store keeps the previous versions of files in buckets with versioning enabled. The versions live in their own
+// storage, each under the key of the file followed by the version id, so they never show up in the buckets. Which
+// buckets are versioned is kept in a JSON file; a setting covers every bucket nested below unless it has one of its
+// own. Versions outlive files deleted one by one, so a deleted file can be restored as well, while expiring a file
+// or deleting a whole bucket removes its versions too. The metadata of each version is kept in the metadata store.
+type Store struct {
+	l        sync.RWMutex
+	path     string
+	settings map[string]bool
+	versions storage.Storage
+}
+
+// Open loads the versioning settings from the file at path. Previous versions are kept in the given storage.
+func Open(path string, versions storage.Storage) (*Store, error) {
+	s := &Store{path: path, settings: map[string]bool{}, versions: versions}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, errors.Err(err)
+	}
+
+	err = json.Unmarshal(contents, &s.settings)
+	if err != nil {
+		return nil, errors.Prefix("unable to read versioning settings: ", err)
+	}
+
+	return s, nil
+}
+
+// Enable turns versioning of the bucket on or off. Turning it off keeps the versions stored so far.
+func (s *Store) Enable(bucket string, enabled bool) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	previous, existed := s.settings[bucket]
+	s.settings[bucket] = enabled
+	err := s.save()
+	if err != nil {
+		if existed {
+			s.settings[bucket] = previous
+		} else {
+			delete(s.settings, bucket)
+		}
+	}
+	return err
+}
+
+// Enabled reports whether files in the bucket are versioned, going by the nearest bucket with a setting
+func (s *Store) Enabled(bucket string) bool {
+	s.l.RLock()
+	defer s.l.RUnlock()
+
+	for b := bucket; ; b = storage.BucketOf(b) {
+		if enabled, ok := s.settings[b]; ok {
+			return enabled
+		}
+		if b == "" {
+			return false
+		}
+	}
+}
+
+// Keep stores the current contents of the file, along with its metadata, as a version before it is replaced. It
+// returns the id of the version, or "" when nothing new was kept because the file does not exist yet, is not in a
+// versioned bucket or was kept before. Should replacing the file fail after all, Discard removes the version again.
+func (s *Store) Keep(st storage.Storage, key string) (string, error) {
+	if !s.Enabled(storage.BucketOf(key)) {
+		return "", nil
+	}
+
+	object, info, err := st.Get(key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer util.CloseObject(object)
+
+	id := versionID(info)
+	if _, err := s.versions.Stat(key + "/" + id); err == nil {
+		// The same version was kept before, for example when it was restored
+		return "", nil
+	}
+	_, err = s.versions.Put(key+"/"+id, object)
+	if err == nil && metadata.Default != nil {
+		err = metadata.Default.KeepVersion(key, id)
+		if err != nil {
+			_ = s.versions.Delete(key + "/" + id)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Discard removes a version Keep stored for a replacement that did not happen after all. An empty id does nothing.
+func (s *Store) Discard(key, id string) error {
+	if id == "" {
+		return nil
+	}
+	err := s.versions.Delete(key + "/" + id)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	if metadata.Default != nil {
+		return metadata.Default.RemoveVersion(key, id)
+	}
+	return nil
+}
+
+// List returns the versions of a file, newest first, starting with the file itself if it exists
+func (s *Store) List(st storage.Storage, key string) ([]*Version, error) {
+	versions := make([]*Version, 0)
+	current, err := st.Stat(key)
+	if err == nil && !current.IsDir {
+		versions = append(versions, newVersion(current, versionID(current), true))
+	} else if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+
+	infos, err := s.versions.List(key)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.IsDir || info.Bucket() != key {
+			continue
+		}
+		if len(versions) > 0 && versions[0].Current && info.Name() == versions[0].ID {
+			continue
+		}
+		versions = append(versions, newVersion(info, info.Name(), false))
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].Current || !versions[j].Current && versions[i].ID > versions[j].ID
+	})
+	if len(versions) == 0 {
+		return nil, errors.Err(storage.ErrNotFound)
+	}
+	return versions, nil
+}
+
+// Get opens a version of a file, which may be the current one. The returned info describes the file itself.
+func (s *Store) Get(st storage.Storage, key, id string) (storage.Object, *storage.ObjectInfo, error) {
+	if strings.Contains(id, "/") {
+		return nil, nil, errors.Err(ErrNotFound)
+	}
+
+	object, info, err := st.Get(key)
+	if err == nil && versionID(info) == id {
+		return object, info, nil
+	} else if err == nil {
+		util.CloseObject(object)
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return nil, nil, err
+	}
+
+	object, info, err = s.versions.Get(key + "/" + id)
+	if errors.Is(err, storage.ErrNotFound) || storage.IsInvalidPath(err) {
+		return nil, nil, errors.Err(ErrNotFound)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	info.Key = key
+	return object, info, nil
+}
+
+// Restore makes a previous version the current contents of the file, with the metadata it had. The contents it
+// replaces are kept as a version first, so a restore can be undone the same way.
+func (s *Store) Restore(st storage.Storage, key, id string) error {
+	object, _, err := s.Get(st, key, id)
+	if err != nil {
+		return err
+	}
+	defer util.CloseObject(object)
+
+	current, err := st.Stat(key)
+	if err == nil && versionID(current) == id {
+		return nil
+	}
+
+	kept, err := s.Keep(st, key)
+	if err != nil {
+		return err
+	}
+	_, err = st.Put(key, object)
+	if err != nil {
+		_ = s.Discard(key, kept)
+		return err
+	}
+	if metadata.Default != nil {
+		return metadata.Default.RestoreVersion(key, id)
+	}
+	return nil
+}
+
+// Remove deletes every previous version of a file along with their metadata
+func (s *Store) Remove(key string) error {
+	infos, err := s.versions.List(key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		// Versions of files in a bucket that has since taken the name of the file are not the file's
+		if info.IsDir || info.Bucket() != key {
+			continue
+		}
+		err = s.versions.Delete(info.Key)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	if metadata.Default != nil {
+		return metadata.Default.RemoveVersions(key)
+	}
+	return nil
+}
+
+// RemoveBucket deletes the previous versions of every file in the bucket and the buckets nested below it, along with
+// their versioning settings
+func (s *Store) RemoveBucket(bucket string) error {
+	err := s.versions.DeleteBucket(bucket, true)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	removed := map[string]bool{}
+	for b, enabled := range s.settings {
+		if b == bucket || strings.HasPrefix(b, bucket+"/") {
+			removed[b] = enabled
+			delete(s.settings, b)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	err = s.save()
+	if err != nil {
+		for b, enabled := range removed {
+			s.settings[b] = enabled
+		}
+	}
+	return err
+}
+
+// save writes the settings to disk. The caller must hold the lock.
+func (s *Store) save() error {
+	contents, err := json.MarshalIndent(s.settings, "", "  ")
+	if err != nil {
+		return errors.Err(err)
+	}
+
+	return util.WriteFileAtomic(s.path, contents, 0600)
+}
+
+// versionID derives the id of a version from its modification time and, where known, its checksum. Backends that
+// only keep whole seconds would otherwise give two versions written within a second the same id.
+func versionID(info *storage.ObjectInfo) string {
+	id := info.ModifiedAt.UTC().Format(idFormat)
+	if len(info.Checksum) >= 12 {
+		id += "-" + info.Checksum[:12]
+	}
+	return id
+}
+
+// newVersion describes a version. Kept versions were written when they were replaced, so their modification time
+// is taken from the id.
+func newVersion(info *storage.ObjectInfo, id string, current bool) *Version {
+	v := &Version{ID: id, Size: info.Size, ModifiedAt: info.ModifiedAt, Checksum: info.Checksum, Current: current}
+	if modified, err := time.Parse(idFormat, strings.SplitN(id, "-", 2)[0]); err == nil && !current {
+		v.ModifiedAt = modified
+	}
+	return v
+}
@@ -0,0 +1,144 @@
+package versions
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tiger5226/filetransfer/storage"
+
+	"github.com/lbryio/lbry.go/extras/errors"
+)
+
+func newTestStore(t *testing.T) (*Store, *storage.Local, func()) {
+	dir, err := ioutil.TempDir("", "ft-versions-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := storage.NewLocal(filepath.Join(dir, "data"))
+	data.UID, data.GID = os.Getuid(), os.Getgid()
+	kept := storage.NewLocal(filepath.Join(dir, "versions"))
+	kept.UID, kept.GID = os.Getuid(), os.Getgid()
+
+	store, err := Open(filepath.Join(dir, "versioning.json"), kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, data, func() { _ = os.RemoveAll(dir) }
+}
+
+func read(t *testing.T, object storage.Object) string {
+	defer func() { _ = object.Close() }()
+	contents, err := ioutil.ReadAll(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+func TestVersions(t *testing.T) {
+	store, data, cleanup := newTestStore(t)
+	defer cleanup()
+
+	put := func(contents string) {
+		if _, err := store.Keep(data, "release/app"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := data.Put("release/app", strings.NewReader(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	put("unversioned 1")
+	put("unversioned 2")
+	if history, err := store.List(data, "release/app"); err != nil || len(history) != 1 {
+		t.Fatalf("an unversioned bucket kept versions: %v %v", history, err)
+	}
+
+	if err := store.Enable("release", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Enable("release/nightly", false); err != nil {
+		t.Fatal(err)
+	}
+	if !store.Enabled("release/beta") || store.Enabled("release/nightly/x") || store.Enabled("other") {
+		t.Error("the versioning settings were not inherited as expected")
+	}
+
+	put("version 3")
+	put("version 4")
+	history, err := store.List(data, "release/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || !history[0].Current || history[1].ID <= history[2].ID {
+		t.Fatalf("unexpected history %+v", history)
+	}
+
+	object, info, err := store.Get(data, "release/app", history[2].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents := read(t, object); contents != "unversioned 2" || info.Key != "release/app" {
+		t.Errorf("the oldest version holds %q as %s", contents, info.Key)
+	}
+	if _, _, err := store.Get(data, "release/app", "20000101T000000.000000000Z"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("an unknown version returned %v", err)
+	}
+
+	// A version kept for a replacement that failed is discarded again
+	kept, err := store.Keep(data, "release/app")
+	if err != nil || kept == "" {
+		t.Fatalf("nothing was kept: %v", err)
+	}
+	if again, err := store.Keep(data, "release/app"); err != nil || again != "" {
+		t.Errorf("the same contents were kept twice as %q: %v", again, err)
+	}
+	if err := store.Discard("release/app", kept); err != nil {
+		t.Fatal(err)
+	}
+	if discarded, _ := store.List(data, "release/app"); len(discarded) != 3 {
+		t.Errorf("the version was not discarded: %+v", discarded)
+	}
+
+	// A deleted file can be brought back, and the restore itself is undoable
+	if _, err := store.Keep(data, "release/app"); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.Delete("release/app"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Restore(data, "release/app", history[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	object, _, err = data.Get("release/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents := read(t, object); contents != "version 3" {
+		t.Errorf("the restored file holds %q", contents)
+	}
+	if err := store.Restore(data, "release/app", history[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if history, _ := store.List(data, "release/app"); len(history) != 5 {
+		t.Errorf("restoring did not keep the replaced contents: %+v", history)
+	}
+
+	// Expired files and deleted buckets take their versions along
+	if err := store.Remove("release/app"); err != nil {
+		t.Fatal(err)
+	}
+	if history, _ := store.List(data, "release/app"); len(history) != 1 {
+		t.Errorf("the versions of the file were not removed: %+v", history)
+	}
+	put("version 5")
+	if err := store.RemoveBucket("release"); err != nil {
+		t.Fatal(err)
+	}
+	if history, _ := store.List(data, "release/app"); len(history) != 1 || store.Enabled("release") {
+		t.Errorf("the versions of the bucket were not removed: %+v", history)
+	}
+}